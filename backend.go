@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/oxplot/svglinkify/linkify"
+)
+
+// Backend renders SVGs to PDFs and tells where the objects in them end up
+type Backend interface {
+	// BoundingBoxes returns the bounding boxes of all the objects with an id
+	// in the SVG at svgPath, whose content is svgContent. If ids isn't nil,
+	// only the objects with those ids are needed, and the backend may leave
+	// out the rest.
+	BoundingBoxes(ctx context.Context, svgPath, svgContent string, ids []string) (map[string]*linkify.PositionedObject, error)
+
+	// Render exports the SVG at svgPath to a PDF at pdfPath. If ctx is done
+	// before it finishes, whatever was written to pdfPath is removed.
+	Render(ctx context.Context, svgPath, pdfPath string) error
+}
+
+// toolError returns the error msg for a tool having failed, followed by each
+// line the tool wrote to stderr with prefix (the tool and what it was doing,
+// e.g. "inkscape export") before it, so its output can be told apart from
+// ours and from that of the other tool running at the same time
+func toolError(msg, prefix string, stderr []byte) error {
+	b := strings.Builder{}
+	b.WriteString(msg)
+	for _, line := range strings.Split(string(stderr), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			fmt.Fprintf(&b, "\n%s: %s", prefix, line)
+		}
+	}
+	return errors.New(b.String())
+}
+
+// Names of the backends, see -backend
+const (
+	BackendInkscape = "inkscape"
+	BackendRsvg     = "rsvg"
+)
+
+// The id is matched greedily so that ids containing commas still leave the
+// last four fields as the bounding box
+var bboxRegexp = regexp.MustCompile(`(?m)^(.+),([^,\n]+),([^,\n]+),([^,\n]+),([^,\n]+)$`)
+
+var inkscapeVersionRegexp = regexp.MustCompile(`Inkscape\s+(\d+)\.(\d+)`)
+
+// parseInkscapeVersion returns the major and minor version from the output of
+// inkscape --version, e.g. "Inkscape 0.92.4 (5da689c313, 2019-01-14)"
+func parseInkscapeVersion(s string) (int, int, error) {
+	m := inkscapeVersionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, fmt.Errorf("cannot find inkscape version in '%s'", strings.TrimSpace(s))
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor, nil
+}
+
+// inkscapeBackend asks inkscape for bounding boxes and renders with it
+type inkscapeBackend struct {
+	path string
+
+	// major is the major version of inkscape, which decides the command line
+	// syntax: 1.0 replaced -S with --query-all and --export-pdf with
+	// --export-filename
+	major int
+
+	// version is the full version inkscape reports, which bounding boxes are
+	// cached by along with the SVG
+	version string
+}
+
+// inkscapeVersionEnv is the environment variable holding the output of
+// inkscape --version, if it's already known
+const inkscapeVersionEnv = "SVGLINKIFY_INKSCAPE_VERSION"
+
+// newInkscapeBackend returns the backend for the inkscape at path, after
+// asking it for its version
+func newInkscapeBackend(ctx context.Context, path string) (*inkscapeBackend, error) {
+	// -batch asks once and passes the version on to each conversion
+	out := []byte(os.Getenv(inkscapeVersionEnv))
+	if len(out) == 0 {
+		var err error
+		if out, err = exec.CommandContext(ctx, path, "--version").Output(); err != nil {
+			return nil, fmt.Errorf("cannot run inkscape to get its version: %s", err)
+		}
+	}
+	major, _, err := parseInkscapeVersion(string(out))
+	if err != nil {
+		return nil, err
+	}
+	return &inkscapeBackend{path: path, major: major, version: strings.TrimSpace(string(out))}, nil
+}
+
+// queryArg returns the argument for querying the bounding boxes of all
+// objects
+func (b *inkscapeBackend) queryArg() string {
+	if b.major >= 1 {
+		return "--query-all"
+	}
+	return "-S"
+}
+
+func (b *inkscapeBackend) BoundingBoxes(ctx context.Context, svgPath, svgContent string, ids []string) (map[string]*linkify.PositionedObject, error) {
+	if *noCache {
+		return b.queryBoundingBoxes(ctx, svgPath, ids)
+	}
+	cachePath, err := b.cachePath(svgContent)
+	if err != nil {
+		verbosef("not caching bounding boxes: %s", err)
+		return b.queryBoundingBoxes(ctx, svgPath, ids)
+	}
+	if v, err := ioutil.ReadFile(cachePath); err == nil {
+		var allObjects map[string]*linkify.PositionedObject
+		if err := json.Unmarshal(v, &allObjects); err == nil {
+			verbosef("using cached bounding boxes from %s", cachePath)
+			return allObjects, nil
+		}
+	}
+	if ids != nil {
+		// Only the boxes of all the objects are cached, which have whatever
+		// ids later runs need
+		return b.queryBoundingBoxes(ctx, svgPath, ids)
+	}
+	allObjects, err := b.queryBoundingBoxes(ctx, svgPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(allObjects) == 0 {
+		// Most likely inkscape couldn't handle the query, which may well
+		// change with another version
+		return allObjects, nil
+	}
+	if err := writeCache(cachePath, allObjects); err != nil {
+		verbosef("cannot cache bounding boxes: %s", err)
+	}
+	return allObjects, nil
+}
+
+// cachePath returns where the bounding boxes of the SVG with svgContent are
+// cached, which is keyed by the SVG and the version of inkscape
+func (b *inkscapeBackend) cachePath(svgContent string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", b.version, b.queryArg())
+	io.WriteString(h, svgContent)
+	return filepath.Join(dir, "svglinkify", hex.EncodeToString(h.Sum(nil))+".json"), nil
+}
+
+// writeCache writes the bounding boxes to the cache file at path, in a way
+// that concurrent runs never see it half written
+func writeCache(path string, allObjects map[string]*linkify.PositionedObject) error {
+	v, err := json.Marshal(allObjects)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(v)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runQuery runs inkscape with the given arguments to query bounding boxes and
+// returns what it outputs
+func (b *inkscapeBackend) runQuery(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, b.path, args...)
+	cmd.Env = cLocaleEnv()
+	verbosef("running %s", strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("inkscape was stopped while calculating bounding boxes: %s", ctx.Err())
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, toolError("inkscape errored when calculating bounding boxes", "inkscape query", exitErr.Stderr)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// queryBoundingBoxes asks inkscape for the bounding boxes of the objects with
+// the given ids in the SVG at svgPath, or of all the objects if ids is nil
+func (b *inkscapeBackend) queryBoundingBoxes(ctx context.Context, svgPath string, ids []string) (map[string]*linkify.PositionedObject, error) {
+	if ids != nil {
+		allObjects, err := b.queryIDBoundingBoxes(ctx, svgPath, ids)
+		if allObjects != nil || err != nil {
+			return allObjects, err
+		}
+		verbosef("querying the bounding boxes of all objects instead")
+	}
+	inkBBoxOut, err := b.runQuery(ctx, b.queryArg(), svgPath)
+	if err != nil {
+		return nil, err
+	}
+	bboxMatches := bboxRegexp.FindAllStringSubmatch(string(inkBBoxOut), -1)
+	verbosef("inkscape gave %d bounding box line(s)", len(bboxMatches))
+
+	// Parse all bounding box as objects
+	allObjects := map[string]*linkify.PositionedObject{}
+
+	for _, bb := range bboxMatches {
+		// inkscape lists objects in document order, and of those with the
+		// same id the first is the one links to it go to
+		if _, ok := allObjects[strings.TrimSpace(bb[1])]; !ok {
+			inkBBoxToObject(bb, allObjects)
+		}
+	}
+	return allObjects, nil
+}
+
+// queryIDBoundingBoxes asks inkscape for the bounding boxes of only the
+// objects with the given ids. Inkscape 1.0 and later are asked for all of
+// them in one run, and older versions for each in a run of its own, which
+// skips those inkscape can't find. If inkscape can't be asked this way, it
+// returns nil so that all the objects are queried instead.
+func (b *inkscapeBackend) queryIDBoundingBoxes(ctx context.Context, svgPath string, ids []string) (map[string]*linkify.PositionedObject, error) {
+	allObjects := map[string]*linkify.PositionedObject{}
+	if b.major < 1 {
+		// The queries go to a single inkscape in shell mode if it starts
+		// and keeps running, which saves starting one for each
+
+		var shell *inkscapeShell
+		if len(ids) > 1 {
+			var err error
+			if shell, err = startInkscapeShell(ctx, b.path); err != nil {
+				verbosef("running inkscape for each id as its shell didn't start: %s", err)
+			} else {
+				defer func() {
+					if shell != nil {
+						shell.close()
+					}
+				}()
+			}
+		}
+		for _, id := range ids {
+			args := []string{"-I", id, "-X", "-Y", "-W", "-H", svgPath}
+			var out []byte
+			var err error
+			if shell != nil {
+				if out, err = shell.run(args...); err != nil && ctx.Err() == nil {
+					verbosef("running inkscape for each id from now on: %s", err)
+					shell.close()
+					shell = nil
+				}
+			}
+			if shell == nil {
+				out, err = b.runQuery(ctx, args...)
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			boxes := idQueryBoxes(out, 1)
+			if err != nil || boxes == nil {
+				verbosef("inkscape gave no bounding box for id '%s'", id)
+				continue
+			}
+			o := boxes[0]
+			o.ID = id
+			allObjects[id] = &o
+		}
+		return allObjects, nil
+	}
+
+	// The ids are given as one comma separated list, which won't do for
+	// ids with commas, and a single one inkscape can't find fails the run
+
+	for _, id := range ids {
+		if strings.ContainsRune(id, ',') {
+			verbosef("cannot query the bounding box of id '%s' on its own as it has a comma", id)
+			return nil, nil
+		}
+	}
+	if len(ids) == 0 {
+		return allObjects, nil
+	}
+	out, err := b.runQuery(ctx, "--query-id="+strings.Join(ids, ","), "--query-x", "--query-y", "--query-width", "--query-height", svgPath)
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	boxes := idQueryBoxes(out, len(ids))
+	if err != nil || boxes == nil {
+		verbosef("inkscape gave no bounding boxes for the ids (%v)", err)
+		return nil, nil
+	}
+	for i, id := range ids {
+		o := boxes[i]
+		o.ID = id
+		allObjects[id] = &o
+	}
+	return allObjects, nil
+}
+
+// idQueryBoxes parses what inkscape outputs when queried for the x, y, width
+// and height of n objects: a line for each, holding the values of all the
+// objects separated by commas. It returns nil if the output is anything else.
+func idQueryBoxes(out []byte, n int) []linkify.PositionedObject {
+	lines := strings.Fields(string(out))
+	if len(lines) != 4 {
+		return nil
+	}
+	boxes := make([]linkify.PositionedObject, n)
+	for i, line := range lines {
+		values := strings.Split(line, ",")
+		if len(values) != n {
+			return nil
+		}
+		for j, v := range values {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil
+			}
+			o := &boxes[j]
+			field := [4]*float64{&o.X, &o.Y, &o.W, &o.H}[i]
+			*field = f
+		}
+	}
+	return boxes
+}
+
+// cLocaleEnv returns the environment with the C locale in effect, so that
+// inkscape writes numbers with a decimal point rather than the decimal comma
+// of some locales, which would be mistaken for the field separator
+func cLocaleEnv() []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "LC_ALL=") && !strings.HasPrefix(e, "LC_NUMERIC=") {
+			env = append(env, e)
+		}
+	}
+	return append(env, "LC_ALL=C", "LC_NUMERIC=C")
+}
+
+// inkBBoxToObject parses the fields of a line of inkscape's bounding box
+// output and adds the object to allObjects. Fields may be padded with spaces
+// (or end in a carriage return) and numbers may be in scientific notation, as
+// inkscape 1.x sometimes outputs.
+func inkBBoxToObject(bb []string, allObjects map[string]*linkify.PositionedObject) {
+	o := linkify.PositionedObject{ID: strings.TrimSpace(bb[1])}
+	for i, f := range []struct {
+		name string
+		v    *float64
+	}{{"X", &o.X}, {"Y", &o.Y}, {"W", &o.W}, {"H", &o.H}} {
+		s := strings.TrimSpace(bb[i+2])
+		var err error
+		if *f.v, err = strconv.ParseFloat(s, 64); err != nil {
+			log.Printf("inkscape gave us '%s' which is invalid as %s for id '%s' - ignoring object", s, f.name, o.ID)
+			return
+		}
+	}
+	allObjects[o.ID] = &o
+}
+
+// exportArgs returns the inkscape arguments for exporting the SVG at svgPath
+// to the PDF at pdfPath. Those given with -inkscape-arg come before the
+// output and input so they can't take their place.
+func (b *inkscapeBackend) exportArgs(svgPath, pdfPath string) []string {
+	args := []string{"--export-dpi", strconv.Itoa(*exportDPI)}
+
+	// Inkscape takes the opacity of the background on its own
+
+	color, opacity := *bgColor, *bgOpacity
+	if _, a, err := linkify.ParseRGBA(color); err == nil && len(color) == 9 {
+		color, opacity = color[:7], strconv.FormatFloat(a, 'g', 3, 64)
+	}
+	if color != "" {
+		args = append(args, "--export-background", color)
+	}
+	if opacity != "" {
+		args = append(args, "--export-background-opacity", opacity)
+	}
+	args = append(args, inkscapeArgs...)
+	if b.major >= 1 {
+		return append(args, "--export-type=pdf", "--export-filename="+pdfPath, svgPath)
+	}
+	return append(args, "--export-pdf", pdfPath, svgPath)
+}
+
+func (b *inkscapeBackend) Render(ctx context.Context, svgPath, pdfPath string) error {
+	cmd := exec.CommandContext(ctx, b.path, b.exportArgs(svgPath, pdfPath)...)
+	verbosef("running %s", strings.Join(cmd.Args, " "))
+	if _, err := cmd.Output(); err != nil {
+		if ctx.Err() != nil {
+			os.Remove(pdfPath)
+			return fmt.Errorf("inkscape was stopped while generating PDF: %s", ctx.Err())
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return toolError("inkscape errored while generating PDF", "inkscape export", exitErr.Stderr)
+		}
+		return err
+	}
+	return nil
+}
+
+// rsvgBackend renders with rsvg-convert, which can't report bounding boxes,
+// so they're computed from the SVG instead
+type rsvgBackend struct {
+	path string
+}
+
+func (b *rsvgBackend) BoundingBoxes(ctx context.Context, svgPath, svgContent string, ids []string) (map[string]*linkify.PositionedObject, error) {
+	return linkify.SVGBoundingBoxes(strings.NewReader(svgContent))
+}
+
+func (b *rsvgBackend) Render(ctx context.Context, svgPath, pdfPath string) error {
+	args := []string{"--format", "pdf", "--output", pdfPath}
+	if *bgColor != "" {
+		args = append(args, "--background-color", *bgColor)
+	}
+	cmd := exec.CommandContext(ctx, b.path, append(args, svgPath)...)
+	verbosef("running %s", strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			os.Remove(pdfPath)
+			return fmt.Errorf("rsvg-convert was stopped while generating PDF: %s", ctx.Err())
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return toolError("rsvg-convert errored while generating PDF", "rsvg-convert export", out)
+		}
+		return err
+	}
+	return nil
+}
+
+// resolveToolPath expands a leading ~ to the home directory, resolves p, the
+// path to the named tool, to an absolute path and checks that it's
+// executable. A bare name without any directory is looked up in PATH.
+func resolveToolPath(tool, p string) (string, error) {
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot expand '%s': %s", p, err)
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	if !strings.ContainsRune(p, filepath.Separator) && !strings.ContainsRune(p, '/') {
+		lp, err := exec.LookPath(p)
+		if err != nil {
+			return "", fmt.Errorf("cannot find %s '%s' in PATH", tool, p)
+		}
+		p = lp
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("cannot find %s at '%s'", tool, abs)
+	}
+	if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0111 == 0) {
+		return "", fmt.Errorf("%s at '%s' is not executable", tool, abs)
+	}
+	return abs, nil
+}
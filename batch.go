@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// findSVGs returns the paths of all the SVGs within dir, compressed or not,
+// skipping our own temporary files
+func findSVGs(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && isSVGExt(filepath.Ext(p)) && !strings.HasPrefix(fi.Name(), ".svglinkify-") {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// isSVGExt reports whether ext is the extension of an SVG or a compressed
+// SVG
+func isSVGExt(ext string) bool {
+	return strings.EqualFold(ext, ".svg") || strings.EqualFold(ext, ".svgz")
+}
+
+// batchArgs returns the command line options given to us, less those for
+// -batch itself, to pass on to the conversion of each SVG
+func batchArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "batch", "jobs":
+		case "inkscape-arg":
+			for _, a := range inkscapeArgs {
+				args = append(args, "-inkscape-arg="+a)
+			}
+		default:
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// convertBatch converts every SVG within dir to a PDF next to it and prints a
+// summary. Each SVG is converted by running ourselves again so that a failing
+// one doesn't stop the others. It returns false if any of them failed.
+func convertBatch(dir string) bool {
+	svgs, err := findSVGs(dir)
+	if err != nil {
+		fatal(err)
+	}
+	if len(svgs) == 0 {
+		log.Printf("did not find any SVGs in '%s'", dir)
+		return true
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fatal(err)
+	}
+
+	env := os.Environ()
+	if b, ok := backend.(*inkscapeBackend); ok {
+		env = append(env, inkscapeVersionEnv+"="+b.version)
+	}
+	args := batchArgs()
+
+	var mu sync.Mutex
+	var failed []string
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for svg := range paths {
+				files := []string{svg}
+				if !*dryRun {
+					files = append(files, strings.TrimSuffix(svg, filepath.Ext(svg))+".pdf")
+				}
+				// An SVG whose name starts with a dash isn't taken for an option
+				cmd := exec.CommandContext(ctx, self, append(append(args, "--"), files...)...)
+				cmd.Env = env
+				out, err := cmd.CombinedOutput()
+
+				// The output of each conversion is kept together
+				mu.Lock()
+				if len(out) > 0 {
+					fmt.Fprintf(os.Stderr, "%s:\n%s", svg, out)
+				}
+				if err != nil {
+					failed = append(failed, svg)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, svg := range svgs {
+		paths <- svg
+	}
+	close(paths)
+	wg.Wait()
+
+	log.Printf("converted %d of %d SVG(s)", len(svgs)-len(failed), len(svgs))
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		log.Printf("failed: %s", strings.Join(failed, ", "))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oxplot/svglinkify/linkify"
+)
+
+// convertAll converts the SVG at svgPath, whose content is svgContent, to the
+// PDF at outputPath with the given links, resized as -page-size and -scale
+// ask, or to a PDF for each of -page-sizes
+func convertAll(svgPath, svgContent string, links []*linkify.PositionedLink) {
+	if *pageSize != "" {
+		svgPath, svgContent = resizeSVG(svgContent, *pageSize)
+	}
+	if *scale != 1 {
+		scaled, err := linkify.ScaleSVG(svgContent, *scale)
+		if err != nil {
+			fatal(err)
+		}
+		svgPath, svgContent = tempSVG(filepath.Dir(inputPath), scaled), scaled
+	}
+	if *pageSizes == "" {
+		convert(svgPath, svgContent, outputPath, *linksOut, *keepPath, links)
+	} else {
+		for _, size := range strings.Split(*pageSizes, ",") {
+			convertPageSize(svgContent, strings.ToLower(strings.TrimSpace(size)), links)
+		}
+	}
+}
+
+// convert exports the SVG at svgPath, whose content is svgContent, to a PDF at
+// pdfPath and adds the given links to it. The links are also written as JSON
+// to linksPath unless it's empty.
+func convert(svgPath, svgContent, pdfPath, linksPath, keepPath string, anchors []*linkify.PositionedLink) {
+	stage = StageParse
+	viewport, err := linkify.ParseSVGViewport(svgContent)
+	if err != nil {
+		log.Printf("ignoring %s", err)
+	}
+	pageViewports, err := linkify.ParseSVGPages(svgContent, viewport)
+	if err != nil {
+		fatal(err)
+	}
+	// Highlights drawn in the content are rendered from a copy of the SVG
+	// with them in it, which needs the bounding boxes of the links first
+
+	annotHighlight := highlight
+	contentHighlight := highlight != nil && *hlMode == HighlightContent
+	if contentHighlight {
+		annotHighlight = nil
+	}
+	opts := &linkify.Options{
+		Viewport:      viewport,
+		PageViewports: pageViewports,
+		Highlight:     annotHighlight,
+		Border:        border,
+		Fit:           *internalFit,
+		FitMargin:     margin,
+		LinkPadding:   padding,
+		NamedDests:    *namedDests,
+		Tagged:        *tagged,
+		ReuseObjects:  *reuseObjects,
+		Delinearize:   *delinearize,
+		OnLinkError: func(e *linkify.LinkError) error {
+			linkError(e.Link.URL, "%s", e)
+			return nil
+		},
+		Logf:  verbosef,
+		Warnf: log.Printf,
+	}
+
+	// Generate the PDF while determining the final bounding boxes of all the
+	// links, as the two don't depend on each other
+
+	// The PDF is generated in a temporary file next to pdfPath, which only
+	// replaces it once links are added, so it's never left half written
+
+	render := !*dryRun && *verifyPath == "" && !*skipRender
+	var workPath string
+	if !*dryRun && *verifyPath == "" {
+		workPath = tempOutput(pdfPath)
+	}
+	stage = StageRender
+	renderDone := make(chan error, 1)
+	if render && !contentHighlight {
+		go func() {
+			renderDone <- backend.Render(ctx, svgPath, workPath)
+		}()
+	}
+	var ids []string
+	if *queryIDs {
+		ids = linkify.NeededIDs(anchors)
+	}
+	allObjects, bboxErr := backend.BoundingBoxes(ctx, svgPath, svgContent, ids)
+	var renderErr error
+	if render && !contentHighlight {
+		renderErr = <-renderDone
+	}
+	if renderErr != nil {
+		if bboxErr != nil {
+			log.Print(bboxErr)
+		}
+		fatal(renderErr)
+	}
+	if bboxErr != nil {
+		fatal(bboxErr)
+	}
+	if len(allObjects) == 0 {
+		for _, a := range anchors {
+			if a.Valid {
+				continue
+			}
+			if *noBBoxes == NoBBoxesError {
+				fatalf("%s gave no bounding boxes at all, so links without data-link-rect cannot be placed - use -no-bboxes %s to write the PDF anyway", *backendName, NoBBoxesWarn)
+			}
+			log.Printf("%s gave no bounding boxes at all, so links without data-link-rect cannot be placed", *backendName)
+			break
+		}
+	}
+	stage = StageLinkify
+	if *verbose {
+		ids := make([]string, 0, len(allObjects))
+		for id := range allObjects {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			o := allObjects[id]
+			verbosef("object '%s' at %g,%g size %gx%g px", id, o.X, o.Y, o.W, o.H)
+		}
+	}
+
+	allLinks, validLinks := placeLinks(anchors, allObjects)
+
+	// Only report what was found
+
+	if *dryRun {
+		printLinks(os.Stdout, allLinks)
+		if linksPath != "" {
+			writeLinksJSON(linksPath, allObjects, allLinks, nil)
+		}
+		return
+	}
+
+	// Compare against an existing PDF instead of generating one
+
+	if *verifyPath != "" {
+		verifyOutput(linksPath, allObjects, allLinks, validLinks, opts)
+		return
+	}
+
+	if render && contentHighlight {
+		stage = StageRender
+		renderHighlighted(svgPath, svgContent, workPath, validLinks, viewport)
+		stage = StageLinkify
+	}
+
+	// Add links to PDF
+
+	if *skipRender {
+		out, err := os.OpenFile(workPath, os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			fatal(err)
+		}
+		err = copyFile(out, pdfPath)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if keepPath != "" {
+		keepIntermediate(keepPath, workPath)
+	}
+	f, err := os.OpenFile(workPath, os.O_RDWR, 0666)
+	if err != nil {
+		fatal(err)
+	}
+	workFile = f
+	if *skipRender {
+		checkPrerendered(f, svgContent, len(pageViewports))
+	} else if *pageSize != "" || *pageSizes != "" || *scale != 1 {
+		checkResized(f, svgContent)
+	}
+	if !*delinearize {
+		if lin, err := linkify.IsLinearized(f); err != nil {
+			fatal(err)
+		} else if lin {
+			log.Print("PDF is linearized (fast web view), which adding links undoes and some viewers warn about - use -delinearize to strip it")
+		}
+	}
+	placed := reportLinkRects(linksPath, f, allObjects, allLinks, validLinks, opts)
+	if err := linkify.AddLinksToPDF(f, allObjects, validLinks, opts); err != nil {
+		fatal(err)
+	}
+
+	if *checkOutput {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			fatal(err)
+		}
+		if err := linkify.CheckPDF(f, allObjects, validLinks, opts); err != nil {
+			fatalf("generated PDF is broken: %s", err)
+		}
+	}
+	workFile = nil
+	if err := f.Close(); err != nil {
+		fatal(err)
+	}
+	if pdfPath == "-" {
+		if err := copyFile(os.Stdout, workPath); err != nil {
+			fatal(err)
+		}
+		os.Remove(workPath)
+	} else if err := os.Rename(workPath, pdfPath); err != nil {
+		fatal(err)
+	}
+	delete(tempFiles, workPath)
+
+	countLinks(allLinks, placed)
+}
+
+// renderHighlighted renders the SVG at svgPath, whose content is svgContent,
+// to pdfPath with the highlight of each of the links drawn behind it
+func renderHighlighted(svgPath, svgContent, pdfPath string, links []*linkify.PositionedLink, vp *linkify.Viewport) {
+	highlighted, err := linkify.HighlightSVG(svgContent, links, highlight, vp)
+	if err != nil {
+		fatal(err)
+	}
+
+	// The highlighted SVG lives next to the original so relative references
+	// to images etc. still resolve
+
+	tmp := tempSVG(filepath.Dir(svgPath), highlighted)
+	if err := backend.Render(ctx, tmp, pdfPath); err != nil {
+		fatal(err)
+	}
+	os.Remove(tmp)
+	delete(tempFiles, tmp)
+}
+
+// tempOutput creates the temporary file the PDF for pdfPath is generated in,
+// in the same directory so it can be renamed over pdfPath, and with the same
+// permissions as pdfPath if it already exists
+func tempOutput(pdfPath string) string {
+	tmp, err := ioutil.TempFile(filepath.Dir(pdfPath), ".svglinkify-*.pdf")
+	if err != nil {
+		fatal(err)
+	}
+	tempFiles[tmp.Name()] = true
+	if err := tmp.Close(); err != nil {
+		fatal(err)
+	}
+
+	// Temporary files are only accessible by us, unlike what's expected of
+	// an output file
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(pdfPath); err == nil && pdfPath != "-" {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		fatal(err)
+	}
+	return tmp.Name()
+}
+
+// keepIntermediate copies the PDF at workPath, before links are added, to
+// path
+func keepIntermediate(path, workPath string) {
+	out, err := os.Create(path)
+	if err != nil {
+		fatal(err)
+	}
+	err = copyFile(out, workPath)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatal(err)
+	}
+	verbosef("kept the PDF as rendered at %s", path)
+}
+
+// copyFile writes the content of the file at src to w
+func copyFile(w io.Writer, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(w, in)
+	return err
+}
+
+// checkPrerendered checks that the PDF in f, which wasn't rendered by us, is
+// laid out like the SVG with svgContent and nPages pages (0 for a single
+// page), as links are placed assuming each PDF page shows the corresponding
+// SVG page from its top left corner at 72 points per inch
+func checkPrerendered(f io.ReadSeeker, svgContent string, nPages int) {
+	pdf, err := linkify.UnmarshalPDFFile(f)
+	if err != nil {
+		fatal(err)
+	}
+	if nPages == 0 {
+		nPages = 1
+	}
+	if len(pdf.Kids) != nPages {
+		fatalf("PDF has %d page(s) but the SVG has %d", len(pdf.Kids), nPages)
+	}
+	if w, h, ok := linkify.ParseSVGSize(svgContent); ok {
+		p := pdf.Kids[0]
+		if pw, ph := p.ShownSize(); math.Abs(pw-w) > 1 || math.Abs(ph-h) > 1 {
+			log.Printf("PDF page is %gx%g points but the SVG is %gx%g - links may be misplaced", pw, ph, w, h)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(err)
+	}
+}
+
+// checkResized checks that the PDF in f, rendered from the resized
+// svgContent, came out at the size it was resized to, as links would
+// otherwise be misplaced
+func checkResized(f io.ReadSeeker, svgContent string) {
+	pdf, err := linkify.UnmarshalPDFFile(f)
+	if err != nil {
+		fatal(err)
+	}
+	if w, h, ok := linkify.ParseSVGSize(svgContent); ok && len(pdf.Kids) > 0 {
+		if pw, ph := pdf.Kids[0].ShownSize(); math.Abs(pw-w) > 1 || math.Abs(ph-h) > 1 {
+			fatalf("%s exported a %gx%g points page instead of %gx%g", *backendName, pw, ph, w, h)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(err)
+	}
+}
+
+// convertPageSize converts the SVG resized to the named page size, writing the
+// PDF next to outputPath with the size name as a suffix
+func convertPageSize(svgContent, size string, links []*linkify.PositionedLink) {
+	tmp, resized := resizeSVG(svgContent, size)
+	linksPath := *linksOut
+	if linksPath != "" {
+		linksPath = sizedPath(linksPath, size)
+	}
+	keep := *keepPath
+	if keep != "" {
+		keep = sizedPath(keep, size)
+	}
+	convert(tmp, resized, sizedPath(outputPath, size), linksPath, keep, links)
+	os.Remove(tmp)
+	delete(tempFiles, tmp)
+}
+
+// resizeSVG resizes the SVG to the given page size and writes it to a
+// temporary file, returning its path and the resized SVG
+func resizeSVG(svgContent, size string) (string, string) {
+	w, h, err := linkify.ParsePageSize(size)
+	if err != nil {
+		fatal(err)
+	}
+	resized, err := linkify.ResizeSVG(svgContent, w, h)
+	if err != nil {
+		fatal(err)
+	}
+
+	// The resized SVG lives next to the original so relative references to
+	// images etc. still resolve
+
+	return tempSVG(filepath.Dir(inputPath), resized), resized
+}
+
+// tempSVG writes svgContent to a temporary file in dir, which is one of
+// tempFiles, and returns its path
+func tempSVG(dir, svgContent string) string {
+	tmp, err := ioutil.TempFile(dir, ".svglinkify-*.svg")
+	if err != nil {
+		fatal(err)
+	}
+	tempFiles[tmp.Name()] = true
+	_, err = tmp.WriteString(svgContent)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatal(err)
+	}
+	return tmp.Name()
+}
+
+// loadSVG reads the SVG at inputPath, or stdin if it's "-", and returns the
+// path of a file with its content, which the backends need even when it's
+// read from stdin, and the content. That file goes in the current directory
+// so relative references to images etc. resolve as they would for a file
+// there. Compressed SVGs (.svgz) are likewise decompressed to a file next to
+// them, as everything else works on the SVG itself.
+func loadSVG() (string, string) {
+	f := os.Stdin
+	if inputPath != "-" {
+		var err error
+		if f, err = os.Open(inputPath); err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+	}
+	svgContent, compressed, err := readSVG(f, *maxSVGSize)
+	if err != nil {
+		fatal(err)
+	}
+	svgPath := inputPath
+	if inputPath == "-" {
+		svgPath = tempSVG(".", svgContent)
+	} else if compressed {
+		svgPath = tempSVG(filepath.Dir(inputPath), svgContent)
+	}
+	return svgPath, svgContent
+}
+
+// gzipMagic is what gzip compressed content, such as an .svgz, starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readSVG reads the SVG in r, decompressing it as it's read if it's gzip
+// compressed, and gives up once it's over max bytes (unless max is 0) so that
+// an oversized or maliciously compressed file isn't held in memory whole
+func readSVG(r io.Reader, max int64) (content string, compressed bool, err error) {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		z, err := gzip.NewReader(br)
+		if err != nil {
+			return "", true, fmt.Errorf("cannot decompress SVG: %s", err)
+		}
+		defer z.Close()
+		r, compressed = z, true
+	}
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	b := strings.Builder{}
+	n, err := io.Copy(&b, r)
+	if err != nil && compressed {
+		return "", true, fmt.Errorf("cannot decompress SVG: %s", err)
+	} else if err != nil {
+		return "", false, err
+	}
+	if max > 0 && n > max {
+		return "", compressed, fmt.Errorf("SVG is larger than %d bytes - see -max-svg-size", max)
+	}
+	return b.String(), compressed, nil
+}
+
+// sizedPath returns p with the page size name added before its extension
+func sizedPath(p, size string) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "-" + size + ext
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Ways errors are reported, see -error-format
+const (
+	ErrorFormatText = "text"
+	ErrorFormatJSON = "json"
+)
+
+// Stages svglinkify fails at, see -error-format
+const (
+	StageSetup   = "setup"   // checking options and finding the tools
+	StageParse   = "parse"   // reading the SVG and its links
+	StageRender  = "render"  // exporting the PDF and querying bounding boxes
+	StageLinkify = "linkify" // reading the PDF and adding the links to it
+	StageLinks   = "links"   // links that could not be resolved
+)
+
+// stageExitCodes are the exit statuses for failing at each stage with
+// -error-format json. Otherwise it's always 1, except 2 for bad usage.
+var stageExitCodes = map[string]int{
+	StageSetup:   2,
+	StageParse:   3,
+	StageRender:  4,
+	StageLinkify: 5,
+	StageLinks:   6,
+}
+
+// fatal is log.Fatal which first removes the temporary files and reports the
+// error as -error-format asks
+func fatal(v ...interface{}) {
+	exitWithError(fmt.Sprint(v...))
+}
+
+// fatalf is log.Fatalf which first removes the temporary files and reports
+// the error as -error-format asks
+func fatalf(format string, v ...interface{}) {
+	exitWithError(fmt.Sprintf(format, v...))
+}
+
+// exitWithError removes the temporary files, reports msg as the error
+// svglinkify stops at and exits with the status for the current stage
+func exitWithError(msg string) {
+	removeTempFiles()
+	if *errorFormat != ErrorFormatJSON {
+		log.Fatal(msg)
+	}
+	code := stageExitCodes[stage]
+	b, _ := json.Marshal(struct {
+		Stage   string `json:"stage"`
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	}{stage, msg, code})
+	os.Stderr.Write(append(b, '\n'))
+	os.Exit(code)
+}
+
+// removeTempFiles removes all of tempFiles so a failure never leaves them
+// behind
+func removeTempFiles() {
+	if workFile != nil {
+		workFile.Close()
+		workFile = nil
+	}
+	for p := range tempFiles {
+		os.Remove(p)
+		delete(tempFiles, p)
+	}
+}
+
+// linkError reports that the link to url could not be resolved. Unless
+// -fail-fast is given, the link is only recorded and conversion carries on.
+func linkError(url string, format string, v ...interface{}) {
+	if *failFast {
+		stage = StageLinks
+		fatalf(format, v...)
+	}
+	log.Printf(format, v...)
+	for _, u := range badLinks {
+		if u == url {
+			return
+		}
+	}
+	badLinks = append(badLinks, url)
+}
@@ -0,0 +1,165 @@
+package linkify
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Highlight describes how the appearance streams of links are drawn
+type Highlight struct {
+	// Color is the RGB fill color, each component from 0 to 1
+	Color [3]float64
+
+	// Opacity of the fill from 0 to 1
+	Opacity float64
+
+	// Radius of the rounded corners in points, 0 for sharp corners
+	Radius float64
+}
+
+// Border describes the outline viewers draw around link annotations
+type Border struct {
+	// Width of the outline in points, 0 for no outline
+	Width float64
+
+	// Color is the RGB outline color, each component from 0 to 1, or nil for
+	// the viewer's default
+	Color *[3]float64
+}
+
+// marshal returns the /Border entry of a link annotation along with /C if a
+// color is given
+func (b *Border) marshal() string {
+	if b == nil || b.Width <= 0 {
+		return "/Border [ 0 0 0 ]"
+	}
+	s := "/Border [ 0 0 " + strconv.FormatFloat(b.Width, 'f', -1, 64) + " ]"
+	if c := b.Color; c != nil {
+		s += fmt.Sprintf(" /C [ %f %f %f ]", c[0], c[1], c[2])
+	}
+	return s
+}
+
+// PDFAppearance is a form XObject used as the normal (/N) appearance of a
+// link annotation
+type PDFAppearance struct {
+	OwnRef    *PDFObjRef
+	Highlight *Highlight
+
+	// Width of in points
+	W float64
+
+	// Height in points
+	H float64
+}
+
+func (a *PDFAppearance) Marshal(w io.Writer) (int, error) {
+	c := a.Highlight.Color
+	content := fmt.Sprintf("/GS0 gs %f %f %f rg %s f", c[0], c[1], c[2], a.path())
+	return fmt.Fprintf(w, "%d %d obj\n"+
+		"<< /Type /XObject /Subtype /Form /BBox [ 0 0 %f %f ] "+
+		"/Resources << /ExtGState << /GS0 << /Type /ExtGState /ca %f >> >> >> /Length %d >>\n"+
+		"stream\n%s\nendstream\nendobj\n",
+		a.OwnRef.ID, a.OwnRef.Gen, a.W, a.H, a.Highlight.Opacity, len(content), content)
+}
+
+// kappa is the distance of the control points from the ends of a cubic Bézier
+// curve approximating a quarter circle of radius 1
+const kappa = 0.5522847498
+
+// path returns the content stream operators for the outline of the highlight
+func (a *PDFAppearance) path() string {
+	r := math.Min(a.Highlight.Radius, math.Min(a.W, a.H)/2)
+	if r <= 0 {
+		return fmt.Sprintf("0 0 %f %f re", a.W, a.H)
+	}
+
+	// Go counter clockwise from the bottom edge, with a curve at each corner
+
+	k := r * (1 - kappa)
+	w, h := a.W, a.H
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%f 0 m ", r)
+	fmt.Fprintf(&b, "%f 0 l %f 0 %f %f %f %f c ", w-r, w-k, w, k, w, r)
+	fmt.Fprintf(&b, "%f %f l %f %f %f %f %f %f c ", w, h-r, w, h-k, w-k, h, w-r, h)
+	fmt.Fprintf(&b, "%f %f l %f %f %f %f %f %f c ", r, h, k, h, 0.0, h-k, 0.0, h-r)
+	fmt.Fprintf(&b, "0 %f l 0 %f %f 0 %f 0 c h", r, k, k, r)
+	return b.String()
+}
+
+// ParseColor parses a color in #rgb or #rrggbb form
+func ParseColor(s string) ([3]float64, error) {
+	var c [3]float64
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 || !strings.HasPrefix(s, "#") {
+		return c, fmt.Errorf("invalid color '%s' - expected #rrggbb", s)
+	}
+	for i := range c {
+		v, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return c, fmt.Errorf("invalid color '%s' - expected #rrggbb", s)
+		}
+		c[i] = float64(v) / 255
+	}
+	return c, nil
+}
+
+// ParseRGBA parses a color in #rgb, #rrggbb or #rrggbbaa form, returning its
+// opacity from 0 to 1 too, which is 1 unless given
+func ParseRGBA(s string) ([3]float64, float64, error) {
+	hex := s
+	alpha := uint64(255)
+	var err error
+	if len(s) == 9 {
+		hex = s[:7]
+		alpha, err = strconv.ParseUint(s[7:], 16, 8)
+	}
+	c, cerr := ParseColor(hex)
+	if err != nil || cerr != nil {
+		return c, 0, fmt.Errorf("invalid color '%s' - expected #rrggbb or #rrggbbaa", s)
+	}
+	return c, float64(alpha) / 255, nil
+}
+
+// ParseRGB parses a color in r,g,b form with each component from 0 to 1
+func ParseRGB(s string) ([3]float64, error) {
+	var c [3]float64
+	f := strings.Split(s, ",")
+	if len(f) != 3 {
+		return c, fmt.Errorf("invalid color '%s' - expected r,g,b", s)
+	}
+	for i := range c {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f[i]), 64)
+		if err != nil || v < 0 || v > 1 {
+			return c, fmt.Errorf("invalid color '%s' - expected r,g,b with each from 0 to 1", s)
+		}
+		c[i] = v
+	}
+	return c, nil
+}
+
+// ContrastColor returns a highlight color that stands out against the given
+// background color: blue on light backgrounds and yellow on dark ones
+func ContrastColor(bg [3]float64) [3]float64 {
+	lum := 0.2126*bg[0] + 0.7152*bg[1] + 0.0722*bg[2]
+	if lum > 0.5 {
+		return [3]float64{0, 0.4, 1}
+	}
+	return [3]float64{1, 0.85, 0}
+}
+
+// appearanceFor returns the appearance of the given link on the page
+func (p *PDFPage) appearanceFor(l *PositionedLink, hl *Highlight) *PDFAppearance {
+	r := p.linkRect(l)
+	return &PDFAppearance{
+		Highlight: hl,
+		W:         r[2] - r[0],
+		H:         r[3] - r[1],
+	}
+}
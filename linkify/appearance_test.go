@@ -0,0 +1,124 @@
+package linkify
+
+import "testing"
+
+func TestContrastColor(t *testing.T) {
+	blue, yellow := [3]float64{0, 0.4, 1}, [3]float64{1, 0.85, 0}
+	for _, c := range []struct {
+		bg, want [3]float64
+	}{
+		{[3]float64{1, 1, 1}, blue},
+		{[3]float64{1, 1, 0.6}, blue},
+		{[3]float64{0, 0, 0}, yellow},
+		{[3]float64{0, 0, 0.8}, yellow},
+	} {
+		if got := ContrastColor(c.bg); got != c.want {
+			t.Errorf("background %v: got %v, want %v", c.bg, got, c.want)
+		}
+	}
+}
+
+func TestHighlightAppearance(t *testing.T) {
+	l := &PositionedLink{URL: "https://example.com/", X: 100, Y: 100, W: 200, H: 100, Valid: true}
+	hl := &Highlight{Color: [3]float64{1, 0, 0}, Opacity: 0.5}
+	f := addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, &Options{Highlight: hl})
+	pdf, annots := annotDicts(t, f, 0)
+	if len(annots) != 1 {
+		t.Fatalf("got %d annotations, want 1", len(annots))
+	}
+	ap, _ := annots[0]["AP"].(map[PDFName]interface{})
+	ref, ok := ap["N"].(*PDFObjRef)
+	if !ok {
+		t.Fatalf("annotation has no normal appearance: %v", annots[0])
+	}
+	s, err := pdf.Xref.ReadObj(f, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, data, err := splitPDFStream(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dict["Type"] != PDFName("XObject") || dict["Subtype"] != PDFName("Form") {
+		t.Errorf("appearance is not a form XObject: %v", dict)
+	}
+	if bbox, _ := dict["BBox"].([]interface{}); len(bbox) != 4 || bbox[2] != 150.0 || bbox[3] != 75.0 {
+		t.Errorf("got appearance /BBox %v, want [ 0 0 150 75 ]", dict["BBox"])
+	}
+	res, _ := dict["Resources"].(map[PDFName]interface{})
+	gs, _ := res["ExtGState"].(map[PDFName]interface{})
+	if gs0, _ := gs["GS0"].(map[PDFName]interface{}); gs0["ca"] != 0.5 {
+		t.Errorf("got appearance resources %v, want /GS0 with /ca 0.5", res)
+	}
+	if want := "/GS0 gs 1.000000 0.000000 0.000000 rg 0 0 150.000000 75.000000 re f"; string(data) != want {
+		t.Errorf("got appearance content %q, want %q", data, want)
+	}
+}
+
+func TestHighlightPath(t *testing.T) {
+	for _, c := range []struct {
+		radius float64
+		want   string
+	}{
+		{0, "0 0 100.000000 50.000000 re"},
+		{10, "10.000000 0 m " +
+			"90.000000 0 l 95.522847 0 100.000000 4.477153 100.000000 10.000000 c " +
+			"100.000000 40.000000 l 100.000000 45.522847 95.522847 50.000000 90.000000 50.000000 c " +
+			"10.000000 50.000000 l 4.477153 50.000000 0.000000 45.522847 0.000000 40.000000 c " +
+			"0 10.000000 l 0 4.477153 4.477153 0 10.000000 0 c h"},
+		// The radius can't be more than half the shorter side
+		{100, "25.000000 0 m " +
+			"75.000000 0 l 88.807119 0 100.000000 11.192881 100.000000 25.000000 c " +
+			"100.000000 25.000000 l 100.000000 38.807119 88.807119 50.000000 75.000000 50.000000 c " +
+			"25.000000 50.000000 l 11.192881 50.000000 0.000000 38.807119 0.000000 25.000000 c " +
+			"0 25.000000 l 0 11.192881 11.192881 0 25.000000 0 c h"},
+	} {
+		a := &PDFAppearance{Highlight: &Highlight{Radius: c.radius}, W: 100, H: 50}
+		if got := a.path(); got != c.want {
+			t.Errorf("radius %g: got\n%s\nwant\n%s", c.radius, got, c.want)
+		}
+	}
+}
+
+func TestBorderMarshal(t *testing.T) {
+	red := [3]float64{1, 0, 0}
+	for _, c := range []struct {
+		border *Border
+		want   string
+	}{
+		{nil, "/Border [ 0 0 0 ]"},
+		{&Border{}, "/Border [ 0 0 0 ]"},
+		{&Border{Color: &red}, "/Border [ 0 0 0 ]"},
+		{&Border{Width: 1.5}, "/Border [ 0 0 1.5 ]"},
+		{&Border{Width: 2, Color: &red}, "/Border [ 0 0 2 ] /C [ 1.000000 0.000000 0.000000 ]"},
+	} {
+		if got := c.border.marshal(); got != c.want {
+			t.Errorf("%+v: got %q, want %q", c.border, got, c.want)
+		}
+	}
+}
+
+func TestParseRGBA(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		color [3]float64
+		alpha float64
+	}{
+		{"#ffffff", [3]float64{1, 1, 1}, 1},
+		{"#000", [3]float64{0, 0, 0}, 1},
+		{"#ff000000", [3]float64{1, 0, 0}, 0},
+		{"#0000ffff", [3]float64{0, 0, 1}, 1},
+	} {
+		color, alpha, err := ParseRGBA(c.s)
+		if err != nil {
+			t.Errorf("%s: %s", c.s, err)
+		} else if color != c.color || alpha != c.alpha {
+			t.Errorf("%s: got %v with opacity %g, want %v with %g", c.s, color, alpha, c.color, c.alpha)
+		}
+	}
+	for _, s := range []string{"", "white", "#ff", "#fffff", "#ffffff8", "#ffffffgg", "#ffffff800"} {
+		if _, _, err := ParseRGBA(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package linkify
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matrix is an affine transform [a b c d e f] as in SVG, mapping (x, y) to
+// (a*x + c*y + e, b*x + d*y + f)
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n and then m
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+var transformRegexp = regexp.MustCompile(`(matrix|translate|scale|rotate|skewX|skewY)\s*\(([^)]*)\)`)
+
+// parseTransform parses the value of a transform attribute. Malformed parts
+// are ignored.
+func parseTransform(s string) matrix {
+	m := identity
+	for _, t := range transformRegexp.FindAllStringSubmatch(s, -1) {
+		v := parseNumbers(t[2])
+		var n matrix
+		switch {
+		case t[1] == "matrix" && len(v) == 6:
+			copy(n[:], v)
+		case t[1] == "translate" && len(v) == 1:
+			n = matrix{1, 0, 0, 1, v[0], 0}
+		case t[1] == "translate" && len(v) == 2:
+			n = matrix{1, 0, 0, 1, v[0], v[1]}
+		case t[1] == "scale" && len(v) == 1:
+			n = matrix{v[0], 0, 0, v[0], 0, 0}
+		case t[1] == "scale" && len(v) == 2:
+			n = matrix{v[0], 0, 0, v[1], 0, 0}
+		case t[1] == "rotate" && (len(v) == 1 || len(v) == 3):
+			a := v[0] * math.Pi / 180
+			n = matrix{math.Cos(a), math.Sin(a), -math.Sin(a), math.Cos(a), 0, 0}
+			if len(v) == 3 {
+				n = matrix{1, 0, 0, 1, v[1], v[2]}.mul(n).mul(matrix{1, 0, 0, 1, -v[1], -v[2]})
+			}
+		case t[1] == "skewX" && len(v) == 1:
+			n = matrix{1, 0, math.Tan(v[0] * math.Pi / 180), 1, 0, 0}
+		case t[1] == "skewY" && len(v) == 1:
+			n = matrix{1, math.Tan(v[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		m = m.mul(n)
+	}
+	return m
+}
+
+var (
+	numberRegexp = regexp.MustCompile(`[-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+
+	// leadingNumberRegexp matches a number at the start only
+	leadingNumberRegexp = regexp.MustCompile(`^` + numberRegexp.String())
+)
+
+// parseNumbers returns all the numbers in s, however they're separated
+func parseNumbers(s string) []float64 {
+	var v []float64
+	for _, n := range numberRegexp.FindAllString(s, -1) {
+		f, _ := strconv.ParseFloat(n, 64)
+		v = append(v, f)
+	}
+	return v
+}
+
+// svgUnits is the number of user units per unit of absolute length
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": pixelsPerInch / pointsPerInch,
+	"pc": 12 * pixelsPerInch / pointsPerInch,
+	"mm": pixelsPerInch / 25.4,
+	"cm": pixelsPerInch / 2.54,
+	"in": pixelsPerInch,
+}
+
+// userLength parses a length attribute into user units. Relative lengths
+// such as percentages aren't known and give 0.
+func userLength(s string) float64 {
+	s = strings.TrimSpace(s)
+	n := leadingNumberRegexp.FindString(s)
+	if n == "" {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(n, 64)
+	return v * svgUnits[strings.TrimSpace(s[len(n):])]
+}
+
+// bbox is a bounding box being accumulated
+type bbox struct {
+	x1, y1, x2, y2 float64
+	empty          bool
+}
+
+func newBBox() bbox {
+	return bbox{empty: true}
+}
+
+func (b *bbox) add(x, y float64) {
+	if b.empty {
+		*b = bbox{x1: x, y1: y, x2: x, y2: y}
+		return
+	}
+	b.x1, b.y1 = math.Min(b.x1, x), math.Min(b.y1, y)
+	b.x2, b.y2 = math.Max(b.x2, x), math.Max(b.y2, y)
+}
+
+func (b *bbox) union(o bbox) {
+	if !o.empty {
+		b.add(o.x1, o.y1)
+		b.add(o.x2, o.y2)
+	}
+}
+
+// transformed returns the bounding box of the corners of b mapped by m
+func (b bbox) transformed(m matrix) bbox {
+	t := newBBox()
+	if !b.empty {
+		for _, pt := range [][2]float64{{b.x1, b.y1}, {b.x2, b.y1}, {b.x1, b.y2}, {b.x2, b.y2}} {
+			t.add(m.apply(pt[0], pt[1]))
+		}
+	}
+	return t
+}
+
+// geometryHidden are elements whose content isn't drawn where it's defined
+var geometryHidden = map[string]bool{
+	"clipPath":       true,
+	"defs":           true,
+	"linearGradient": true,
+	"marker":         true,
+	"mask":           true,
+	"metadata":       true,
+	"pattern":        true,
+	"radialGradient": true,
+	"symbol":         true,
+	"title":          true,
+	"desc":           true,
+}
+
+// SVGBoundingBoxes computes the bounding boxes of all the elements with an id
+// from the geometry in the SVG, for when there's no inkscape to ask. Boxes are
+// in the user units of the root, don't include strokes, and take curves as
+// the hull of their control points. Text is estimated from its font size and
+// number of characters. use elements take the box of the element they refer
+// to, if it comes before them, placed at their x and y (ignoring any viewBox
+// of a referenced symbol), and otherwise only count their own x, y, width and
+// height. Of elements with the same id, only the first is given.
+func SVGBoundingBoxes(r io.Reader) (map[string]*PositionedObject, error) {
+	d := newSVGDecoder(r)
+
+	type frame struct {
+		name   string
+		id     string
+		ctm    matrix
+		box    bbox
+		hidden bool
+
+		// own is the element's transform within its parent and local its box
+		// in its own coordinates, which is what use elements need
+		own   matrix
+		local bbox
+
+		// text holds the characters of text elements
+		text     strings.Builder
+		textX    float64
+		textY    float64
+		fontSize float64
+	}
+	objects := map[string]*PositionedObject{}
+	var stack []*frame
+
+	// refBoxes holds the box of each element with an id in the coordinates
+	// of its parent, for use elements referring to it
+	refBoxes := map[string]bbox{}
+
+	// seen holds the ids found so far, so that only the first element with
+	// each gets its box
+	seen := map[string]bool{}
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			f := &frame{name: t.Name.Local, id: elementID(t), ctm: identity, box: newBBox(), own: identity, local: newBBox(), fontSize: 16}
+			if seen[f.id] {
+				f.id = ""
+			} else if f.id != "" {
+				seen[f.id] = true
+			}
+			attrs := map[string]string{}
+			for _, a := range t.Attr {
+				if a.Name.Space == "" || a.Name.Space == svgNamespace {
+					attrs[a.Name.Local] = a.Value
+				}
+			}
+			if len(stack) > 0 {
+				p := stack[len(stack)-1]
+				f.ctm, f.hidden, f.fontSize = p.ctm, p.hidden, p.fontSize
+			}
+			if len(stack) > 0 || f.name != "svg" {
+				f.own = parseTransform(attrs["transform"])
+			}
+			f.hidden = f.hidden || geometryHidden[f.name]
+			if fs := fontSize(attrs); fs > 0 {
+				f.fontSize = fs
+			}
+			if f.name == "svg" && len(stack) > 0 {
+				// Nested viewports are only offset, not scaled
+				f.own = f.own.mul(matrix{1, 0, 0, 1, userLength(attrs["x"]), userLength(attrs["y"])})
+			}
+			f.ctm = f.ctm.mul(f.own)
+			if f.name == "text" {
+				if x := parseNumbers(attrs["x"]); len(x) > 0 {
+					f.textX = x[0]
+				}
+				if y := parseNumbers(attrs["y"]); len(y) > 0 {
+					f.textY = y[0]
+				}
+			}
+			for _, pt := range shapePoints(f.name, attrs) {
+				f.box.add(f.ctm.apply(pt[0], pt[1]))
+				f.local.add(pt[0], pt[1])
+			}
+			if href := anchorHref(t); f.name == "use" && strings.HasPrefix(href, "#") {
+				if ref, ok := refBoxes[href[1:]]; ok {
+					at := matrix{1, 0, 0, 1, userLength(attrs["x"]), userLength(attrs["y"])}
+					f.box, f.local = ref.transformed(f.ctm.mul(at)), ref.transformed(at)
+				}
+			}
+			stack = append(stack, f)
+		case xml.CharData:
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].name == "text" {
+					stack[i].text.Write(t)
+					break
+				}
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if f.name == "text" {
+				if n := len([]rune(strings.TrimSpace(f.text.String()))); n > 0 {
+					w := float64(n) * f.fontSize * 0.6
+					x, y := f.textX, f.textY
+					for _, pt := range [][2]float64{{x, y - f.fontSize*0.8}, {x + w, y - f.fontSize*0.8}, {x, y + f.fontSize*0.2}, {x + w, y + f.fontSize*0.2}} {
+						f.box.add(f.ctm.apply(pt[0], pt[1]))
+						f.local.add(pt[0], pt[1])
+					}
+				}
+			}
+			if f.box.empty {
+				continue
+			}
+			inParent := f.local.transformed(f.own)
+			if f.id != "" {
+				objects[f.id] = &PositionedObject{ID: f.id, X: f.box.x1, Y: f.box.y1, W: f.box.x2 - f.box.x1, H: f.box.y2 - f.box.y1}
+				refBoxes[f.id] = inParent
+			}
+			if len(stack) > 0 && (!f.hidden || stack[len(stack)-1].hidden) {
+				stack[len(stack)-1].box.union(f.box)
+				stack[len(stack)-1].local.union(inParent)
+			}
+		}
+	}
+}
+
+// svgNamespace is the namespace SVG elements and attributes are in
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+var fontSizeRegexp = regexp.MustCompile(`(?:^|;)\s*font-size\s*:\s*([^;]+)`)
+
+// fontSize returns the font size set on an element, or 0 if none
+func fontSize(attrs map[string]string) float64 {
+	if m := fontSizeRegexp.FindStringSubmatch(attrs["style"]); m != nil {
+		return userLength(m[1])
+	}
+	return userLength(attrs["font-size"])
+}
+
+// shapePoints returns points, in the element's own coordinates, whose
+// bounding box is that of the shape
+func shapePoints(name string, attrs map[string]string) [][2]float64 {
+	l := func(n string) float64 { return userLength(attrs[n]) }
+	rect := func(x, y, w, h float64) [][2]float64 {
+		if w <= 0 && h <= 0 {
+			return nil
+		}
+		return [][2]float64{{x, y}, {x + w, y}, {x, y + h}, {x + w, y + h}}
+	}
+	switch name {
+	case "rect", "image", "use", "foreignObject":
+		return rect(l("x"), l("y"), l("width"), l("height"))
+	case "circle":
+		r := l("r")
+		return rect(l("cx")-r, l("cy")-r, 2*r, 2*r)
+	case "ellipse":
+		rx, ry := l("rx"), l("ry")
+		return rect(l("cx")-rx, l("cy")-ry, 2*rx, 2*ry)
+	case "line":
+		return [][2]float64{{l("x1"), l("y1")}, {l("x2"), l("y2")}}
+	case "polyline", "polygon":
+		v := parseNumbers(attrs["points"])
+		var pts [][2]float64
+		for i := 0; i+1 < len(v); i += 2 {
+			pts = append(pts, [2]float64{v[i], v[i+1]})
+		}
+		return pts
+	case "path":
+		return pathPoints(attrs["d"])
+	}
+	return nil
+}
+
+// pathArgs is the number of arguments each path command takes
+var pathArgs = map[byte]int{'m': 2, 'l': 2, 'h': 1, 'v': 1, 'c': 6, 's': 4, 'q': 4, 't': 2, 'a': 7, 'z': 0}
+
+// pathPoints returns the end and control points of the path data d, with arcs
+// sampled along their curve. Parsing stops at the first error, as renderers
+// do.
+func pathPoints(d string) [][2]float64 {
+	var pts [][2]float64
+	p := pathLexer{s: d}
+	var x, y, startX, startY float64
+
+	// ctrlX and ctrlY are the last control point of the previous segment,
+	// which the shorthand curves reflect
+	var ctrlX, ctrlY float64
+	var cmd, prev byte
+
+	for {
+		p.skipSeparators()
+		if p.pos >= len(p.s) {
+			return pts
+		}
+		if c := p.s[p.pos]; pathArgs[c|0x20] > 0 || c|0x20 == 'z' {
+			cmd = c
+			p.pos++
+		} else if cmd == 0 {
+			return pts
+		}
+		lower := cmd | 0x20
+		if lower == 'z' {
+			x, y = startX, startY
+			pts = append(pts, [2]float64{x, y})
+			cmd, prev = 0, 'z'
+			continue
+		}
+
+		var ox, oy float64
+		if cmd == lower {
+			ox, oy = x, y
+		}
+		v := make([]float64, pathArgs[lower])
+		for i := range v {
+			var ok bool
+			if lower == 'a' && (i == 3 || i == 4) {
+				v[i], ok = p.flag()
+			} else {
+				v[i], ok = p.number()
+			}
+			if !ok {
+				return pts
+			}
+		}
+
+		// The reflection of the previous control point, or the current point
+		// if the previous segment isn't the same kind of curve
+		rx, ry := x, y
+		if (lower == 's' && (prev == 'c' || prev == 's')) || (lower == 't' && (prev == 'q' || prev == 't')) {
+			rx, ry = 2*x-ctrlX, 2*y-ctrlY
+		}
+
+		switch lower {
+		case 'm', 'l':
+			x, y = ox+v[0], oy+v[1]
+			if lower == 'm' {
+				startX, startY = x, y
+				// Further coordinate pairs are implicit linetos
+				cmd = cmd - 'm' + 'l'
+			}
+		case 'h':
+			x = ox + v[0]
+		case 'v':
+			y = oy + v[0]
+		case 'c':
+			pts = append(pts, [2]float64{ox + v[0], oy + v[1]}, [2]float64{ox + v[2], oy + v[3]})
+			ctrlX, ctrlY = ox+v[2], oy+v[3]
+			x, y = ox+v[4], oy+v[5]
+		case 's':
+			pts = append(pts, [2]float64{rx, ry}, [2]float64{ox + v[0], oy + v[1]})
+			ctrlX, ctrlY = ox+v[0], oy+v[1]
+			x, y = ox+v[2], oy+v[3]
+		case 'q':
+			pts = append(pts, [2]float64{ox + v[0], oy + v[1]})
+			ctrlX, ctrlY = ox+v[0], oy+v[1]
+			x, y = ox+v[2], oy+v[3]
+		case 't':
+			pts = append(pts, [2]float64{rx, ry})
+			ctrlX, ctrlY = rx, ry
+			x, y = ox+v[0], oy+v[1]
+		case 'a':
+			ex, ey := ox+v[5], oy+v[6]
+			pts = append(pts, arcPoints(x, y, v[0], v[1], v[2], v[3] != 0, v[4] != 0, ex, ey)...)
+			x, y = ex, ey
+		}
+		pts = append(pts, [2]float64{x, y})
+		prev = lower
+	}
+}
+
+// arcPoints samples the elliptical arc from (x1, y1) to (x2, y2), following
+// the endpoint to center conversion in the SVG spec
+func arcPoints(x1, y1, rx, ry, angle float64, large, sweep bool, x2, y2 float64) [][2]float64 {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || (x1 == x2 && y1 == y2) {
+		return nil
+	}
+	phi := angle * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (x1-x2)/2, (y1-y2)/2
+	x1p, y1p := cos*dx+sin*dy, -sin*dx+cos*dy
+
+	// Scale up radii that are too small to reach
+	if l := x1p*x1p/(rx*rx) + y1p*y1p/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1p*y1p - ry*ry*x1p*x1p
+	den := rx*rx*y1p*y1p + ry*ry*x1p*x1p
+	k := 0.0
+	if num > 0 && den > 0 {
+		k = math.Sqrt(num / den)
+	}
+	if large == sweep {
+		k = -k
+	}
+	cxp, cyp := k*rx*y1p/ry, -k*ry*x1p/rx
+	cx := cos*cxp - sin*cyp + (x1+x2)/2
+	cy := sin*cxp + cos*cyp + (y1+y2)/2
+
+	theta1 := math.Atan2((y1p-cyp)/ry, (x1p-cxp)/rx)
+	theta2 := math.Atan2((-y1p-cyp)/ry, (-x1p-cxp)/rx)
+	delta := theta2 - theta1
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+
+	const samples = 32
+	pts := make([][2]float64, 0, samples)
+	for i := 1; i < samples; i++ {
+		t := theta1 + delta*float64(i)/samples
+		ex, ey := rx*math.Cos(t), ry*math.Sin(t)
+		pts = append(pts, [2]float64{cos*ex - sin*ey + cx, sin*ex + cos*ey + cy})
+	}
+	return pts
+}
+
+// pathLexer reads the numbers and flags of path data
+type pathLexer struct {
+	s   string
+	pos int
+}
+
+func (p *pathLexer) skipSeparators() {
+	for p.pos < len(p.s) && (isPDFWhite(p.s[p.pos]) || p.s[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+func (p *pathLexer) number() (float64, bool) {
+	p.skipSeparators()
+	n := leadingNumberRegexp.FindString(p.s[p.pos:])
+	if n == "" {
+		return 0, false
+	}
+	p.pos += len(n)
+	v, err := strconv.ParseFloat(n, 64)
+	return v, err == nil
+}
+
+// flag reads an arc flag, which needn't be separated from what follows
+func (p *pathLexer) flag() (float64, bool) {
+	p.skipSeparators()
+	if p.pos < len(p.s) && (p.s[p.pos] == '0' || p.s[p.pos] == '1') {
+		p.pos++
+		return float64(p.s[p.pos-1] - '0'), true
+	}
+	return 0, false
+}
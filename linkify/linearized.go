@@ -0,0 +1,94 @@
+package linkify
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var pdfLinearizedRegexp = regexp.MustCompile(`/Linearized\b`)
+
+// linearizedHeadLen is how far into a linearized PDF its linearization
+// dictionary must be entirely
+const linearizedHeadLen = 1024
+
+// pdfLinearization is the linearization dictionary of a PDF
+type pdfLinearization struct {
+	OwnRef *PDFObjRef
+
+	// Offset of the dictionary in the file and the dictionary itself
+	Offset int64
+	Dict   string
+}
+
+// readLinearization returns the linearization dictionary of the PDF in f,
+// which is its first object, or nil if the PDF isn't linearized
+func readLinearization(f io.ReadSeeker) (*pdfLinearization, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, linearizedHeadLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	m := pdfObjRegexp.FindSubmatchIndex(buf[:n])
+	if m == nil {
+		return nil, nil
+	}
+	dict := string(buf[m[6]:m[7]])
+	if !strings.HasPrefix(dict, "<<") || !strings.HasSuffix(dict, ">>") || !pdfLinearizedRegexp.MatchString(dict) {
+		return nil, nil
+	}
+	v, err := ParsePDFValue(fmt.Sprintf("%s %s R", buf[m[2]:m[3]], buf[m[4]:m[5]]))
+	if err != nil {
+		return nil, err
+	}
+	ref, _ := v.(*PDFObjRef)
+	return &pdfLinearization{OwnRef: ref, Offset: int64(m[6]), Dict: dict}, nil
+}
+
+// IsLinearized reports whether the PDF in f is linearized for fast web view,
+// which appending links to it undoes: viewers then load it as a whole and some
+// warn about the hint tables no longer matching
+func IsLinearized(f io.ReadSeeker) (bool, error) {
+	lin, err := readLinearization(f)
+	return lin != nil, err
+}
+
+// delinearize makes the PDF in f, which must be loaded as p, no longer
+// linearized: its linearization dictionary is blanked out in place, keeping
+// its length so no offsets change, and the dictionary and the hint stream are
+// freed in the xref
+func (p *PDFFile) delinearize(f io.ReadWriteSeeker) error {
+	lin, err := readLinearization(f)
+	if err != nil || lin == nil {
+		return err
+	}
+	v, err := ParsePDFValue(lin.Dict)
+	if err != nil {
+		return fmt.Errorf("cannot read PDF linearization dictionary: %s", err)
+	}
+	dict, _ := v.(map[PDFName]interface{})
+
+	// The hint stream is only given by its offset
+
+	if h, ok := dict["H"].([]interface{}); ok && len(h) > 0 {
+		if off, ok := h[0].(float64); ok {
+			for id, e := range p.Xref.Entries {
+				if !e.Free && e.StreamID == 0 && e.Offset == int64(off) {
+					p.Xref.Free(id)
+				}
+			}
+		}
+	}
+	if r := lin.OwnRef; r != nil && r.ID < len(p.Xref.Entries) && !p.Xref.Entries[r.ID].Free {
+		p.Xref.Free(r.ID)
+	}
+	if _, err := f.Seek(lin.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "<<"+strings.Repeat(" ", len(lin.Dict)-4)+">>")
+	return err
+}
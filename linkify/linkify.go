@@ -0,0 +1,618 @@
+// Package linkify adds clickable links to PDFs exported by inkscape from SVGs.
+//
+// The links and the bounding boxes of objects are found in the SVG, as
+// reported by inkscape, and AddLinksToPDF then appends link annotations to
+// the PDF through an incremental update.
+package linkify
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strings"
+)
+
+type PositionedObject struct {
+	// SVG ID
+	ID string `json:"id"`
+
+	// X position of in pixels
+	X float64 `json:"x"`
+
+	// Y position of in pixels
+	Y float64 `json:"y"`
+
+	// Width of in pixels
+	W float64 `json:"w"`
+
+	// Height in pixels
+	H float64 `json:"h"`
+}
+
+type PositionedLink struct {
+	// SVG ID
+	ID string `json:"id"`
+
+	// SyntheticID is set if the anchor has no id in the SVG, in which case ID
+	// is made up from the URL and it's placed by its aliases or descendants
+	SyntheticID bool `json:"syntheticId,omitempty"`
+
+	// URL of the link
+	URL string `json:"url"`
+
+	// Title of the link, shown by viewers as a tooltip
+	Title string `json:"title,omitempty"`
+
+	// NewWindow is set if the anchor asks for its target to be opened in a
+	// new window, with target="_blank" or xlink:show="new"
+	NewWindow bool `json:"newWindow,omitempty"`
+
+	// X position of in pixels
+	X float64 `json:"x"`
+
+	// Y position of in pixels
+	Y float64 `json:"y"`
+
+	// Width of in pixels
+	W float64 `json:"w"`
+
+	// Height in pixels
+	H float64 `json:"h"`
+
+	// Valid indicates if this link has all the requirements to be used
+	Valid bool `json:"valid"`
+
+	// Descendants are the ids of the elements within the anchor, in document
+	// order
+	Descendants []string `json:"descendants,omitempty"`
+
+	// Aliases are other ids the anchor may be known by in the bounding boxes
+	// if inkscape rewrote its id: its data-svglinkify-id and inkscape:label,
+	// in that order
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// BareFragment returns the ID portion of the URL, if the URL starts with #
+// otherwise returns the empty string. Percent-encoded characters in the
+// fragment (e.g. spaces in ids) are decoded.
+func (l *PositionedLink) BareFragment() string {
+	if l.URL[0] == '#' {
+		if id, err := url.PathUnescape(l.URL[1:]); err == nil {
+			return id
+		}
+		return l.URL[1:]
+	} else {
+		return ""
+	}
+}
+
+// TargetID returns the id of the object an internal link goes to, or the
+// empty string for other links, including named actions and page links
+func (l *PositionedLink) TargetID() string {
+	id := l.BareFragment()
+	if strings.HasPrefix(id, namedActionPrefix) || strings.HasPrefix(id, pageFragmentPrefix) {
+		return ""
+	}
+	return id
+}
+
+// Ways the clickable area of a link is found, see ResolveLinkBox
+const (
+	ResolveExact      = "exact-id"
+	ResolveFirstChild = "first-child-id"
+	ResolveUnion      = "union-of-descendants"
+)
+
+// ResolveLinkBox returns the bounding box of the link among allObjects
+// according to strategy, one of ResolveExact, ResolveFirstChild or
+// ResolveUnion, or nil if it cannot be determined. Any other strategy is
+// taken as ResolveExact.
+func ResolveLinkBox(l *PositionedLink, allObjects map[string]*PositionedObject, strategy string) *PositionedObject {
+	switch strategy {
+	case ResolveFirstChild:
+		for _, id := range l.Descendants {
+			if o, ok := allObjects[id]; ok {
+				return o
+			}
+		}
+		return nil
+	case ResolveUnion:
+		return unionBox(l, allObjects)
+	default:
+		// The id may have been rewritten by inkscape, in which case one of the
+		// aliases may still match. An anchor wrapping a group may not get a
+		// bounding box of its own, in which case what it wraps is the next
+		// best thing.
+		for _, id := range append([]string{l.ID}, l.Aliases...) {
+			if o, ok := allObjects[id]; ok {
+				return o
+			}
+		}
+		return unionBox(l, allObjects)
+	}
+}
+
+// NeededIDs returns the ids of the objects the links may be placed by or go
+// to, e.g. to ask inkscape only for those. Aliases are left out as they're
+// only needed when inkscape rewrote an id, in which case querying that id
+// fails and all the objects are queried anyway.
+func NeededIDs(links []*PositionedLink) []string {
+	seen := map[string]bool{}
+	ids := []string{}
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, l := range links {
+		if !l.Valid {
+			if !l.SyntheticID {
+				add(l.ID)
+			}
+			for _, id := range l.Descendants {
+				add(id)
+			}
+		}
+		add(l.TargetID())
+	}
+	return ids
+}
+
+// unionBox returns the union of the bounding boxes of all the elements within
+// the link, or nil if none of them has one
+func unionBox(l *PositionedLink, allObjects map[string]*PositionedObject) *PositionedObject {
+	var u *PositionedObject
+	for _, id := range l.Descendants {
+		o, ok := allObjects[id]
+		if !ok {
+			continue
+		}
+		if u == nil {
+			c := *o
+			u = &c
+			continue
+		}
+		x1, y1 := math.Min(u.X, o.X), math.Min(u.Y, o.Y)
+		x2, y2 := math.Max(u.X+u.W, o.X+o.W), math.Max(u.Y+u.H, o.Y+o.H)
+		u.X, u.Y, u.W, u.H = x1, y1, x2-x1, y2-y1
+	}
+	return u
+}
+
+// LinkError describes a link that could not be added to the PDF
+type LinkError struct {
+	Link *PositionedLink
+
+	// Reason the link could not be added, e.g. "points to non-existing object"
+	Reason string
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("link '%s' %s", e.Link.URL, e.Reason)
+}
+
+// Options control how links are added to a PDF
+type Options struct {
+	// Viewport maps the SVG user units of links and objects to PDF points.
+	// Defaults to DefaultViewport.
+	Viewport *Viewport
+
+	// PageViewports holds the viewport of each page of a multi-page document
+	// in order, which also decides which page each link goes on. Pages
+	// without one use Viewport.
+	PageViewports []*Viewport
+
+	// Highlight, if not nil, gives each link an appearance stream drawing a
+	// highlight over it
+	Highlight *Highlight
+
+	// Border, if not nil, is the outline drawn around each link
+	Border *Border
+
+	// Fit is how the targets of internal links are viewed, one of FitR, Fit,
+	// FitB or XYZ. Defaults to FitR.
+	Fit string
+
+	// FitMargin is the room left around the targets of internal links with
+	// FitR, so they don't touch the edges of the window. The zoomed area
+	// stays within the target's page.
+	FitMargin Margin
+
+	// LinkPadding grows the clickable area of each link beyond its bounding
+	// box, e.g. to make small icons easier to hit. It stays within the page
+	// and doesn't change where internal links go.
+	LinkPadding Margin
+
+	// NamedDests, if true, registers the target of each internal link once
+	// in the /Dests name tree of the catalog and has links refer to it by
+	// name, rather than repeating the destination in every link
+	NamedDests bool
+
+	// Tagged, if true, adds a structure tree with a /Link element for each
+	// link, so that screen readers and PDF/UA checkers find them. Each link
+	// annotation is then an object of its own. The page content isn't
+	// tagged, so the PDF is only marked as tagged (/MarkInfo) if it already
+	// was.
+	Tagged bool
+
+	// OnLinkError, if not nil, is called for each link that cannot be added.
+	// Returning an error aborts adding links with that error.
+	OnLinkError func(*LinkError) error
+
+	// ReuseObjects, if true, writes the changed pages and the catalog under
+	// their own object numbers, replacing the originals, instead of freeing
+	// those and appending new objects. The object table then doesn't grow
+	// each time a PDF is updated again. The page tree nodes always keep
+	// their numbers, which the /Parent of each page refers to.
+	ReuseObjects bool
+
+	// Delinearize, if true, makes a linearized PDF plainly structured
+	// before links are added, rather than leaving viewers to find that its
+	// linearization no longer holds. This changes the PDF in place.
+	Delinearize bool
+
+	// Logf, if not nil, is given diagnostics such as where each object is
+	// written
+	Logf func(format string, v ...interface{})
+
+	// Warnf, if not nil, is given warnings about links that are left out
+	// without being errors, such as those entirely outside their page
+	Warnf func(format string, v ...interface{})
+}
+
+// logf passes the diagnostic on to Logf if it's set
+func (o *Options) logf(format string, v ...interface{}) {
+	if o.Logf != nil {
+		o.Logf(format, v...)
+	}
+}
+
+// warnf passes the warning on to Warnf if it's set
+func (o *Options) warnf(format string, v ...interface{}) {
+	if o.Warnf != nil {
+		o.Warnf(format, v...)
+	}
+}
+
+// withDefaults returns a copy of o with unset fields set to their defaults
+func (o *Options) withDefaults() *Options {
+	c := Options{}
+	if o != nil {
+		c = *o
+	}
+	if c.Viewport == nil {
+		c.Viewport = DefaultViewport
+	}
+	if c.Fit == "" {
+		c.Fit = FitR
+	}
+	return &c
+}
+
+// AddLinksToPDF incrementally updates the PDF output of inkscape in f to add
+// the given clickable links. allObjects holds the bounding boxes of all the
+// objects in the SVG, which internal links point to. opts may be nil to use
+// the defaults.
+func AddLinksToPDF(f io.ReadWriteSeeker, allObjects map[string]*PositionedObject, links []*PositionedLink, opts *Options) error {
+	opts = opts.withDefaults()
+
+	// Load original xref, catalog, pages and all the page objects of the PDF
+
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		return err
+	}
+	xref, catalog := pdf.Xref, pdf.Catalog
+	if opts.Delinearize {
+		if err := pdf.delinearize(f); err != nil {
+			return err
+		}
+	}
+
+	// Update the pages with the new links and objects. Only pages that get
+	// links are rewritten, and they must all have their new references
+	// before any is written since links can point to other pages. The page
+	// tree nodes keep their numbers so the /Parent of every page still
+	// holds, and those with kids that get new numbers are rewritten in place.
+
+	if err := pdf.setupPages(allObjects, links, opts); err != nil {
+		return err
+	}
+	var changed []*PDFPage
+	var nodes []*PDFPages
+	dirty := map[*PDFPages]bool{}
+	for _, page := range pdf.Kids {
+		if len(page.Links) == 0 {
+			continue
+		}
+		if err := page.takeAnnots(f, xref); err != nil {
+			return err
+		}
+		if !opts.ReuseObjects {
+			xref.Free(page.OwnRef.ID)
+			page.OwnRef = &PDFObjRef{ID: len(xref.Entries) + len(changed)}
+			page.parent.KidRefs[page.kid] = page.OwnRef
+			if !dirty[page.parent] {
+				dirty[page.parent] = true
+				nodes = append(nodes, page.parent)
+			}
+		}
+		changed = append(changed, page)
+	}
+
+	// The destinations, the appearance streams, the shared actions and then
+	// the annotations, their structure elements and the structure tree are
+	// numbered after the new pages and catalog, if there are any
+
+	nextID := len(xref.Entries)
+	if !opts.ReuseObjects {
+		nextID += len(changed) + 1
+	}
+	var dests *PDFDests
+	if opts.NamedDests {
+		if pdfNamesRegexp.MatchString(catalog.Raw) {
+			return fmt.Errorf("cannot add named destinations to a PDF which already has a name dictionary")
+		}
+		dests = &PDFDests{OwnRef: &PDFObjRef{ID: nextID}, Dests: map[string]string{}}
+		nextID++
+		for _, page := range changed {
+			dests.AddLinkDests(page)
+		}
+		catalog.DestsRef = dests.OwnRef
+	}
+	if opts.Highlight != nil {
+		for _, page := range changed {
+			for _, l := range page.Links {
+				ap := page.appearanceFor(l, opts.Highlight)
+				ap.OwnRef = &PDFObjRef{ID: nextID}
+				nextID++
+				page.Appearances = append(page.Appearances, ap)
+			}
+		}
+	}
+
+	// Actions used by more than one link are written once and referred to
+
+	var actions []*PDFAction
+	shared := map[string]*PDFAction{}
+	uses := map[string]int{}
+	for _, page := range changed {
+		for _, l := range page.Links {
+			if a, lerr := page.linkAction(l); lerr == nil {
+				uses[a]++
+				if uses[a] == 2 {
+					shared[a] = &PDFAction{OwnRef: &PDFObjRef{ID: nextID}, Action: a}
+					nextID++
+					actions = append(actions, shared[a])
+				}
+			}
+		}
+	}
+	for _, page := range changed {
+		page.SharedActions = shared
+	}
+
+	var tree *PDFStructTree
+	var annots []*PDFAnnot
+	if opts.Tagged {
+		if pdfStructTreeRegexp.MatchString(catalog.Raw) {
+			return fmt.Errorf("cannot tag a PDF which already has a structure tree")
+		}
+		for _, page := range changed {
+			page.Annots = []*PDFAnnot{}
+			for i := range page.Links {
+				a := &PDFAnnot{OwnRef: &PDFObjRef{ID: nextID}, Page: page, Index: i, StructParent: len(annots)}
+				nextID++
+				page.Annots = append(page.Annots, a)
+				annots = append(annots, a)
+			}
+		}
+		tree = &PDFStructTree{OwnRef: &PDFObjRef{ID: nextID + len(annots)}}
+		for _, a := range annots {
+			tree.Elems = append(tree.Elems, &PDFLinkElem{OwnRef: &PDFObjRef{ID: nextID}, Annot: a, ParentRef: tree.OwnRef})
+			nextID++
+		}
+		nextID++
+		catalog.StructTreeRef = tree.OwnRef
+	}
+
+	// Write new pages, page tree nodes and catalog
+
+	var outN int
+	var pageOffs []int64
+
+	// The update is appended to the PDF as is, leaving the original objects
+	// and xref intact, and its own xref section only holds the entries that
+	// changed, pointing back to the original one
+
+	nextOff, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if outN, err = fmt.Fprint(f, "\n"); err != nil {
+		return err
+	}
+	nextOff += int64(outN)
+	for _, page := range changed {
+		pageOffs = append(pageOffs, nextOff)
+		if outN, err = page.Marshal(f); err != nil {
+			return err
+		}
+		nextOff += int64(outN)
+	}
+
+	var nodeOffs []int64
+	for _, node := range nodes {
+		nodeOffs = append(nodeOffs, nextOff)
+		if outN, err = node.Marshal(f); err != nil {
+			return err
+		}
+		nextOff += int64(outN)
+	}
+
+	catalogOff := nextOff
+	if !opts.ReuseObjects {
+		xref.Free(catalog.OwnRef.ID)
+		catalog.OwnRef = &PDFObjRef{ID: len(xref.Entries) + len(changed)}
+	}
+	if outN, err = catalog.Marshal(f); err != nil {
+		return err
+	}
+
+	var destsOff int64
+	if dests != nil {
+		nextOff += int64(outN)
+		destsOff = nextOff
+		if outN, err = dests.Marshal(f); err != nil {
+			return err
+		}
+	}
+
+	var apOffs []int64
+	for _, page := range changed {
+		for _, ap := range page.Appearances {
+			nextOff += int64(outN)
+			apOffs = append(apOffs, nextOff)
+			if outN, err = ap.Marshal(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	var actionOffs []int64
+	for _, a := range actions {
+		nextOff += int64(outN)
+		actionOffs = append(actionOffs, nextOff)
+		if outN, err = a.Marshal(f); err != nil {
+			return err
+		}
+	}
+
+	var annotOffs, elemOffs []int64
+	var treeOff int64
+	if tree != nil {
+		for _, a := range annots {
+			nextOff += int64(outN)
+			annotOffs = append(annotOffs, nextOff)
+			if outN, err = a.Marshal(f); err != nil {
+				return err
+			}
+		}
+		for _, e := range tree.Elems {
+			nextOff += int64(outN)
+			elemOffs = append(elemOffs, nextOff)
+			if outN, err = e.Marshal(f); err != nil {
+				return err
+			}
+		}
+		nextOff += int64(outN)
+		treeOff = nextOff
+		if outN, err = tree.Marshal(f); err != nil {
+			return err
+		}
+	}
+
+	// Write the xref section of the update
+
+	nextOff += int64(outN)
+	xrefNewOff := nextOff
+	firstNewID := len(xref.Entries)
+
+	// Objects stored in object streams are taken out of them, as the stream
+	// itself is left as it is
+
+	rewrite := func(ref *PDFObjRef, off int64) {
+		xref.Entries[ref.ID] = &PDFXrefEntry{Offset: off, Gen: ref.Gen}
+		opts.logf("rewrote object %d at offset %d", ref.ID, off)
+	}
+	for i, node := range nodes {
+		rewrite(node.OwnRef, nodeOffs[i])
+	}
+	if opts.ReuseObjects {
+		for i, page := range changed {
+			rewrite(page.OwnRef, pageOffs[i])
+		}
+		rewrite(catalog.OwnRef, catalogOff)
+	} else {
+		for _, off := range pageOffs {
+			xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: off})
+		}
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: catalogOff})
+	}
+	if dests != nil {
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: destsOff})
+	}
+	for _, off := range apOffs {
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: off})
+	}
+	for _, off := range actionOffs {
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: off})
+	}
+	for _, off := range append(annotOffs, elemOffs...) {
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: off})
+	}
+	if tree != nil {
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: treeOff})
+	}
+	if xref.StreamRef != nil && opts.ReuseObjects {
+		// The new xref stream takes the place of the original one
+		xref.Entries[xref.StreamRef.ID] = &PDFXrefEntry{Offset: xrefNewOff, Gen: xref.StreamRef.Gen}
+	} else if xref.StreamRef != nil {
+		// The new xref stream takes up an object of its own, and the original
+		// one is no longer needed
+		xref.Free(xref.StreamRef.ID)
+		xref.StreamRef = &PDFObjRef{ID: len(xref.Entries)}
+		xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: xrefNewOff})
+	}
+	xref.Trailer.Root = catalog.OwnRef
+	xref.Trailer.Size = len(xref.Entries)
+	xref.Trailer.Prev = xref.OwnOffset
+	for id := firstNewID; id < len(xref.Entries); id++ {
+		opts.logf("wrote object %d at offset %d", id, xref.Entries[id].Offset)
+	}
+	opts.logf("wrote xref at offset %d", xrefNewOff)
+
+	if _, err = xref.Marshal(f); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "startxref\n%d\n%%%%EOF", xrefNewOff); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LinkRect is where a link ends up in a PDF
+type LinkRect struct {
+	// Page the link is on, counting from 0
+	Page int `json:"page"`
+
+	// Rect is the clickable area in PDF points from the bottom left of the
+	// page (llx, lly, urx, ury)
+	Rect [4]float64 `json:"rect"`
+}
+
+// LinkRects returns where each of the links goes in the PDF in f, as
+// AddLinksToPDF places them. Links that are on none of the pages are left out.
+func LinkRects(f io.ReadSeeker, allObjects map[string]*PositionedObject, links []*PositionedLink, opts *Options) (map[*PositionedLink]*LinkRect, error) {
+	opts = opts.withDefaults()
+	opts.OnLinkError = nil
+	opts.Warnf = nil
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := pdf.setupPages(allObjects, links, opts); err != nil {
+		return nil, err
+	}
+	rects := map[*PositionedLink]*LinkRect{}
+	for i, page := range pdf.Kids {
+		for _, l := range page.Links {
+			rects[l] = &LinkRect{Page: i, Rect: page.linkRect(l)}
+		}
+	}
+	return rects, nil
+}
@@ -0,0 +1,87 @@
+package linkify
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBareFragment(t *testing.T) {
+	for url, want := range map[string]string{
+		"#target":        "target",
+		"#my%20target":   "my target",
+		"#caf%C3%A9":     "café",
+		"#100%":          "100%",
+		"https://x.com/": "",
+	} {
+		l := PositionedLink{URL: url}
+		if got := l.BareFragment(); got != want {
+			t.Errorf("%s: got %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestTargetID(t *testing.T) {
+	for url, want := range map[string]string{
+		"#r1":                 "r1",
+		"#missing":            "missing",
+		"#action:print":       "",
+		"#page=2":             "",
+		"https://example.com": "",
+		"other.pdf#r1":        "",
+	} {
+		l := &PositionedLink{URL: url}
+		if got := l.TargetID(); got != want {
+			t.Errorf("%s: got %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestResolveLinkBox(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">
+<a id="a" href="https://example.com/"><g id="g"><rect id="r1" x="0" y="0" width="10" height="10"/><rect id="r2" x="20" y="5" width="10" height="10"/></g></a>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || !reflect.DeepEqual(links[0].Descendants, []string{"g", "r1", "r2"}) {
+		t.Fatalf("got links %+v, want one around g, r1 and r2", links)
+	}
+	l := links[0]
+	box := func(id string, x, y, w, h float64) *PositionedObject {
+		return &PositionedObject{ID: id, X: x, Y: y, W: w, H: h}
+	}
+	// Unlike the union of its contents, the box inkscape gives the anchor
+	// and group takes the stroke into account
+	anchor, group := box("a", -1, -1, 32, 17), box("g", -1, -1, 32, 17)
+	r1, r2 := box("r1", 0, 0, 10, 10), box("r2", 20, 5, 10, 10)
+	union := box("r1", 0, 0, 30, 15)
+	for _, c := range []struct {
+		strategy string
+		objects  []*PositionedObject
+		want     *PositionedObject
+	}{
+		{ResolveExact, []*PositionedObject{anchor, group, r1, r2}, anchor},
+		{ResolveExact, []*PositionedObject{group, r1, r2}, group},
+		{ResolveExact, []*PositionedObject{r1, r2}, union},
+		{ResolveExact, nil, nil},
+		{ResolveFirstChild, []*PositionedObject{anchor, group, r1, r2}, group},
+		{ResolveFirstChild, []*PositionedObject{anchor, r2}, r2},
+		{ResolveFirstChild, []*PositionedObject{anchor}, nil},
+		{ResolveUnion, []*PositionedObject{anchor, r1, r2}, union},
+		{ResolveUnion, []*PositionedObject{anchor, r2}, r2},
+		{ResolveUnion, []*PositionedObject{anchor}, nil},
+	} {
+		objects := map[string]*PositionedObject{}
+		var ids []string
+		for _, o := range c.objects {
+			objects[o.ID] = o
+			ids = append(ids, o.ID)
+		}
+		got := ResolveLinkBox(l, objects, c.strategy)
+		if (got == nil) != (c.want == nil) || got != nil && *got != *c.want {
+			t.Errorf("%s with %v: got %+v, want %+v", c.strategy, ids, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,1395 @@
+package linkify
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	pdfObjRegexp       = regexp.MustCompile(`(?s)(?:^|[\r\n])(\d+)\s+(\d+)\s+obj\s+(.*?)\s*[\r\n]endobj(?:\s|$)`)
+	pdfXrefRegexp      = regexp.MustCompile(`(?s)^xref\s+(\d+)\s+(\d+)\s+(.*?)\s+trailer\s+(.*?)\s+startxref\s+`)
+	pdfXrefEntryRegexp = regexp.MustCompile(`(?m)^(\d+)[^\S\r\n]+(\d+)(?:[^\S\r\n]+([fn]))?[^\S\r\n]*$`)
+	pdfStartxrefRegexp = regexp.MustCompile(`(?:^|[\r\n])startxref\s+(\d+)`)
+	pdfSizeRegexp      = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfPrevRegexp      = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfRotateRegexp    = regexp.MustCompile(`/Rotate\s+(-?\d+)`)
+	pdfRootRegexp      = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+	pdfPagesRegexp     = regexp.MustCompile(`/Pages\s+(\d+)\s+(\d+)\s+R`)
+	pdfKidsRegexp      = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+	pdfRefRegexp       = regexp.MustCompile(`(\d+)\s+(\d+)\s+R`)
+	pdfMediaBoxRegexp  = regexp.MustCompile(`/MediaBox\s*\[\s*(\S+)\s+(\S+)\s+(\S+)\s+([^\s\]]+)`)
+	pdfInfoRegexp      = regexp.MustCompile(`/Info\s+\d+\s+\d+\s+R`)
+	pdfIDRegexp        = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+	pdfNamesRegexp     = regexp.MustCompile(`/Names\b`)
+)
+
+// pdfEOLReplacer turns all the line endings PDFs may have into LF
+var pdfEOLReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// readPDFMatch reads r in chunks until re matches what has been read so far
+// and returns the submatches, or nil if the end of r is reached first. To
+// avoid rescanning on every read, re is only tried once marker shows up in the
+// newly read data.
+func readPDFMatch(r io.Reader, marker string, re *regexp.Regexp) ([]string, error) {
+	var buf []byte
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		from := len(buf) - n - len(marker)
+		if from < 0 {
+			from = 0
+		}
+		if n > 0 && bytes.Contains(buf[from:], []byte(marker)) {
+			if m := re.FindSubmatch(buf); m != nil {
+				sm := make([]string, len(m))
+				for i := range m {
+					sm[i] = string(m[i])
+				}
+				return sm, nil
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readPDFObj reads the PDF object at the start of r, however large it is, and
+// returns its body
+func readPDFObj(r io.Reader) (string, error) {
+	m, err := readPDFMatch(r, "endobj", pdfObjRegexp)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return "", fmt.Errorf("cannot find read PDF object")
+	}
+	return m[3], nil
+}
+
+type PDFXrefEntry struct {
+	Offset int64
+	Gen    int
+	Free   bool
+
+	// StreamID is the ID of the object stream a compressed object is stored
+	// in, and StreamIndex its index within it. StreamID is 0 for objects that
+	// aren't compressed.
+	StreamID    int
+	StreamIndex int
+}
+
+func (e *PDFXrefEntry) Marshal(w io.Writer) (int, error) {
+	var free string
+	if e.Free {
+		free = "f"
+	} else {
+		free = "n"
+	}
+	return fmt.Fprintf(w, "%010d %05d %s \n", e.Offset, e.Gen, free)
+}
+
+// streamFields returns the type and the other two fields of the entry as
+// they're stored in an xref stream
+func (e *PDFXrefEntry) streamFields() (int, int64, int64) {
+	switch {
+	case e.Free:
+		return 0, e.Offset, int64(e.Gen)
+	case e.StreamID > 0:
+		return 2, int64(e.StreamID), int64(e.StreamIndex)
+	default:
+		return 1, e.Offset, int64(e.Gen)
+	}
+}
+
+// PDFMaxGen is the largest generation number. Free entries with it can't be
+// reused.
+const PDFMaxGen = 65535
+
+type PDFObjRef struct {
+	ID  int
+	Gen int
+}
+
+func (r *PDFObjRef) String() string {
+	return fmt.Sprintf("%d %d R", r.ID, r.Gen)
+}
+
+type PDFXrefTrailer struct {
+	Size int
+	Root *PDFObjRef
+	Raw  string
+
+	// Prev is the offset of the xref section this one updates, 0 if there's
+	// none
+	Prev int64
+}
+
+func (t *PDFXrefTrailer) Marshal(w io.Writer) (int, error) {
+	s := pdfSizeRegexp.ReplaceAllStringFunc(t.Raw, func(s string) string {
+		return fmt.Sprintf("/Size %d", t.Size)
+	})
+	s = pdfRootRegexp.ReplaceAllStringFunc(s, func(s string) string {
+		return fmt.Sprintf("/Root %s", t.Root)
+	})
+	s = pdfPrevRegexp.ReplaceAllString(s, "")
+	if t.Prev > 0 {
+		var err error
+		if s, err = pdfDictAppend(s, fmt.Sprintf("/Prev %d", t.Prev)); err != nil {
+			return 0, fmt.Errorf("cannot write PDF xref trailer: %s", err)
+		}
+	}
+	return w.Write([]byte("trailer\n" + s + "\n"))
+}
+
+type PDFCatalog struct {
+	OwnRef   *PDFObjRef
+	PagesRef *PDFObjRef
+	Raw      string
+
+	// DestsRef, if not nil, is added as the /Dests name tree of the catalog
+	DestsRef *PDFObjRef
+
+	// StructTreeRef, if not nil, is added as the structure tree of the
+	// catalog
+	StructTreeRef *PDFObjRef
+}
+
+func UnmarshalPDFCatalog(s string) (*PDFCatalog, error) {
+	m := pdfPagesRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("cannot read PDF catalog")
+	}
+	id, _ := strconv.ParseInt(m[1], 10, 32)
+	gen, _ := strconv.ParseInt(m[2], 10, 32)
+	return &PDFCatalog{PagesRef: &PDFObjRef{ID: int(id), Gen: int(gen)}, Raw: s}, nil
+}
+
+func (c *PDFCatalog) Marshal(w io.Writer) (int, error) {
+	s := pdfPagesRegexp.ReplaceAllStringFunc(c.Raw, func(s string) string {
+		return fmt.Sprintf("/Pages %s", c.PagesRef)
+	})
+	var err error
+	if c.DestsRef != nil {
+		if s, err = pdfDictAppend(s, fmt.Sprintf("/Names << /Dests %s >>", c.DestsRef)); err != nil {
+			return 0, fmt.Errorf("cannot add names to PDF catalog: %s", err)
+		}
+	}
+	if c.StructTreeRef != nil {
+		if s, err = pdfDictAppend(s, fmt.Sprintf("/StructTreeRoot %s", c.StructTreeRef)); err != nil {
+			return 0, fmt.Errorf("cannot add structure tree to PDF catalog: %s", err)
+		}
+	}
+
+	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", c.OwnRef.ID, c.OwnRef.Gen, s)
+}
+
+type PDFPages struct {
+	OwnRef  *PDFObjRef
+	KidRefs []*PDFObjRef
+	Raw     string
+}
+
+func UnmarshalPDFPages(s string) (*PDFPages, error) {
+	m := pdfKidsRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("cannot read PDF pages")
+	}
+	pages := PDFPages{Raw: s}
+	for _, rm := range pdfRefRegexp.FindAllStringSubmatch(m[1], -1) {
+		id, _ := strconv.ParseInt(rm[1], 10, 32)
+		gen, _ := strconv.ParseInt(rm[2], 10, 32)
+		pages.KidRefs = append(pages.KidRefs, &PDFObjRef{ID: int(id), Gen: int(gen)})
+	}
+	if len(pages.KidRefs) == 0 {
+		return nil, fmt.Errorf("PDF has no pages")
+	}
+	return &pages, nil
+}
+
+func (p *PDFPages) Marshal(w io.Writer) (int, error) {
+	s := pdfKidsRegexp.ReplaceAllStringFunc(p.Raw, func(s string) string {
+		kids := make([]string, len(p.KidRefs))
+		for i, r := range p.KidRefs {
+			kids[i] = r.String()
+		}
+		return fmt.Sprintf("/Kids [ %s ]", strings.Join(kids, " "))
+	})
+
+	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", p.OwnRef.ID, p.OwnRef.Gen, s)
+}
+
+type PDFPage struct {
+	OwnRef   *PDFObjRef
+	Links    []*PositionedLink
+	Objects  map[string]*PositionedObject
+	Viewport *Viewport
+	Width    float64
+	Height   float64
+	Raw      string
+
+	// X and Y are the lower left corner of the media box, which isn't always
+	// at the origin (e.g. when exporting only the drawing area)
+	X float64
+	Y float64
+
+	// Rotate is how many degrees clockwise viewers turn the page when
+	// showing it: 0, 90, 180 or 270
+	Rotate int
+
+	// AllPages holds all the pages of the document, which the targets of
+	// internal links are looked up on. If nil, targets are taken to be on
+	// this page.
+	AllPages []*PDFPage
+
+	// Appearances holds the appearance stream of each link, if any
+	Appearances []*PDFAppearance
+
+	// Border is drawn around each link if not nil
+	Border *Border
+
+	// Fit is how the destinations of internal links are viewed, one of the
+	// Fit constants. Empty means FitR.
+	Fit string
+
+	// FitMargin is the room left around the targets of internal links with
+	// FitR
+	FitMargin Margin
+
+	// LinkPadding is the room added around the clickable area of each link
+	LinkPadding Margin
+
+	// NamedDests makes internal links refer to their targets by name, as
+	// given by PDFDests, instead of inlining the destination
+	NamedDests bool
+
+	// OnLinkError, if not nil, is called with links that cannot be marshaled
+	// correctly
+	OnLinkError func(*LinkError) error
+
+	// SharedActions holds the action objects that links with the same action
+	// refer to instead of each having its own copy, keyed by the action
+	// dictionary
+	SharedActions map[string]*PDFAction
+
+	// Annots, if not nil, holds the annotation object of each link, which
+	// the page then refers to instead of having the annotations inline
+	Annots []*PDFAnnot
+
+	// OldAnnots are the elements of the /Annots array the page already had,
+	// which the links are added after, see takeAnnots
+	OldAnnots string
+
+	// parent is the page tree node the page is a kid of, at index kid of its
+	// /Kids
+	parent *PDFPages
+	kid    int
+}
+
+// takeAnnots moves the annotations already on the page, e.g. form fields,
+// from its raw dictionary to OldAnnots so they're kept alongside the links.
+// The array is read from f if it's an object of its own.
+func (p *PDFPage) takeAnnots(f io.ReadSeeker, xref *PDFXref) error {
+	keyStart, start, end, ok := pdfDictEntry(p.Raw, "Annots")
+	if !ok {
+		return nil
+	}
+	annots := p.Raw[start:end]
+	if v, err := ParsePDFValue(annots); err == nil {
+		if ref, ok := v.(*PDFObjRef); ok {
+			if annots, err = xref.ReadObj(f, ref); err != nil {
+				return fmt.Errorf("cannot read annotations of PDF page: %s", err)
+			}
+		}
+	}
+	annots = strings.TrimSpace(annots)
+	if !strings.HasPrefix(annots, "[") || !strings.HasSuffix(annots, "]") {
+		return fmt.Errorf("annotations of PDF page are not an array")
+	}
+	p.OldAnnots = strings.TrimSpace(annots[1 : len(annots)-1])
+	p.Raw = p.Raw[:keyStart] + p.Raw[end:]
+	return nil
+}
+
+func UnmarshalPDFPage(s string) (*PDFPage, error) {
+	return unmarshalPDFPage(s, nil)
+}
+
+// unmarshalPDFPage is UnmarshalPDFPage for a page which takes the /MediaBox
+// and /Rotate it doesn't have itself from the page tree nodes above it, whose
+// dictionaries inherited holds from the nearest up
+func unmarshalPDFPage(s string, inherited []string) (*PDFPage, error) {
+	attr := func(re *regexp.Regexp) []string {
+		for _, d := range append([]string{s}, inherited...) {
+			if m := re.FindStringSubmatch(d); m != nil {
+				return m
+			}
+		}
+		return nil
+	}
+	m := attr(pdfMediaBoxRegexp)
+	if m == nil {
+		return nil, fmt.Errorf("cannot find PDF page media box")
+	}
+	var box [4]float64
+	for i := range box {
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PDF media box '%s' found", strings.TrimSpace(m[0]))
+		}
+		box[i] = v
+	}
+	x1, y1 := math.Min(box[0], box[2]), math.Min(box[1], box[3])
+	x2, y2 := math.Max(box[0], box[2]), math.Max(box[1], box[3])
+	page := PDFPage{Raw: s, X: x1, Y: y1, Width: x2 - x1, Height: y2 - y1, Viewport: DefaultViewport}
+	if m := attr(pdfRotateRegexp); m != nil {
+		r, _ := strconv.Atoi(m[1])
+		if r%90 != 0 {
+			return nil, fmt.Errorf("invalid PDF page rotation %d - expected a multiple of 90", r)
+		}
+		page.Rotate = (r%360 + 360) % 360
+	}
+	return &page, nil
+}
+
+// Contains reports whether the center of o, in SVG user units, falls on the
+// page
+func (p *PDFPage) Contains(o *PositionedObject) bool {
+	x, y := o.X+o.W/2, o.Y+o.H/2
+	w, h := p.ShownSize()
+	return x >= p.Viewport.X && x <= p.Viewport.X+w/p.Viewport.Scale &&
+		y >= p.Viewport.Y && y <= p.Viewport.Y+h/p.Viewport.Scale
+}
+
+// targetPage returns the page the internal link target o is on
+func (p *PDFPage) targetPage(o *PositionedObject) *PDFPage {
+	if len(p.AllPages) > 1 {
+		for _, q := range p.AllPages {
+			if q.Contains(o) {
+				return q
+			}
+		}
+	}
+	return p
+}
+
+// ShownSize returns the width and height of the page in points as viewers
+// show it, i.e. turned by /Rotate
+func (p *PDFPage) ShownSize() (float64, float64) {
+	if p.Rotate == 90 || p.Rotate == 270 {
+		return p.Height, p.Width
+	}
+	return p.Width, p.Height
+}
+
+// pdfPoint converts a position in SVG user units to PDF points in the page's
+// own coordinates, which annotations and destinations are in. The SVG is
+// taken to be the page as shown, so with /Rotate the position is turned back.
+func (p *PDFPage) pdfPoint(x, y float64) (float64, float64) {
+	// From the top left of the page as shown
+	u, v := (x-p.Viewport.X)*p.Viewport.Scale, (y-p.Viewport.Y)*p.Viewport.Scale
+	switch p.Rotate {
+	case 90:
+		return p.X + v, p.Y + u
+	case 180:
+		return p.X + p.Width - u, p.Y + v
+	case 270:
+		return p.X + p.Width - v, p.Y + p.Height - u
+	default:
+		return p.X + u, p.Y + p.Height - v
+	}
+}
+
+// pdfRect converts a rectangle in SVG user units to PDF points (left, bottom,
+// right and top) in the page's own coordinates
+func (p *PDFPage) pdfRect(x, y, w, h float64) [4]float64 {
+	x1, y1 := p.pdfPoint(x, y)
+	x2, y2 := p.pdfPoint(x+w, y+h)
+	return [4]float64{math.Min(x1, x2), math.Min(y1, y2), math.Max(x1, x2), math.Max(y1, y2)}
+}
+
+// linkRect returns the clickable area of the link in PDF points (left,
+// bottom, right and top) grown by LinkPadding, without the parts outside the
+// media box, which some viewers reject
+func (p *PDFPage) linkRect(l *PositionedLink) [4]float64 {
+	return p.inflate(p.pdfRect(l.X, l.Y, l.W, l.H), p.LinkPadding)
+}
+
+// onPage reports whether any of the link's bounding box, regardless of
+// padding, is within the media box
+func (p *PDFPage) onPage(l *PositionedLink) bool {
+	r := p.inflate(p.pdfRect(l.X, l.Y, l.W, l.H), Margin{})
+	return r[0] < r[2] && r[1] < r[3]
+}
+
+// The ways the target of an internal link can be viewed, see Options.Fit
+const (
+	// FitR zooms so that the target's bounding box fills the window
+	FitR = "fitr"
+
+	// Fit shows the whole page holding the target
+	Fit = "fit"
+
+	// FitB shows the whole bounding box of the content of the target's page
+	FitB = "fitb"
+
+	// XYZ scrolls the top left corner of the target to the top left of the
+	// window and keeps the current zoom
+	XYZ = "xyz"
+)
+
+// Margin is room around a rectangle, either in points or, if Percent is true,
+// as a percentage of the rectangle's width and height
+type Margin struct {
+	Value   float64
+	Percent bool
+}
+
+// ParseMargin parses a margin in points, e.g. 6 or 6pt, or in percent, e.g.
+// 10%
+func ParseMargin(s string) (Margin, error) {
+	m := Margin{}
+	v := strings.TrimSpace(s)
+	if strings.HasSuffix(v, "%") {
+		m.Percent = true
+		v = strings.TrimSuffix(v, "%")
+	} else {
+		v = strings.TrimSuffix(v, "pt")
+	}
+	var err error
+	if m.Value, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil || m.Value < 0 {
+		return m, fmt.Errorf("invalid margin '%s' - expected points (e.g. 6) or percent (e.g. 10%%)", s)
+	}
+	return m, nil
+}
+
+// inflate returns the rectangle (left, bottom, right and top) grown by the
+// margin on each side, but no further than the page's media box
+func (p *PDFPage) inflate(r [4]float64, m Margin) [4]float64 {
+	dx, dy := m.Value, m.Value
+	if m.Percent {
+		dx, dy = (r[2]-r[0])*m.Value/100, (r[3]-r[1])*m.Value/100
+	}
+	return [4]float64{
+		math.Max(r[0]-dx, p.X),
+		math.Max(r[1]-dy, p.Y),
+		math.Min(r[2]+dx, p.X+p.Width),
+		math.Min(r[3]+dy, p.Y+p.Height),
+	}
+}
+
+// dest returns the explicit destination of the internal link target t. PDF
+// destinations are in points from the bottom left of the page, so for an
+// unrotated page, the target's left edge and top edge, which is its smallest Y
+// in SVG user units, are at pdfPoint(t.X, t.Y).
+func (p *PDFPage) dest(t *PositionedObject) string {
+	tp := p.targetPage(t)
+	switch p.Fit {
+	case Fit:
+		return fmt.Sprintf("[ %d %d R /Fit ]", tp.OwnRef.ID, tp.OwnRef.Gen)
+	case FitB:
+		return fmt.Sprintf("[ %d %d R /FitB ]", tp.OwnRef.ID, tp.OwnRef.Gen)
+	case XYZ:
+		// A null zoom leaves the zoom as is
+		x, y := tp.pdfPoint(t.X, t.Y)
+		return fmt.Sprintf("[ %d %d R /XYZ %f %f null ]", tp.OwnRef.ID, tp.OwnRef.Gen, x, y)
+	default:
+		// Left, bottom, right and top
+		r := tp.pdfRect(t.X, t.Y, t.W, t.H)
+		if p.FitMargin.Value > 0 {
+			r = tp.inflate(r, p.FitMargin)
+		}
+		return fmt.Sprintf("[ %d %d R /FitR %f %f %f %f ]", tp.OwnRef.ID, tp.OwnRef.Gen, r[0], r[1], r[2], r[3])
+	}
+}
+
+// remotePDFLink returns the file and destination of links to other PDFs, such
+// as file:other.pdf#page=3, which go to the given page (or a named destination
+// with #name, or the first page without a fragment). ok is false for any
+// other link.
+func remotePDFLink(link string) (file, dest string, ok bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "file" {
+		return "", "", false
+	}
+	file = u.Opaque
+	if file == "" {
+		file = u.Path
+	}
+	if !strings.HasSuffix(strings.ToLower(file), ".pdf") {
+		return "", "", false
+	}
+	dest, ok = remoteDest(u.Fragment)
+	return file, dest, ok
+}
+
+// remoteDest returns the destination in another PDF given by the fragment of
+// a link to it: page=N for page N, a named destination, or the first page if
+// empty
+func remoteDest(fragment string) (string, bool) {
+	switch {
+	case fragment == "":
+		return "[ 0 /Fit ]", true
+	case strings.HasPrefix(fragment, "page="):
+		n, err := strconv.Atoi(strings.TrimPrefix(fragment, "page="))
+		if err != nil || n < 1 {
+			return "", false
+		}
+		// Pages of other files are given by their index
+		return fmt.Sprintf("[ %d /Fit ]", n-1), true
+	default:
+		return pdfString(fragment), true
+	}
+}
+
+// embeddedScheme is the scheme of links to PDFs attached to the PDF itself,
+// e.g. embedded:appendix.pdf#page=2
+const embeddedScheme = "embedded"
+
+// embeddedPDFLink returns the name the PDF is attached under and the
+// destination in it of embedded: links, with destinations as for
+// remotePDFLink. ok is false if the link isn't to an attached PDF.
+func embeddedPDFLink(link string) (name, dest string, ok bool) {
+	u, err := url.Parse(link)
+	if err != nil || !strings.EqualFold(u.Scheme, embeddedScheme) {
+		return "", "", false
+	}
+	name = u.Opaque
+	if name == "" {
+		name = u.Path
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+		return "", "", false
+	}
+	dest, ok = remoteDest(u.Fragment)
+	return name, dest, ok
+}
+
+// fileLink returns the file of file: links
+func fileLink(link string) (file string, ok bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	file = u.Opaque
+	if file == "" {
+		file = u.Path
+	}
+	return file, file != ""
+}
+
+// namedActionPrefix marks internal links that perform a named action instead
+// of going to an object, e.g. #action:print
+const namedActionPrefix = "action:"
+
+// PDFNamedActions maps the names usable after namedActionPrefix to the
+// standard PDF named actions
+var PDFNamedActions = map[string]PDFName{
+	"print":     "Print",
+	"firstpage": "FirstPage",
+	"lastpage":  "LastPage",
+	"nextpage":  "NextPage",
+	"prevpage":  "PrevPage",
+}
+
+// pageFragmentPrefix marks internal links that go to a whole page instead of
+// an object, e.g. #page=2
+const pageFragmentPrefix = "page="
+
+// linkAction returns the action dictionary for the given link. If the action
+// cannot be built, the returned error says why.
+func (p *PDFPage) linkAction(l *PositionedLink) (string, *LinkError) {
+	bareFragLink := l.BareFragment()
+	var action string
+	var lerr *LinkError
+	if strings.HasPrefix(bareFragLink, namedActionPrefix) {
+		name := strings.TrimPrefix(bareFragLink, namedActionPrefix)
+		if n, ok := PDFNamedActions[strings.ToLower(name)]; ok {
+			action = "/Named /N " + n.String()
+		} else {
+			lerr = &LinkError{Link: l, Reason: fmt.Sprintf("has unknown action '%s'", name)}
+		}
+	} else if strings.HasPrefix(bareFragLink, pageFragmentPrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(bareFragLink, pageFragmentPrefix))
+		switch {
+		case err != nil || n < 1:
+			lerr = &LinkError{Link: l, Reason: "has invalid page number"}
+		case n > len(p.AllPages):
+			lerr = &LinkError{Link: l, Reason: fmt.Sprintf("points to page %d but the PDF has %d", n, len(p.AllPages))}
+		default:
+			q := p.AllPages[n-1]
+			action = fmt.Sprintf("/GoTo /D [ %d %d R /Fit ]", q.OwnRef.ID, q.OwnRef.Gen)
+		}
+	} else if bareFragLink != "" {
+		t := p.Objects[bareFragLink]
+		if t == nil {
+			action = ""
+			lerr = &LinkError{Link: l, Reason: "points to non-existing object"}
+		} else if p.NamedDests {
+			action = "/GoTo /D " + pdfString(bareFragLink)
+		} else {
+			action = "/GoTo /D " + p.dest(t)
+		}
+	} else if uriScheme(l.URL) == embeddedScheme {
+		// The attachment is the named child of the PDF itself
+		if name, dest, ok := embeddedPDFLink(l.URL); ok {
+			action = "/GoToE /D " + dest + " /T << /R /C /N " + pdfString(name) + " >>"
+			if l.NewWindow {
+				action += " /NewWindow true"
+			}
+		} else {
+			lerr = &LinkError{Link: l, Reason: "is not a valid link to an attached PDF"}
+		}
+	} else if file, dest, ok := remotePDFLink(l.URL); ok {
+		action = "/GoToR /F " + pdfString(file) + " /D " + dest
+		if l.NewWindow {
+			action += " /NewWindow true"
+		}
+	} else if file, ok := fileLink(l.URL); ok && l.NewWindow {
+		// URI actions can't ask for a new window, only those opening files
+		// can
+		action = "/Launch /F " + pdfString(file) + " /NewWindow true"
+	} else {
+		action = "/URI /URI " + pdfString(asciiURI(normalizeURI(l.URL)))
+	}
+	return "<< /S " + action + " >>", lerr
+}
+
+// marshalLink returns the link annotation dictionary for the given link,
+// using ap as its appearance if not nil. If the link's action cannot be built,
+// the returned error says why.
+func (p *PDFPage) marshalLink(l *PositionedLink, ap *PDFAppearance) (string, *LinkError) {
+	action, lerr := p.linkAction(l)
+	if a, ok := p.SharedActions[action]; ok && lerr == nil {
+		action = a.OwnRef.String()
+	}
+	var extra string
+	if ap != nil {
+		extra = fmt.Sprintf(" /AP << /N %s >>", ap.OwnRef)
+	}
+	if l.Title != "" {
+		extra += " /Contents " + pdfTextString(l.Title)
+	}
+	r := p.linkRect(l)
+	return fmt.Sprintf(
+		`<< /Type /Annot /Subtype /Link %s /A %s /Rect [ %f %f %f %f ]%s >>`,
+		p.Border.marshal(), action, r[0], r[1], r[2], r[3], extra,
+	), lerr
+}
+
+func (p *PDFPage) Marshal(w io.Writer) (int, error) {
+	b := strings.Builder{}
+	if p.OldAnnots != "" {
+		b.WriteString(" " + p.OldAnnots + " ")
+	}
+	if p.Annots != nil {
+		// Screen readers go through the annotations in structure order
+		for _, a := range p.Annots {
+			b.WriteString(" " + a.OwnRef.String() + " ")
+		}
+		s := p.Raw
+		if keyStart, _, end, ok := pdfDictEntry(s, "Tabs"); ok {
+			s = s[:keyStart] + s[end:]
+		}
+		s, err := pdfDictAppend(s, fmt.Sprintf("/Annots [ %s ] /Tabs /S", b.String()))
+		if err != nil {
+			return 0, fmt.Errorf("cannot add links to PDF page: %s", err)
+		}
+		return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", p.OwnRef.ID, p.OwnRef.Gen, s)
+	}
+	for i, l := range p.Links {
+		var ap *PDFAppearance
+		if i < len(p.Appearances) {
+			ap = p.Appearances[i]
+		}
+		annot, lerr := p.marshalLink(l, ap)
+		if lerr != nil {
+			// setupPages already leaves such links out, and any other is
+			// skipped rather than written with a broken action
+			if p.OnLinkError != nil {
+				if err := p.OnLinkError(lerr); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		b.WriteString(" " + annot + " ")
+	}
+	s, err := pdfDictAppend(p.Raw, fmt.Sprintf("/Annots [ %s ]", b.String()))
+	if err != nil {
+		return 0, fmt.Errorf("cannot add links to PDF page: %s", err)
+	}
+	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", p.OwnRef.ID, p.OwnRef.Gen, s)
+}
+
+// PDFAction is an action dictionary of its own, shared by several links
+type PDFAction struct {
+	OwnRef *PDFObjRef
+	Action string
+}
+
+func (a *PDFAction) Marshal(w io.Writer) (int, error) {
+	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", a.OwnRef.ID, a.OwnRef.Gen, a.Action)
+}
+
+// PDFDests is a name tree of destinations, held in a single node
+type PDFDests struct {
+	OwnRef *PDFObjRef
+
+	// Dests maps names to explicit destinations
+	Dests map[string]string
+}
+
+// AddLinkDests adds a destination for the target of each internal link on
+// page p
+func (d *PDFDests) AddLinkDests(p *PDFPage) {
+	for _, l := range p.Links {
+		id := l.BareFragment()
+		if t := p.Objects[id]; t != nil && !strings.HasPrefix(id, namedActionPrefix) {
+			d.Dests[id] = p.dest(t)
+		}
+	}
+}
+
+func (d *PDFDests) Marshal(w io.Writer) (int, error) {
+	// Names in a name tree must be sorted
+
+	names := make([]string, 0, len(d.Dests))
+	for n := range d.Dests {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	b := strings.Builder{}
+	for _, n := range names {
+		b.WriteString(" " + pdfString(n) + " " + d.Dests[n])
+	}
+	return fmt.Fprintf(w, "%d %d obj\n<< /Names [%s ] >>\nendobj\n", d.OwnRef.ID, d.OwnRef.Gen, b.String())
+}
+
+func UnmarshalPDFXrefTrailer(s string) (*PDFXrefTrailer, error) {
+	m := pdfRootRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("cannot read PDF xref trailer")
+	}
+	id, _ := strconv.ParseInt(m[1], 10, 32)
+	gen, _ := strconv.ParseInt(m[2], 10, 32)
+	t := PDFXrefTrailer{Root: &PDFObjRef{ID: int(id), Gen: int(gen)}, Raw: s}
+	if m := pdfPrevRegexp.FindStringSubmatch(s); m != nil {
+		t.Prev, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	if m := pdfSizeRegexp.FindStringSubmatch(s); m != nil {
+		t.Size, _ = strconv.Atoi(m[1])
+	}
+	return &t, nil
+}
+
+type PDFXref struct {
+	OwnOffset int64
+	ObjStart  int
+	ObjCount  int
+	Entries   []*PDFXrefEntry
+	Trailer   *PDFXrefTrailer
+
+	// StreamRef is the object the xref is stored in when it's an xref stream
+	// rather than a classic xref table, nil otherwise
+	StreamRef *PDFObjRef
+
+	// orig holds the entries as they were read, so that only those changed
+	// since are written to the xref section of an update
+	orig []PDFXrefEntry
+}
+
+func UnmarshalPDFXref(r io.Reader) (*PDFXref, error) {
+	m, err := readPDFMatch(r, "startxref", pdfXrefRegexp)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("cannot find valid xref in PDF")
+	}
+	objStart, _ := strconv.ParseInt(m[1], 10, 32)
+	objCount, _ := strconv.ParseInt(m[2], 10, 32)
+	trailer, err := UnmarshalPDFXrefTrailer(m[4])
+	if err != nil {
+		return nil, err
+	}
+	xref := PDFXref{
+		ObjStart: int(objStart),
+		ObjCount: int(objCount),
+		Trailer:  trailer,
+	}
+	if trailer.Size > 0 {
+		xref.Entries = make([]*PDFXrefEntry, trailer.Size)
+	}
+
+	// The table is made of subsections, each starting with the number of its
+	// first object and the number of entries in it. Objects not in any are
+	// left nil.
+
+	// Lines may end in CR, LF or both, which is all the same here as offsets
+	// within the table don't matter
+
+	table := pdfEOLReplacer.Replace(m[3])
+	lines := pdfXrefEntryRegexp.FindAllStringSubmatch(m[1]+" "+m[2]+"\n"+table, -1)
+	id := 0
+	for _, e := range lines {
+		if e[3] == "" {
+			start, _ := strconv.ParseInt(e[1], 10, 32)
+			id = int(start)
+			continue
+		}
+		offset, _ := strconv.ParseInt(e[1], 10, 64)
+		gen, _ := strconv.ParseInt(e[2], 10, 32)
+		entry := PDFXrefEntry{
+			Offset: offset,
+			Gen:    int(gen),
+			Free:   e[3] == "f",
+		}
+		for id >= len(xref.Entries) {
+			xref.Entries = append(xref.Entries, nil)
+		}
+		xref.Entries[id] = &entry
+		id++
+	}
+	if len(lines) <= 1 {
+		return nil, fmt.Errorf("found empty xref")
+	}
+	return &xref, nil
+}
+
+// UnmarshalPDFXrefStream reads the xref stream object at the start of r, as
+// used by PDF 1.5 and later instead of a classic xref table
+func UnmarshalPDFXrefStream(r io.Reader) (*PDFXref, error) {
+	m, err := readPDFMatch(r, "endobj", pdfObjRegexp)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("cannot find valid xref in PDF")
+	}
+	id, _ := strconv.ParseInt(m[1], 10, 32)
+	gen, _ := strconv.ParseInt(m[2], 10, 32)
+	dict, data, err := splitPDFStream(m[3])
+	if err != nil {
+		return nil, err
+	}
+	if dict["Type"] != PDFName("XRef") {
+		return nil, fmt.Errorf("cannot find valid xref in PDF")
+	}
+	if data, err = decodePDFStream(dict, data); err != nil {
+		return nil, err
+	}
+
+	// The trailer entries are in the stream dictionary itself
+
+	dictEnd := strings.Index(m[3], "stream")
+	if dictEnd < 0 {
+		return nil, fmt.Errorf("cannot find valid xref in PDF")
+	}
+	trailer, err := UnmarshalPDFXrefTrailer(m[3][:dictEnd])
+	if err != nil {
+		return nil, err
+	}
+	size, _ := dict["Size"].(float64)
+	var widths [3]int
+	w, _ := dict["W"].([]interface{})
+	if len(w) != 3 {
+		return nil, fmt.Errorf("invalid PDF xref stream widths")
+	}
+	for i := range w {
+		v, _ := w[i].(float64)
+		if v < 0 || v > 8 {
+			return nil, fmt.Errorf("invalid PDF xref stream widths")
+		}
+		widths[i] = int(v)
+	}
+	index := []interface{}{0.0, size}
+	if v, ok := dict["Index"].([]interface{}); ok {
+		index = v
+	}
+
+	xref := PDFXref{
+		ObjCount:  int(size),
+		Entries:   make([]*PDFXrefEntry, int(size)),
+		Trailer:   trailer,
+		StreamRef: &PDFObjRef{ID: int(id), Gen: int(gen)},
+	}
+	field := func(width, def int) int64 {
+		if width == 0 {
+			return int64(def)
+		}
+		var v int64
+		for _, b := range data[:width] {
+			v = v<<8 | int64(b)
+		}
+		data = data[width:]
+		return v
+	}
+	rowLen := widths[0] + widths[1] + widths[2]
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := index[i].(float64)
+		count, _ := index[i+1].(float64)
+		for id := int(start); id < int(start+count); id++ {
+			if len(data) < rowLen {
+				return nil, fmt.Errorf("truncated PDF xref stream")
+			}
+			typ, f2, f3 := field(widths[0], 1), field(widths[1], 0), field(widths[2], 0)
+			if id < 0 || id >= len(xref.Entries) {
+				continue
+			}
+			e := PDFXrefEntry{}
+			switch typ {
+			case 0:
+				e.Free, e.Gen = true, int(f3)
+			case 1:
+				e.Offset, e.Gen = f2, int(f3)
+			case 2:
+				e.StreamID, e.StreamIndex = int(f2), int(f3)
+			default:
+				// Unknown types are to be treated as null objects
+				e.Free = true
+			}
+			xref.Entries[id] = &e
+		}
+	}
+	return &xref, nil
+}
+
+// inherit takes the entries x doesn't have from older, the xref section x
+// was written on top of in an incremental update
+func (x *PDFXref) inherit(older *PDFXref) {
+	for id, e := range older.Entries {
+		for id >= len(x.Entries) {
+			x.Entries = append(x.Entries, nil)
+		}
+		if x.Entries[id] == nil {
+			x.Entries[id] = e
+		}
+	}
+}
+
+// sections returns the first object number and number of entries of each
+// run of entries which differ from what was read, which is what the xref
+// section of an update holds
+func (x *PDFXref) sections() [][2]int {
+	var runs [][2]int
+	for id, e := range x.Entries {
+		if id < len(x.orig) && *e == x.orig[id] {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1][0]+runs[n-1][1] == id {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int{id, 1})
+		}
+	}
+	return runs
+}
+
+func (x *PDFXref) Marshal(w io.Writer) (int, error) {
+	x.linkFree()
+	if x.StreamRef != nil {
+		return x.marshalStream(w)
+	}
+	var err error
+	var nTotal, n int
+	if n, err = fmt.Fprint(w, "xref\n"); err != nil {
+		return nTotal + n, err
+	}
+	nTotal += n
+
+	for _, sec := range x.sections() {
+		if n, err = fmt.Fprintf(w, "%d %d\n", sec[0], sec[1]); err != nil {
+			return nTotal + n, err
+		}
+		nTotal += n
+		for _, e := range x.Entries[sec[0] : sec[0]+sec[1]] {
+			if n, err = e.Marshal(w); err != nil {
+				return nTotal + n, err
+			}
+			nTotal += n
+		}
+	}
+
+	if n, err = x.Trailer.Marshal(w); err != nil {
+		return nTotal + n, err
+	}
+	nTotal += n
+
+	return nTotal, nil
+}
+
+// marshalStream writes the xref as an uncompressed xref stream object, with
+// the trailer entries in its dictionary. x.StreamRef must already have an
+// entry.
+func (x *PDFXref) marshalStream(w io.Writer) (int, error) {
+	sections := x.sections()
+	var entries []*PDFXrefEntry
+	index := strings.Builder{}
+	for _, sec := range sections {
+		entries = append(entries, x.Entries[sec[0]:sec[0]+sec[1]]...)
+		fmt.Fprintf(&index, " %d %d", sec[0], sec[1])
+	}
+	var maxF2, maxF3 int64
+	for _, e := range entries {
+		_, f2, f3 := e.streamFields()
+		if f2 > maxF2 {
+			maxF2 = f2
+		}
+		if f3 > maxF3 {
+			maxF3 = f3
+		}
+	}
+	width := func(v int64) int {
+		n := 1
+		for v > 0xff {
+			v >>= 8
+			n++
+		}
+		return n
+	}
+	w2, w3 := width(maxF2), width(maxF3)
+	data := bytes.Buffer{}
+	put := func(v int64, n int) {
+		for i := n - 1; i >= 0; i-- {
+			data.WriteByte(byte(v >> uint(8*i)))
+		}
+	}
+	for _, e := range entries {
+		typ, f2, f3 := e.streamFields()
+		put(int64(typ), 1)
+		put(f2, w2)
+		put(f3, w3)
+	}
+
+	var extra string
+	for _, re := range []*regexp.Regexp{pdfInfoRegexp, pdfIDRegexp} {
+		if m := re.FindString(x.Trailer.Raw); m != "" {
+			extra += " " + m
+		}
+	}
+	if x.Trailer.Prev > 0 {
+		extra += fmt.Sprintf(" /Prev %d", x.Trailer.Prev)
+	}
+	n, err := fmt.Fprintf(w, "%d %d obj\n<< /Type /XRef /Size %d /Index [%s ] /W [ 1 %d %d ] /Root %s%s /Length %d >>\nstream\n",
+		x.StreamRef.ID, x.StreamRef.Gen, x.Trailer.Size, index.String(), w2, w3, x.Trailer.Root, extra, data.Len())
+	if err != nil {
+		return n, err
+	}
+	n2, err := w.Write(data.Bytes())
+	if err != nil {
+		return n + n2, err
+	}
+	n3, err := fmt.Fprint(w, "\nendstream\nendobj\n")
+	return n + n2 + n3, err
+}
+
+// SeekObj seeks f to the start of the object with the given reference. It
+// fails if the object isn't in use or its generation doesn't match the xref.
+func (x *PDFXref) SeekObj(f io.Seeker, ref *PDFObjRef) error {
+	if ref.ID < 0 || ref.ID >= len(x.Entries) || x.Entries[ref.ID].Free {
+		return fmt.Errorf("PDF object %s is not in xref", ref)
+	}
+	if e := x.Entries[ref.ID]; e.Gen != ref.Gen {
+		return fmt.Errorf("PDF object %s has generation %d in xref", ref, e.Gen)
+	}
+	if x.Entries[ref.ID].StreamID > 0 {
+		return fmt.Errorf("PDF object %s is in an object stream", ref)
+	}
+	_, err := f.Seek(x.Entries[ref.ID].Offset, io.SeekStart)
+	return err
+}
+
+// ReadObj reads the body of the object with the given reference, including
+// objects compressed in object streams
+func (x *PDFXref) ReadObj(f io.ReadSeeker, ref *PDFObjRef) (string, error) {
+	if ref.ID >= 0 && ref.ID < len(x.Entries) && ref.Gen == 0 {
+		if e := x.Entries[ref.ID]; !e.Free && e.StreamID > 0 {
+			s, err := x.ReadObj(f, &PDFObjRef{ID: e.StreamID})
+			if err != nil {
+				return "", err
+			}
+			return objFromStream(s, e.StreamIndex)
+		}
+	}
+	if err := x.SeekObj(f, ref); err != nil {
+		return "", err
+	}
+	return readPDFObj(f)
+}
+
+// Free marks the object with the given ID as free. Its generation is bumped so
+// that a later reuse of the ID doesn't clash with existing references.
+func (x *PDFXref) Free(id int) {
+	gen := x.Entries[id].Gen + 1
+	if gen > PDFMaxGen {
+		gen = PDFMaxGen
+	}
+	x.Entries[id] = &PDFXrefEntry{Gen: gen, Free: true}
+}
+
+// linkFree chains the free entries into the free list the xref must hold:
+// entry 0, which always has the largest generation, points to the first free
+// object, each free object to the next and the last back to 0. The offset of
+// a free entry is the number of the next one.
+func (x *PDFXref) linkFree() {
+	if len(x.Entries) == 0 {
+		return
+	}
+	x.Entries[0].Free, x.Entries[0].Gen = true, PDFMaxGen
+	prev := x.Entries[0]
+	for id, e := range x.Entries[1:] {
+		if e.Free {
+			prev.Offset = int64(id + 1)
+			prev = e
+		}
+	}
+	prev.Offset = 0
+}
+
+// PDFFile holds the xref, catalog, page tree and pages of a PDF
+type PDFFile struct {
+	Xref    *PDFXref
+	Catalog *PDFCatalog
+	Pages   *PDFPages
+	Kids    []*PDFPage
+}
+
+// pdfTailLen is how far from the end of a PDF its last startxref is looked
+// for, which leaves room for trailing comments and whitespace after it
+const pdfTailLen = 1024
+
+// UnmarshalPDFFile loads the original xref, catalog, page tree and pages of
+// the PDF in f
+func UnmarshalPDFFile(f io.ReadSeeker) (*PDFFile, error) {
+	// A single Read may return less than asked for, so read the tail in
+	// full. It's shorter than pdfTailLen only for tiny files.
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	tail := int64(pdfTailLen)
+	if size < tail {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	if _, err := f.Seek(-tail, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil, err
+	}
+
+	// The tail may well take in an earlier startxref too
+
+	sxrefMs := pdfStartxrefRegexp.FindAllStringSubmatch(string(buf), -1)
+	if sxrefMs == nil {
+		return nil, fmt.Errorf("cannot find startxref in PDF")
+	}
+	origXrefOff, err := strconv.ParseInt(sxrefMs[len(sxrefMs)-1][1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid startxref in PDF: %s", err)
+	}
+
+	xref, err := readXrefSection(f, origXrefOff)
+	if err != nil {
+		return nil, err
+	}
+	xref.OwnOffset = origXrefOff
+
+	// A PDF that was updated incrementally has older xref sections, which
+	// hold the entries of the objects the newer ones don't change
+
+	seen := map[int64]bool{origXrefOff: true}
+	for off := xref.Trailer.Prev; off > 0 && !seen[off]; {
+		seen[off] = true
+		older, err := readXrefSection(f, off)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read earlier xref section: %s", err)
+		}
+		xref.inherit(older)
+		off = older.Trailer.Prev
+	}
+	for i, e := range xref.Entries {
+		if e == nil {
+			xref.Entries[i] = &PDFXrefEntry{Free: true}
+		}
+		xref.orig = append(xref.orig, *xref.Entries[i])
+	}
+
+	s, err := xref.ReadObj(f, xref.Trailer.Root)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := UnmarshalPDFCatalog(s)
+	if err != nil {
+		return nil, err
+	}
+	catalog.OwnRef = xref.Trailer.Root
+
+	if s, err = xref.ReadObj(f, catalog.PagesRef); err != nil {
+		return nil, err
+	}
+	pages, err := UnmarshalPDFPages(s)
+	if err != nil {
+		return nil, err
+	}
+	pages.OwnRef = catalog.PagesRef
+
+	pdf := PDFFile{Xref: xref, Catalog: catalog, Pages: pages}
+	if err := pdf.readPageTree(f, pages, nil, map[int]bool{pages.OwnRef.ID: true}); err != nil {
+		return nil, err
+	}
+
+	return &pdf, nil
+}
+
+// readPageTree appends the pages under the page tree node to Kids in order,
+// going down into the nodes below it, e.g. those of a PDF of many pages.
+// inherited holds the dictionaries of the nodes above it, nearest first, and
+// seen the objects already in the tree, which a kid can't be again.
+func (p *PDFFile) readPageTree(f io.ReadSeeker, node *PDFPages, inherited []string, seen map[int]bool) error {
+	inherited = append([]string{node.Raw}, inherited...)
+	for i, ref := range node.KidRefs {
+		if seen[ref.ID] {
+			return fmt.Errorf("PDF page tree has object %s more than once", ref)
+		}
+		seen[ref.ID] = true
+		s, err := p.Xref.ReadObj(f, ref)
+		if err != nil {
+			return err
+		}
+		if _, start, end, ok := pdfDictEntry(s, "Type"); ok && strings.TrimSpace(s[start:end]) == "/Pages" {
+			kid, err := UnmarshalPDFPages(s)
+			if err != nil {
+				return err
+			}
+			kid.OwnRef = ref
+			if err := p.readPageTree(f, kid, inherited, seen); err != nil {
+				return err
+			}
+			continue
+		}
+		page, err := unmarshalPDFPage(s, inherited)
+		if err != nil {
+			return err
+		}
+		page.OwnRef, page.parent, page.kid = ref, node, i
+		p.Kids = append(p.Kids, page)
+	}
+	return nil
+}
+
+// readXrefSection reads the xref section at offset off of f, which is either a
+// classic xref table or an xref stream object
+func readXrefSection(f io.ReadSeeker, off int64) (*PDFXref, error) {
+	f.Seek(off, io.SeekStart)
+	kw := make([]byte, 4)
+	if _, err := io.ReadFull(f, kw); err != nil {
+		return nil, err
+	}
+	f.Seek(off, io.SeekStart)
+	if string(kw) == "xref" {
+		return UnmarshalPDFXref(f)
+	}
+	return UnmarshalPDFXrefStream(f)
+}
+
+// setupPages gives each page its viewport, the objects links may point to and
+// the links that fall on it. With a single page, all links go on it.
+// Otherwise, links that are on none of the pages are reported through
+// opts.OnLinkError. Either way, links entirely outside the media box of their
+// page are left out with a warning, and those whose action cannot be built
+// are left out and reported too. opts must have its defaults set.
+func (p *PDFFile) setupPages(allObjects map[string]*PositionedObject, links []*PositionedLink, opts *Options) error {
+	for i, page := range p.Kids {
+		page.Objects = allObjects
+		page.OnLinkError = opts.OnLinkError
+		page.AllPages = p.Kids
+		page.Links = nil
+		page.Border = opts.Border
+		page.NamedDests = opts.NamedDests
+		page.Fit = opts.Fit
+		page.FitMargin = opts.FitMargin
+		page.LinkPadding = opts.LinkPadding
+		if i < len(opts.PageViewports) {
+			page.Viewport = opts.PageViewports[i]
+		} else {
+			page.Viewport = opts.Viewport
+		}
+	}
+	if len(p.Kids) == 1 {
+		p.Kids[0].Links = links
+		p.dropOffPage(opts)
+		return p.dropBroken(opts)
+	}
+	for _, l := range links {
+		o := &PositionedObject{X: l.X, Y: l.Y, W: l.W, H: l.H}
+		var on *PDFPage
+		for _, page := range p.Kids {
+			if page.Contains(o) {
+				on = page
+				break
+			}
+		}
+		if on == nil {
+			if opts.OnLinkError != nil {
+				if err := opts.OnLinkError(&LinkError{Link: l, Reason: "is not on any page"}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		on.Links = append(on.Links, l)
+	}
+	p.dropOffPage(opts)
+	return p.dropBroken(opts)
+}
+
+// dropBroken leaves out the links of each page whose action cannot be built,
+// e.g. internal links to missing objects, reporting them through
+// opts.OnLinkError, so that no annotation is written with a broken action
+func (p *PDFFile) dropBroken(opts *Options) error {
+	for _, page := range p.Kids {
+		var kept []*PositionedLink
+		for _, l := range page.Links {
+			if _, lerr := page.linkAction(l); lerr == nil {
+				kept = append(kept, l)
+			} else if opts.OnLinkError != nil {
+				if err := opts.OnLinkError(lerr); err != nil {
+					return err
+				}
+			}
+		}
+		page.Links = kept
+	}
+	return nil
+}
+
+// dropOffPage leaves out the links of each page which are entirely outside
+// its media box, e.g. on objects bleeding off the page, with a warning
+func (p *PDFFile) dropOffPage(opts *Options) {
+	for _, page := range p.Kids {
+		var kept []*PositionedLink
+		for _, l := range page.Links {
+			if page.onPage(l) {
+				kept = append(kept, l)
+			} else {
+				opts.warnf("link '%s' is entirely outside the page - leaving it out", l.URL)
+			}
+		}
+		page.Links = kept
+	}
+}
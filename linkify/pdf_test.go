@@ -0,0 +1,1836 @@
+package linkify
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// memFile is an io.ReadWriteSeeker over a PDF in memory
+type memFile struct {
+	b   []byte
+	pos int64
+}
+
+func newMemFile(b []byte) *memFile {
+	return &memFile{b: append([]byte(nil), b...)}
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.pos >= int64(len(f.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if end := f.pos + int64(len(p)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	n := copy(f.b[f.pos:], p)
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += f.pos
+	case io.SeekEnd:
+		off += int64(len(f.b))
+	}
+	if off < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	f.pos = off
+	return off, nil
+}
+
+// testPDF returns a PDF holding the given object bodies, numbered from 1, with
+// a classic xref table and the first object as the catalog
+func testPDF(objs ...string) []byte {
+	return testPDFGens(nil, objs...)
+}
+
+// testPDFGens is like testPDF with the objects having the given generation
+// numbers, 0 for those past the end of gens
+func testPDFGens(gens []int, objs ...string) []byte {
+	gen := func(i int) int {
+		if i < len(gens) {
+			return gens[i]
+		}
+		return 0
+	}
+	b := bytes.Buffer{}
+	b.WriteString("%PDF-1.4\n")
+	offs := make([]int, len(objs))
+	for i, o := range objs {
+		offs[i] = b.Len()
+		fmt.Fprintf(&b, "%d %d obj\n%s\nendobj\n", i+1, gen(i), o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for i, off := range offs {
+		fmt.Fprintf(&b, "%010d %05d n \n", off, gen(i))
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 %d R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, gen(0), xref)
+	return b.Bytes()
+}
+
+// xrefStreamPDF is like testPDF with an xref stream instead of a table, as
+// cairo writes with PDF 1.5. Objects other than streams are compressed in an
+// object stream.
+func xrefStreamPDF(objs ...string) []byte {
+	b := bytes.Buffer{}
+	b.WriteString("%PDF-1.5\n")
+	objStm := len(objs) + 1
+	type entry struct{ typ, f2, f3 int }
+	entries := []entry{{0, 0, 0xffff}}
+	header, body := strings.Builder{}, strings.Builder{}
+	n := 0
+	for i, o := range objs {
+		if strings.Contains(o, "stream") {
+			entries = append(entries, entry{1, b.Len(), 0})
+			fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+			continue
+		}
+		entries = append(entries, entry{2, objStm, n})
+		fmt.Fprintf(&header, "%d %d ", i+1, body.Len())
+		body.WriteString(o + "\n")
+		n++
+	}
+	entries = append(entries, entry{1, b.Len(), 0})
+	fmt.Fprintf(&b, "%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Length %d >>\nstream\n%s%s\nendstream\nendobj\n",
+		objStm, n, header.Len(), header.Len()+body.Len(), header.String(), body.String())
+
+	// Rows of 1, 2 and 2 bytes with the PNG up predictor
+	entries = append(entries, entry{1, b.Len(), 0})
+	rows := bytes.Buffer{}
+	prev := make([]byte, 5)
+	for _, e := range entries {
+		row := []byte{byte(e.typ), byte(e.f2 >> 8), byte(e.f2), byte(e.f3 >> 8), byte(e.f3)}
+		rows.WriteByte(2)
+		for i := range row {
+			rows.WriteByte(row[i] - prev[i])
+		}
+		prev = row
+	}
+	data := bytes.Buffer{}
+	z := zlib.NewWriter(&data)
+	z.Write(rows.Bytes())
+	z.Close()
+	xref := b.Len()
+	fmt.Fprintf(&b, "%d 0 obj\n<< /Type /XRef /Size %d /W [ 1 2 2 ] /Root 1 0 R "+
+		"/Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 5 >> /Length %d >>\nstream\n",
+		len(entries)-1, len(entries), data.Len())
+	b.Write(data.Bytes())
+	fmt.Fprintf(&b, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+	return b.Bytes()
+}
+
+// onePage are the objects of a PDF with a single 600x400 points page, as
+// inkscape exports an SVG 800x533.33 pixels in size
+var onePage = []string{
+	"<< /Type /Catalog /Pages 2 0 R >>",
+	"<< /Type /Pages /Kids [ 3 0 R ] /Count 1 >>",
+	"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Contents 4 0 R >>",
+	"<< /Length 8 >>\nstream\n0 0 m S\n\nendstream",
+}
+
+// pagePDF returns a PDF like onePage whose page has the given entries instead
+// of its media box, e.g. a /MediaBox and /Rotate of its own
+func pagePDF(entries string) []byte {
+	return testPDF(onePage[0], onePage[1], "<< /Type /Page /Parent 2 0 R "+entries+" /Contents 4 0 R >>", onePage[3])
+}
+
+// addLinks adds the links to a copy of the PDF and checks the result can be
+// read back
+func addLinks(t *testing.T, pdf []byte, objects map[string]*PositionedObject, links []*PositionedLink, opts *Options) *memFile {
+	t.Helper()
+	f := newMemFile(pdf)
+	if err := AddLinksToPDF(f, objects, links, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPDF(f, objects, links, opts); err != nil {
+		t.Fatalf("generated PDF is broken: %s", err)
+	}
+	return f
+}
+
+// readAnnots returns the link annotations on the given page of the PDF
+func readAnnots(t *testing.T, f io.ReadSeeker, page int) []*PDFLinkAnnot {
+	t.Helper()
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annots, err := pdf.ReadLinkAnnots(f, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return annots
+}
+
+// annotDicts returns the annotation dictionaries on the given page of the PDF,
+// along with the PDF to read what they refer to
+func annotDicts(t *testing.T, f io.ReadSeeker, page int) (*PDFFile, []map[PDFName]interface{}) {
+	t.Helper()
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ParsePDFValue(pdf.Kids[page].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = resolvePDFValue(f, pdf.Xref, v.(map[PDFName]interface{})["Annots"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var annots []map[PDFName]interface{}
+	for _, a := range v.([]interface{}) {
+		if a, err = resolvePDFValue(f, pdf.Xref, a); err != nil {
+			t.Fatal(err)
+		}
+		d, ok := a.(map[PDFName]interface{})
+		if !ok {
+			t.Fatalf("annotation %v is not a dictionary", a)
+		}
+		annots = append(annots, d)
+	}
+	return pdf, annots
+}
+
+func TestReadPDFObjLarge(t *testing.T) {
+	dict := "<< /Type /Page " + strings.Repeat("/Pad (0123456789) ", 400) + "/MediaBox [ 0 0 612 792 ] >>"
+	if len(dict) <= 4096 {
+		t.Fatalf("page object is only %d bytes", len(dict))
+	}
+	body, err := readPDFObj(strings.NewReader("3 0 obj\n" + dict + "\nendobj\n4 0 obj\n<< >>\nendobj\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != dict {
+		t.Fatalf("got a %d byte object, want %d bytes", len(body), len(dict))
+	}
+	page, err := UnmarshalPDFPage(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Width != 612 || page.Height != 792 {
+		t.Errorf("got a %gx%g page, want 612x792", page.Width, page.Height)
+	}
+}
+
+func TestNamedDestsSpecialIDs(t *testing.T) {
+	ids := []string{"my target", "café", "наш (1)"}
+	objects := map[string]*PositionedObject{}
+	var links []*PositionedLink
+	for i, id := range ids {
+		x := float64(i) * 100
+		objects[id] = &PositionedObject{ID: id, X: x, Y: 10, W: 50, H: 50}
+		links = append(links, &PositionedLink{URL: "#" + url.PathEscape(id), X: x, Y: 200, W: 50, H: 50, Valid: true})
+	}
+	f := addLinks(t, testPDF(onePage...), objects, links, &Options{NamedDests: true})
+	annots := readAnnots(t, f, 0)
+	if len(annots) != len(ids) {
+		t.Fatalf("got %d annotations, want %d", len(annots), len(ids))
+	}
+	for i, a := range annots {
+		// The name is resolved through the /Dests of the catalog
+		dest, ok := a.Dest.([]interface{})
+		if a.Action != "GoTo" || !ok || len(dest) != 6 || dest[1] != PDFName("FitR") {
+			t.Errorf("link to '%s' has no destination: %s", ids[i], a)
+			continue
+		}
+		if want := 75 * float64(i); dest[2] != want {
+			t.Errorf("link to '%s' goes to x %v, want %v", ids[i], dest[2], want)
+		}
+	}
+}
+
+// largePDF returns a PDF of n pages, each with a content stream of size bytes
+func largePDF(n, size int) []byte {
+	objs := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	var kids []string
+	content := strings.Repeat("0 0 m 1 1 l S\n", size/14)
+	for i := 0; i < n; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objs)+1))
+		objs = append(objs,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Contents %d 0 R >>", len(objs)+2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+	objs[1] = fmt.Sprintf("<< /Type /Pages /Kids [ %s ] /Count %d >>", strings.Join(kids, " "), n)
+	return testPDF(objs...)
+}
+
+func BenchmarkAddLinksToPDF(b *testing.B) {
+	pdf := largePDF(200, 64<<10)
+	objects := map[string]*PositionedObject{}
+	var links []*PositionedLink
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("o%d", i)
+		objects[id] = &PositionedObject{ID: id, X: float64(i), Y: 10, W: 50, H: 50}
+		links = append(links,
+			&PositionedLink{URL: "https://example.com/" + id, X: float64(i), Y: 100, W: 50, H: 20, Valid: true},
+			&PositionedLink{URL: "#" + id, X: float64(i), Y: 200, W: 50, H: 20, Valid: true})
+	}
+	b.SetBytes(int64(len(pdf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := AddLinksToPDF(newMemFile(pdf), objects, links, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalPDFFile(b *testing.B) {
+	pdf := largePDF(200, 64<<10)
+	b.SetBytes(int64(len(pdf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := UnmarshalPDFFile(bytes.NewReader(pdf)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNamedActions(t *testing.T) {
+	for name, want := range PDFNamedActions {
+		for _, href := range []string{"#action:" + name, "#action:" + strings.ToUpper(name)} {
+			l := &PositionedLink{URL: href, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+			annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+			if len(annots) != 1 || annots[0].Action != "Named" || annots[0].Dest != want {
+				t.Errorf("%s: got %v, want a /Named /%s action", href, annots, want)
+			}
+		}
+	}
+	var lerrs []*LinkError
+	opts := &Options{OnLinkError: func(lerr *LinkError) error {
+		lerrs = append(lerrs, lerr)
+		return nil
+	}}
+	l := &PositionedLink{URL: "#action:close", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+	if annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, opts), 0); len(annots) != 0 {
+		t.Errorf("unknown action was added as %v", annots)
+	}
+	if len(lerrs) != 1 || lerrs[0].Reason != "has unknown action 'close'" {
+		t.Errorf("got link errors %v, want the unknown action", lerrs)
+	}
+}
+
+func TestNonZeroGenerations(t *testing.T) {
+	pdf := testPDFGens([]int{1, 3, 2, 5},
+		"<< /Type /Catalog /Pages 2 3 R >>",
+		"<< /Type /Pages /Kids [ 3 2 R ] /Count 1 >>",
+		"<< /Type /Page /Parent 2 3 R /MediaBox [ 0 0 600 400 ] /Contents 4 5 R >>",
+		onePage[3])
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 100, Y: 100, W: 40, H: 40}}
+	links := []*PositionedLink{
+		{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#t", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	for _, reuse := range []bool{false, true} {
+		f := addLinks(t, pdf, objects, links, &Options{ReuseObjects: reuse})
+		doc, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := doc.Kids[0].OwnRef
+		if reuse && *page != (PDFObjRef{ID: 3, Gen: 2}) {
+			t.Errorf("reused page is %s, want 3 2 R", page)
+		}
+		if !reuse {
+			// The old page is freed with its generation bumped for a later
+			// reuse of its number
+			if e := doc.Xref.Entries[3]; !e.Free || e.Gen != 3 {
+				t.Errorf("old page has xref entry %+v, want free with generation 3", *e)
+			}
+			if page.ID == 3 || page.Gen != 0 {
+				t.Errorf("new page is %s, want a new object of generation 0", page)
+			}
+
+			// The free list runs from entry 0 through every free entry
+			// back to 0
+			var chain []int
+			seen := map[int]bool{}
+			for id := doc.Xref.Entries[0].Offset; id != 0 && !seen[int(id)]; id = doc.Xref.Entries[id].Offset {
+				seen[int(id)] = true
+				chain = append(chain, int(id))
+			}
+			var free []int
+			for id, e := range doc.Xref.Entries[1:] {
+				if e.Free {
+					free = append(free, id+1)
+				}
+			}
+			if e := doc.Xref.Entries[0]; !e.Free || e.Gen != PDFMaxGen || fmt.Sprint(chain) != fmt.Sprint(free) {
+				t.Errorf("free list from %+v is %v, want %v", *e, chain, free)
+			}
+		}
+		if _, err := doc.Xref.ReadObj(f, &PDFObjRef{ID: 4, Gen: 5}); err != nil {
+			t.Errorf("contents of the page are lost: %s", err)
+		}
+		annots := readAnnots(t, f, 0)
+		if len(annots) != 2 {
+			t.Fatalf("got %d annotations, want 2", len(annots))
+		}
+		if dest, ok := annots[1].Dest.([]interface{}); !ok || fmt.Sprint(dest[0]) != page.String() {
+			t.Errorf("internal link goes to %v, want page %s", annots[1].Dest, page)
+		}
+	}
+}
+
+func TestXrefStream(t *testing.T) {
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 100, Y: 100, W: 40, H: 40}}
+	links := []*PositionedLink{
+		{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#t", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	for _, reuse := range []bool{false, true} {
+		pdf := xrefStreamPDF(onePage...)
+		if _, err := UnmarshalPDFFile(bytes.NewReader(pdf)); err != nil {
+			t.Fatalf("cannot read the fixture: %s", err)
+		}
+		f := addLinks(t, pdf, objects, links, &Options{ReuseObjects: reuse})
+		doc, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Xref.StreamRef == nil {
+			t.Errorf("reuse %t: update has an xref table, want a stream as in the original", reuse)
+		}
+		annots := readAnnots(t, f, 0)
+		if len(annots) != 2 || annots[0].URI != "https://example.com/" || annots[1].Action != "GoTo" {
+			t.Errorf("reuse %t: got annotations %v, want both links", reuse, annots)
+		}
+	}
+}
+
+// threePages returns the objects of a PDF with three 600x400 points pages,
+// either all kids of the root of the page tree or with the first two under a
+// node of their own
+func threePages(nested bool) []string {
+	page := func(parent int) string {
+		return fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [ 0 0 600 400 ] /Contents 6 0 R >>", parent)
+	}
+	if !nested {
+		return []string{onePage[0], "<< /Type /Pages /Kids [ 3 0 R 4 0 R 5 0 R ] /Count 3 >>", page(2), page(2), page(2), onePage[3]}
+	}
+	return []string{
+		onePage[0],
+		"<< /Type /Pages /Kids [ 7 0 R 5 0 R ] /Count 3 >>",
+		page(7), page(7), page(2),
+		onePage[3],
+		"<< /Type /Pages /Parent 2 0 R /Kids [ 3 0 R 4 0 R ] /Count 2 >>",
+	}
+}
+
+func TestMultiplePages(t *testing.T) {
+	// The pages are side by side in the SVG, each 800x533.33 pixels
+	viewports := []*Viewport{{X: 0, Scale: 0.75}, {X: 800, Scale: 0.75}, {X: 1600, Scale: 0.75}}
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 900, Y: 100, W: 40, H: 40}}
+	links := []*PositionedLink{
+		{URL: "https://example.com/1", X: 100, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#t", X: 100, Y: 100, W: 50, H: 20, Valid: true},
+		{URL: "https://example.com/2", X: 900, Y: 10, W: 50, H: 20, Valid: true},
+	}
+	for _, nested := range []bool{false, true} {
+		for _, reuse := range []bool{false, true} {
+			name := fmt.Sprintf("nested %t, reuse %t", nested, reuse)
+			f := addLinks(t, testPDF(threePages(nested)...), objects, links, &Options{PageViewports: viewports, ReuseObjects: reuse})
+			doc, err := UnmarshalPDFFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(doc.Kids) != 3 {
+				t.Fatalf("%s: got %d pages, want 3", name, len(doc.Kids))
+			}
+
+			// Every page, whether it got links or not, must be a kid of
+			// the node its /Parent refers to
+			for i, page := range doc.Kids {
+				v, err := ParsePDFValue(page.Raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ref, _ := v.(map[PDFName]interface{})["Parent"].(*PDFObjRef)
+				if ref == nil {
+					t.Fatalf("%s: page %d has no /Parent", name, i)
+				}
+				s, err := doc.Xref.ReadObj(f, ref)
+				if err != nil {
+					t.Fatalf("%s: /Parent of page %d is gone: %s", name, i, err)
+				}
+				parent, err := UnmarshalPDFPages(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := false
+				for _, kid := range parent.KidRefs {
+					found = found || *kid == *page.OwnRef
+				}
+				if !found {
+					t.Errorf("%s: page %d (%s) is not in the /Kids of its /Parent %s", name, i, page.OwnRef, ref)
+				}
+			}
+
+			first, second := readAnnots(t, f, 0), readAnnots(t, f, 1)
+			if len(first) != 2 || first[0].URI != "https://example.com/1" {
+				t.Errorf("%s: got %v on the first page, want the first link and the internal one", name, first)
+			} else if dest, ok := first[1].Dest.([]interface{}); !ok || fmt.Sprint(dest[0]) != doc.Kids[1].OwnRef.String() {
+				t.Errorf("%s: internal link goes to %v, want the second page %s", name, first[1].Dest, doc.Kids[1].OwnRef)
+			}
+			if len(second) != 1 || second[0].URI != "https://example.com/2" {
+				t.Errorf("%s: got %v on the second page, want the second link", name, second)
+			}
+			if third := readAnnots(t, f, 2); len(third) != 0 {
+				t.Errorf("%s: got %v on the third page, want none", name, third)
+			}
+		}
+	}
+}
+
+func TestNamedDests(t *testing.T) {
+	objects := map[string]*PositionedObject{
+		"b": {ID: "b", X: 100, Y: 100, W: 40, H: 40},
+		"a": {ID: "a", X: 200, Y: 100, W: 40, H: 40},
+	}
+	var links []*PositionedLink
+	for i, id := range []string{"b", "a", "b", "b"} {
+		links = append(links, &PositionedLink{URL: "#" + id, X: float64(i) * 60, Y: 300, W: 50, H: 20, Valid: true})
+	}
+	f := addLinks(t, testPDF(onePage...), objects, links, &Options{NamedDests: true})
+	pdf, annots := annotDicts(t, f, 0)
+	if len(annots) != len(links) {
+		t.Fatalf("got %d annotations, want %d", len(annots), len(links))
+	}
+	for i, a := range annots {
+		action, _ := a["A"].(map[PDFName]interface{})
+		if action == nil {
+			// Shared by the links to the same target
+			v, err := resolvePDFValue(f, pdf.Xref, a["A"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			action, _ = v.(map[PDFName]interface{})
+		}
+		if want := links[i].URL[1:]; action["S"] != PDFName("GoTo") || action["D"] != want {
+			t.Errorf("link %d has action %v, want to go to the name '%s'", i, action, want)
+		}
+	}
+
+	// Each target is in the name tree once, in order
+	v, err := ParsePDFValue(pdf.Catalog.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := v.(map[PDFName]interface{})["Names"].(map[PDFName]interface{})
+	tree, err := resolvePDFValue(f, pdf.Xref, names["Dests"])
+	if err != nil {
+		t.Fatalf("catalog has no /Dests: %s", err)
+	}
+	entries, _ := tree.(map[PDFName]interface{})["Names"].([]interface{})
+	if len(entries) != 4 || entries[0] != "a" || entries[2] != "b" {
+		t.Fatalf("got name tree %v, want a and b", entries)
+	}
+	for i, id := range []string{"a", "b"} {
+		dest, _ := entries[2*i+1].([]interface{})
+		if len(dest) != 6 || fmt.Sprint(dest[0]) != pdf.Kids[0].OwnRef.String() || dest[1] != PDFName("FitR") ||
+			dest[2] != objects[id].X*0.75 {
+			t.Errorf("'%s' goes to %v", id, dest)
+		}
+	}
+}
+
+func TestDestFitModes(t *testing.T) {
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	o := &PositionedObject{ID: "t", X: 100, Y: 100, W: 40, H: 40}
+	for _, c := range []struct {
+		fit  string
+		want string
+	}{
+		{"", "[ 3 0 R /FitR 75.000000 295.000000 105.000000 325.000000 ]"},
+		{FitR, "[ 3 0 R /FitR 75.000000 295.000000 105.000000 325.000000 ]"},
+		{Fit, "[ 3 0 R /Fit ]"},
+		{FitB, "[ 3 0 R /FitB ]"},
+		// The top left corner of the target, keeping the zoom
+		{XYZ, "[ 3 0 R /XYZ 75.000000 325.000000 null ]"},
+	} {
+		page.Fit = c.fit
+		if got := page.dest(o); got != c.want {
+			t.Errorf("fit '%s': got %s, want %s", c.fit, got, c.want)
+		}
+	}
+}
+
+func TestURIEscaping(t *testing.T) {
+	u := `https://example.com/x?a=(1)&b=2\3`
+	l := &PositionedLink{URL: u, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+	if len(annots) != 1 || annots[0].URI != u {
+		t.Errorf("got %v, want a link to %s", annots, u)
+	}
+}
+
+func TestNonASCIIURI(t *testing.T) {
+	u := "https://café.example/путь?q=é"
+	want := "https://caf%C3%A9.example/%D0%BF%D1%83%D1%82%D1%8C?q=%C3%A9"
+	if got := asciiURI(u); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	l := &PositionedLink{URL: u, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+	if len(annots) != 1 || annots[0].URI != want {
+		t.Errorf("got %v, want a link to %s", annots, want)
+	}
+	if s := pdfTextString("Café, путь"); s != "<FEFF00430061006600E9002C0020043F04430442044C>" {
+		t.Errorf("got text string %s", s)
+	}
+}
+
+func TestAddLinksLargePage(t *testing.T) {
+	// Lots of resources on the page, with the media box well past the first
+	// 4096 bytes
+	pad := ""
+	for i := 0; i < 200; i++ {
+		pad += fmt.Sprintf("/F%d << /Type /Font /Subtype /Type1 /BaseFont /Helvetica >> ", i)
+	}
+	pdf := pagePDF("/Resources << /Font << " + pad + ">> >> /MediaBox [ 0 0 600 400 ]")
+	if len(pdf) < 2*4096 {
+		t.Fatalf("PDF is only %d bytes", len(pdf))
+	}
+	l := &PositionedLink{URL: "https://example.com/", X: 100, Y: 100, W: 200, H: 100, Valid: true}
+	f := addLinks(t, pdf, nil, []*PositionedLink{l}, nil)
+	doc, err := UnmarshalPDFFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := doc.Kids[0]; !strings.Contains(page.Raw, pad) || page.Width != 600 || page.Height != 400 {
+		t.Errorf("page was not read intact: %gx%g, %d bytes", page.Width, page.Height, len(page.Raw))
+	}
+	annots := readAnnots(t, f, 0)
+	if len(annots) != 1 || annots[0].Rect != [4]float64{75, 250, 225, 325} {
+		t.Errorf("got %v, want the link at [ 75 250 225 325 ]", annots)
+	}
+}
+
+// byteReader returns a byte per Read, as a pipe may return less than asked
+// for
+type byteReader struct {
+	r io.ReadSeeker
+}
+
+func (b *byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return b.r.Read(p[:1])
+}
+
+func (b *byteReader) Seek(off int64, whence int) (int64, error) {
+	return b.r.Seek(off, whence)
+}
+
+func TestReadOneByteAtATime(t *testing.T) {
+	body, err := readPDFObj(&byteReader{strings.NewReader("3 0 obj\n" + onePage[2] + "\nendobj\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != onePage[2] {
+		t.Errorf("got %q, want %q", body, onePage[2])
+	}
+	for _, pdf := range [][]byte{testPDF(onePage...), xrefStreamPDF(onePage...)} {
+		doc, err := UnmarshalPDFFile(&byteReader{bytes.NewReader(pdf)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(doc.Kids) != 1 || doc.Kids[0].Raw != onePage[2] {
+			t.Errorf("got pages %+v", doc.Kids)
+		}
+	}
+}
+
+func TestMediaBoxOrigin(t *testing.T) {
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 400, Y: 300, W: 40, H: 40}}
+	links := []*PositionedLink{
+		{URL: "https://example.com/", X: 100, Y: 100, W: 200, H: 100, Valid: true},
+		{URL: "#t", X: 0, Y: 0, W: 20, H: 20, Valid: true},
+	}
+	// Inkscape exports the drawing area alone with the origin where the
+	// drawing starts, and the corners may come in any order
+	for _, box := range []string{"[ 10 20 610 420 ]", "[ 610 420 10 20 ]", "[ 10.0 20.0 610.0 420.0 ]"} {
+		f := addLinks(t, pagePDF("/MediaBox "+box), objects, links, nil)
+		annots := readAnnots(t, f, 0)
+		if len(annots) != 2 {
+			t.Fatalf("%s: got %d annotations, want 2", box, len(annots))
+		}
+		if want := [4]float64{85, 270, 235, 345}; annots[0].Rect != want {
+			t.Errorf("%s: link is at %v, want %v", box, annots[0].Rect, want)
+		}
+		if want := [4]float64{10, 405, 25, 420}; annots[1].Rect != want {
+			t.Errorf("%s: link is at %v, want %v", box, annots[1].Rect, want)
+		}
+		dest, _ := annots[1].Dest.([]interface{})
+		if len(dest) != 6 || dest[2] != 310.0 || dest[3] != 165.0 || dest[4] != 340.0 || dest[5] != 195.0 {
+			t.Errorf("%s: internal link goes to %v, want [ 310 165 340 195 ]", box, dest)
+		}
+	}
+}
+
+func TestInheritedPageAttributes(t *testing.T) {
+	pdf := testPDF(
+		onePage[0],
+		"<< /Type /Pages /Kids [ 3 0 R 6 0 R ] /Count 3 /MediaBox [ 0 0 600 400 ] /Rotate 90 >>",
+		"<< /Type /Pages /Parent 2 0 R /Kids [ 4 0 R 5 0 R ] /Count 2 /Rotate 180 >>",
+		"<< /Type /Page /Parent 3 0 R >>",
+		"<< /Type /Page /Parent 3 0 R /MediaBox [ 0 0 300 200 ] /Rotate 0 >>",
+		"<< /Type /Page /Parent 2 0 R >>",
+	)
+	doc, err := UnmarshalPDFFile(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		w, h   float64
+		rotate int
+	}{{600, 400, 180}, {300, 200, 0}, {600, 400, 90}}
+	if len(doc.Kids) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(doc.Kids), len(want))
+	}
+	for i, p := range doc.Kids {
+		if p.Width != want[i].w || p.Height != want[i].h || p.Rotate != want[i].rotate {
+			t.Errorf("page %d is %gx%g turned %d, want %gx%g turned %d", i, p.Width, p.Height, p.Rotate, want[i].w, want[i].h, want[i].rotate)
+		}
+	}
+}
+
+func TestGoToR(t *testing.T) {
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	for _, c := range []struct {
+		url  string
+		want string
+	}{
+		// Remote pages are zero based page numbers rather than references
+		{"file:other.pdf#page=3", "<< /S /GoToR /F (other.pdf) /D [ 2 /Fit ] >>"},
+		{"file:other.pdf", "<< /S /GoToR /F (other.pdf) /D [ 0 /Fit ] >>"},
+		{"file:///docs/other.PDF#page=1", "<< /S /GoToR /F (/docs/other.PDF) /D [ 0 /Fit ] >>"},
+	} {
+		l := &PositionedLink{URL: c.url, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		got, lerr := page.linkAction(l)
+		if lerr != nil || got != c.want {
+			t.Errorf("%s: got %s (%v), want %s", c.url, got, lerr, c.want)
+		}
+	}
+
+	l := &PositionedLink{URL: "file:other.pdf#page=3", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+	if len(annots) != 1 || annots[0].Action != "GoToR" || annots[0].URI != "other.pdf" {
+		t.Errorf("got %v, want a /GoToR to other.pdf", annots)
+	}
+}
+
+func TestGoToE(t *testing.T) {
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	for _, c := range []struct {
+		url  string
+		want string
+	}{
+		// The target is the attachment named in the PDF itself
+		{"embedded:attachment.pdf#page=1", "<< /S /GoToE /D [ 0 /Fit ] /T << /R /C /N (attachment.pdf) >> >>"},
+		{"embedded:attachment.pdf#page=4", "<< /S /GoToE /D [ 3 /Fit ] /T << /R /C /N (attachment.pdf) >> >>"},
+		{"embedded:attachment.pdf", "<< /S /GoToE /D [ 0 /Fit ] /T << /R /C /N (attachment.pdf) >> >>"},
+		{"embedded:attachment.pdf#intro", "<< /S /GoToE /D (intro) /T << /R /C /N (attachment.pdf) >> >>"},
+	} {
+		l := &PositionedLink{URL: c.url, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		got, lerr := page.linkAction(l)
+		if lerr != nil || got != c.want {
+			t.Errorf("%s: got %s (%v), want %s", c.url, got, lerr, c.want)
+		}
+	}
+
+	// Only attached PDFs with valid destinations can be gone to
+	for _, url := range []string{"embedded:notes.txt", "embedded:attachment.pdf#page=0", "embedded:attachment.pdf#page=x"} {
+		l := &PositionedLink{URL: url, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		if got, lerr := page.linkAction(l); lerr == nil || lerr.Reason != "is not a valid link to an attached PDF" {
+			t.Errorf("%s: got %s (%v), want it rejected", url, got, lerr)
+		}
+	}
+
+	for _, newWindow := range []bool{false, true} {
+		l := &PositionedLink{URL: "embedded:attachment.pdf#page=1", NewWindow: newWindow, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		f := addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil)
+		pdf, annots := annotDicts(t, f, 0)
+		if len(annots) != 1 {
+			t.Fatalf("got %d annotations, want 1", len(annots))
+		}
+		v, err := resolvePDFValue(f, pdf.Xref, annots[0]["A"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		action, _ := v.(map[PDFName]interface{})
+		target, _ := action["T"].(map[PDFName]interface{})
+		if action["S"] != PDFName("GoToE") || !pdfValuesMatch(action["D"], []interface{}{0.0, PDFName("Fit")}) ||
+			target["R"] != PDFName("C") || target["N"] != "attachment.pdf" {
+			t.Errorf("got action %v, want a /GoToE to page 1 of the child attachment.pdf", action)
+		}
+		if got := action["NewWindow"] == PDFKeyword("true"); got != newWindow {
+			t.Errorf("got action %v, want new window %t", action, newWindow)
+		}
+
+		annot := readAnnots(t, f, 0)
+		if len(annot) != 1 || annot[0].Action != "GoToE" || annot[0].URI != "attachment.pdf" || annot[0].NewWindow != newWindow {
+			t.Errorf("got %v, want a /GoToE to attachment.pdf with new window %t", annot, newWindow)
+		}
+	}
+}
+
+func TestSharedActions(t *testing.T) {
+	urls := []string{"https://a.example/", "https://b.example/", "https://c.example/"}
+	var links []*PositionedLink
+	for i := 0; i < 10; i++ {
+		links = append(links, &PositionedLink{URL: urls[i%len(urls)], X: 10, Y: float64(10 + 30*i), W: 50, H: 20, Valid: true})
+	}
+	f := addLinks(t, testPDF(onePage...), nil, links, nil)
+	if n := len(regexp.MustCompile(`\d+ \d+ obj\n<< /S /URI `).FindAll(f.b, -1)); n != 3 {
+		t.Errorf("got %d action objects, want 3", n)
+	}
+	if n := len(regexp.MustCompile(`/A \d+ \d+ R`).FindAll(f.b, -1)); n != 10 {
+		t.Errorf("got %d annotations referring to an action, want 10", n)
+	}
+	annots := readAnnots(t, f, 0)
+	if len(annots) != 10 {
+		t.Fatalf("got %d annotations, want 10", len(annots))
+	}
+	for i, a := range annots {
+		if a.Action != "URI" || a.URI != urls[i%len(urls)] {
+			t.Errorf("annotation %d goes to %s %s, want %s", i, a.Action, a.URI, urls[i%len(urls)])
+		}
+	}
+}
+
+func TestTagged(t *testing.T) {
+	links := []*PositionedLink{
+		{URL: "https://example.com/", Title: "Example", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "https://example.org/", X: 10, Y: 40, W: 50, H: 20, Valid: true},
+	}
+	opts := &Options{Tagged: true}
+	for _, c := range []struct {
+		catalog  string
+		markInfo string
+	}{
+		// The content isn't tagged, so only a PDF that already says it is
+		// is marked
+		{onePage[0], "<nil>"},
+		{"<< /Type /Catalog /Pages 2 0 R /MarkInfo << /Marked true >> >>", "map[/Marked:true]"},
+	} {
+		f := addLinks(t, testPDF(append([]string{c.catalog}, onePage[1:]...)...), nil, links, opts)
+		pdf, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ParsePDFValue(pdf.Catalog.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		catalog := v.(map[PDFName]interface{})
+		if m := fmt.Sprint(catalog["MarkInfo"]); m != c.markInfo {
+			t.Errorf("catalog has /MarkInfo %s, want %s", m, c.markInfo)
+		}
+		v, err = resolvePDFValue(f, pdf.Xref, catalog["StructTreeRoot"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, ok := v.(map[PDFName]interface{})
+		if !ok || root["Type"] != PDFName("StructTreeRoot") {
+			t.Fatalf("catalog has /StructTreeRoot %v", v)
+		}
+		nums := root["ParentTree"].(map[PDFName]interface{})["Nums"].([]interface{})
+		parents := map[string]string{}
+		for j := 0; j+1 < len(nums); j += 2 {
+			parents[fmt.Sprint(nums[j])] = fmt.Sprint(nums[j+1])
+		}
+
+		// Each annotation on the page is the object of a /Link element
+		page, err := ParsePDFValue(pdf.Kids[0].Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs := page.(map[PDFName]interface{})["Annots"].([]interface{})
+		elems := root["K"].([]interface{})
+		if len(refs) != len(links) || len(elems) != len(links) {
+			t.Fatalf("got %d annotations and %d elements, want %d", len(refs), len(elems), len(links))
+		}
+		for i, ref := range refs {
+			annot, err := resolvePDFValue(f, pdf.Xref, ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := resolvePDFValue(f, pdf.Xref, elems[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			elem := e.(map[PDFName]interface{})
+			objr := elem["K"].(map[PDFName]interface{})
+			if elem["S"] != PDFName("Link") || objr["Type"] != PDFName("OBJR") || fmt.Sprint(objr["Obj"]) != fmt.Sprint(ref) {
+				t.Errorf("element %d is %v, want a /Link of annotation %s", i, elem, ref)
+			}
+			key := fmt.Sprint(annot.(map[PDFName]interface{})["StructParent"])
+			if parents[key] != fmt.Sprint(elems[i]) {
+				t.Errorf("parent tree %v maps /StructParent %s to %s, want %s", nums, key, parents[key], elems[i])
+			}
+			if want := []string{"Example", "https://example.org/"}[i]; elem["Alt"] != want {
+				t.Errorf("element %d has /Alt %v, want %s", i, elem["Alt"], want)
+			}
+		}
+	}
+
+	// An annotation whose action cannot be built is never half written
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	page.Links = []*PositionedLink{{URL: "#action:close", X: 10, Y: 10, W: 50, H: 20, Valid: true}}
+	b := bytes.Buffer{}
+	n, err := (&PDFAnnot{OwnRef: &PDFObjRef{ID: 5}, Page: page}).Marshal(&b)
+	if _, ok := err.(*LinkError); !ok || n != 0 || b.Len() != 0 {
+		t.Errorf("broken annotation wrote %q (%d) with error %v", b.String(), n, err)
+	}
+
+	tree := "<< /Type /Catalog /Pages 2 0 R /StructTreeRoot 5 0 R >>"
+	err = AddLinksToPDF(newMemFile(testPDF(append([]string{tree}, onePage[1:]...)...)), nil, links, opts)
+	if err == nil || !strings.Contains(err.Error(), "already has a structure tree") {
+		t.Errorf("got %v, want an error for the existing structure tree", err)
+	}
+}
+
+func TestExistingAnnots(t *testing.T) {
+	widget := "<< /Type /Annot /Subtype /Widget /Rect [ 0 0 20 20 ] >>"
+	for _, c := range []struct {
+		name   string
+		pdf    []byte
+		before []PDFName
+	}{
+		{"inline", testPDF(onePage[0], onePage[1],
+			"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Annots [ 5 0 R << /Type /Annot /Subtype /Text /Rect [ 0 0 10 10 ] >> ] /Contents 4 0 R >>",
+			onePage[3], widget), []PDFName{"Widget", "Text"}},
+		{"indirect", testPDF(onePage[0], onePage[1],
+			"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Annots 6 0 R /Contents 4 0 R >>",
+			onePage[3], widget, "[ 5 0 R ]"), []PDFName{"Widget"}},
+	} {
+		l := &PositionedLink{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		pdf, annots := annotDicts(t, addLinks(t, c.pdf, nil, []*PositionedLink{l}, nil), 0)
+		if n := strings.Count(pdf.Kids[0].Raw, "/Annots"); n != 1 {
+			t.Errorf("%s: page has %d /Annots entries:\n%s", c.name, n, pdf.Kids[0].Raw)
+		}
+		want := append(c.before, "Link")
+		if len(annots) != len(want) {
+			t.Fatalf("%s: got %d annotations, want %d", c.name, len(annots), len(want))
+		}
+		for i, a := range annots {
+			if a["Subtype"] != want[i] {
+				t.Errorf("%s: annotation %d is a %v, want %s", c.name, i, a["Subtype"], want[i])
+			}
+		}
+	}
+}
+
+func TestPageEndingInNestedDict(t *testing.T) {
+	for _, page := range []string{
+		"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Contents 4 0 R /Resources << /Font << /F1 << /Type /Font >> >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Contents 4 0 R /Resources << /ExtGState << >> >> >>   \n",
+	} {
+		l := &PositionedLink{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		f := addLinks(t, testPDF(onePage[0], onePage[1], page, onePage[3]), nil, []*PositionedLink{l}, nil)
+		pdf, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ParsePDFValue(pdf.Kids[0].Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := v.(map[PDFName]interface{})
+		// The links are an entry of the page, not of its resources
+		if _, ok := d["Annots"]; !ok {
+			t.Errorf("page has no /Annots:\n%s", pdf.Kids[0].Raw)
+		}
+		if r := d["Resources"].(map[PDFName]interface{}); len(r) != 1 {
+			t.Errorf("resources became %v", r)
+		}
+		if annots := readAnnots(t, f, 0); len(annots) != 1 {
+			t.Errorf("got annotations %v, want the link", annots)
+		}
+	}
+}
+
+func TestFreeMaxGen(t *testing.T) {
+	x := &PDFXref{Entries: []*PDFXrefEntry{{Gen: PDFMaxGen, Free: true}, {Gen: PDFMaxGen - 1}, {Gen: PDFMaxGen}}}
+	x.Free(1)
+	x.Free(2)
+	for id, e := range x.Entries[1:] {
+		if !e.Free || e.Gen != PDFMaxGen {
+			t.Errorf("object %d has xref entry %+v, want free with generation %d", id+1, *e, PDFMaxGen)
+		}
+	}
+}
+
+func TestReuseObjectsTwice(t *testing.T) {
+	links := []*PositionedLink{{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}}
+	for _, reuse := range []bool{false, true} {
+		f := newMemFile(testPDF(onePage...))
+		var sizes []int
+		for pass := 0; pass < 2; pass++ {
+			if err := AddLinksToPDF(f, nil, links, &Options{ReuseObjects: reuse}); err != nil {
+				t.Fatal(err)
+			}
+			doc, err := UnmarshalPDFFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, doc.Xref.Trailer.Size)
+			if annots := readAnnots(t, f, 0); len(annots) != pass+1 {
+				t.Errorf("reuse %t, pass %d: got %d annotations, want %d", reuse, pass, len(annots), pass+1)
+			}
+		}
+		if grew := sizes[1] > sizes[0]; grew == reuse {
+			t.Errorf("reuse %t: object count went from %d to %d", reuse, sizes[0], sizes[1])
+		}
+	}
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+	orig := testPDF(onePage...)
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 100, Y: 100, W: 40, H: 40}}
+	links := []*PositionedLink{
+		{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#t", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	f := addLinks(t, orig, objects, links, &Options{ReuseObjects: true})
+
+	// The original is left as it is and the update follows it
+	if !bytes.HasPrefix(f.b, orig) {
+		t.Fatal("original PDF was changed")
+	}
+	update := string(f.b[len(orig):])
+	startxref := regexp.MustCompile(`startxref\s+(\d+)`)
+	origXref := startxref.FindStringSubmatch(string(orig))[1]
+	m := regexp.MustCompile(`(?s)\nxref\n(.*)trailer\s*(<<.*>>)\s*startxref\s+(\d+)\s*%%EOF$`).FindStringSubmatch(update)
+	if m == nil {
+		t.Fatalf("update doesn't end in an xref section:\n%s", update)
+	}
+	if off, _ := strconv.Atoi(m[3]); !strings.HasPrefix(string(f.b[off:]), "xref\n") {
+		t.Errorf("startxref %d doesn't point at the update's xref", off)
+	}
+
+	// Its xref only holds the page and catalog that changed
+	var ids []int
+	lines := strings.Split(strings.TrimSuffix(m[1], "\n"), "\n")
+	for i := 0; i < len(lines); {
+		var start, n int
+		if _, err := fmt.Sscanf(lines[i], "%d %d", &start, &n); err != nil || i+1+n > len(lines) {
+			t.Fatalf("bad xref subsection header %q", lines[i])
+		}
+		for j := 0; j < n; j++ {
+			if len(lines[i+1+j]) != 19 {
+				t.Errorf("xref entry %q isn't 20 bytes long", lines[i+1+j])
+			}
+			ids = append(ids, start+j)
+		}
+		i += 1 + n
+	}
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Errorf("update has xref entries for %v, want the catalog and the page", ids)
+	}
+	trailer, err := UnmarshalPDFXrefTrailer(m[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(trailer.Prev) != origXref || trailer.Size != len(onePage)+1 {
+		t.Errorf("trailer %s has /Prev %d and /Size %d, want %s and %d", m[2], trailer.Prev, trailer.Size, origXref, len(onePage)+1)
+	}
+}
+
+func TestTrailerPrev(t *testing.T) {
+	// An earlier /Prev is replaced
+	for _, raw := range []string{"<< /Size 5 /Root 1 0 R >>", "<< /Size 5 /Root 1 0 R /Prev 100 >>"} {
+		b := strings.Builder{}
+		tr := &PDFXrefTrailer{Size: 7, Root: &PDFObjRef{ID: 6}, Raw: raw, Prev: 300}
+		if _, err := tr.Marshal(&b); err != nil {
+			t.Fatal(err)
+		}
+		got := b.String()
+		v, err := ParsePDFValue(strings.TrimPrefix(got, "trailer\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := v.(map[PDFName]interface{})
+		if strings.Count(got, "/Prev") != 1 || d["Prev"] != 300.0 || d["Size"] != 7.0 || fmt.Sprint(d["Root"]) != "6 0 R" {
+			t.Errorf("%s: got %q, want /Size 7, /Root 6 0 R and /Prev 300", raw, got)
+		}
+	}
+
+	// Each update points back to the one before
+	links := []*PositionedLink{{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}}
+	f := newMemFile(testPDF(onePage...))
+	var xrefs []int64
+	for pass := 0; pass < 3; pass++ {
+		doc, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xrefs = append(xrefs, doc.Xref.OwnOffset)
+		if pass > 0 && doc.Xref.Trailer.Prev != xrefs[pass-1] {
+			t.Errorf("update %d has /Prev %d, want %d", pass, doc.Xref.Trailer.Prev, xrefs[pass-1])
+		}
+		if err := AddLinksToPDF(f, nil, links, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// linearizedPDF returns a PDF like onePage that is linearized, with its
+// linearization dictionary (object 5) first and a hint stream (object 6)
+func linearizedPDF() []byte {
+	bodies := map[int]string{
+		1: onePage[0], 2: onePage[1], 3: onePage[2], 4: onePage[3],
+		6: "<< /Length 4 >>\nstream\nhint\nendstream",
+	}
+	var pdf []byte
+	l, h := 0, [2]int{}
+	for pass := 0; pass < 2; pass++ {
+		// Numbers are zero padded so the offsets of the first pass hold
+		bodies[5] = fmt.Sprintf("<< /Linearized 1 /L %06d /H [ %06d %06d ] /O 3 /E 0 /N 1 /T 0 >>", l, h[0], h[1])
+		b := bytes.Buffer{}
+		b.WriteString("%PDF-1.4\n")
+		offs := map[int]int{}
+		for _, id := range []int{5, 1, 2, 3, 4, 6} {
+			offs[id] = b.Len()
+			fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", id, bodies[id])
+		}
+		h = [2]int{offs[6], b.Len() - offs[6]}
+		xref := b.Len()
+		b.WriteString("xref\n0 7\n0000000000 65535 f \n")
+		for id := 1; id <= 6; id++ {
+			fmt.Fprintf(&b, "%010d 00000 n \n", offs[id])
+		}
+		fmt.Fprintf(&b, "trailer\n<< /Size 7 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+		pdf, l = b.Bytes(), b.Len()
+	}
+	return pdf
+}
+
+func TestLinearized(t *testing.T) {
+	pdf := linearizedPDF()
+	if lin, err := IsLinearized(bytes.NewReader(pdf)); err != nil || !lin {
+		t.Fatalf("fixture isn't linearized (%v)", err)
+	}
+	links := []*PositionedLink{{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}}
+	for _, delinearize := range []bool{false, true} {
+		f := addLinks(t, pdf, nil, links, &Options{Delinearize: delinearize})
+		if annots := readAnnots(t, f, 0); len(annots) != 1 {
+			t.Errorf("delinearize %t: got annotations %v, want the link", delinearize, annots)
+		}
+		if lin, err := IsLinearized(f); err != nil || lin == delinearize {
+			t.Errorf("delinearize %t: PDF is linearized %t (%v)", delinearize, lin, err)
+		}
+		if len(f.b) < len(pdf) {
+			t.Fatalf("delinearize %t: PDF shrank", delinearize)
+		}
+		// Only the linearization dictionary changes in place, keeping every
+		// offset
+		if delinearize {
+			doc, err := UnmarshalPDFFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !doc.Xref.Entries[5].Free || !doc.Xref.Entries[6].Free {
+				t.Errorf("linearization dictionary and hint stream aren't freed: %+v %+v", *doc.Xref.Entries[5], *doc.Xref.Entries[6])
+			}
+			if d := bytes.IndexByte(f.b, '>'); !bytes.Equal(f.b[d:len(pdf)], pdf[d:]) {
+				t.Error("more than the linearization dictionary was changed")
+			}
+		} else if !bytes.Equal(f.b[:len(pdf)], pdf) {
+			t.Error("original PDF was changed")
+		}
+	}
+}
+
+func TestFitMargin(t *testing.T) {
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	for _, c := range []struct {
+		margin string
+		target PositionedObject
+		want   string
+	}{
+		{"10", PositionedObject{X: 100, Y: 100, W: 40, H: 40}, "[ 3 0 R /FitR 65.000000 285.000000 115.000000 335.000000 ]"},
+		{"10pt", PositionedObject{X: 100, Y: 100, W: 40, H: 40}, "[ 3 0 R /FitR 65.000000 285.000000 115.000000 335.000000 ]"},
+		// Half of the 30pt square on each side
+		{"50%", PositionedObject{X: 100, Y: 100, W: 40, H: 40}, "[ 3 0 R /FitR 60.000000 280.000000 120.000000 340.000000 ]"},
+		// Clamped to the top left corner of the 600x400 page
+		{"10", PositionedObject{X: 0, Y: 0, W: 40, H: 40}, "[ 3 0 R /FitR 0.000000 360.000000 40.000000 400.000000 ]"},
+		// and the bottom right
+		{"10", PositionedObject{X: 760, Y: 493.333333, W: 40, H: 40}, "[ 3 0 R /FitR 560.000000 0.000000 600.000000 40.000000 ]"},
+	} {
+		m, err := ParseMargin(c.margin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.FitMargin = m
+		if got := page.dest(&c.target); got != c.want {
+			t.Errorf("margin %s around %+v: got %s, want %s", c.margin, c.target, got, c.want)
+		}
+	}
+	for _, s := range []string{"-1", "abc", "10%%", ""} {
+		if _, err := ParseMargin(s); err == nil {
+			t.Errorf("margin '%s' was accepted", s)
+		}
+	}
+}
+
+func TestOffPageLinks(t *testing.T) {
+	var warnings []string
+	opts := &Options{Warnf: func(format string, v ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}}
+	links := []*PositionedLink{
+		// Bleeding off the top left corner of the 800x533.33 px page
+		{URL: "https://example.com/bleed", X: -40, Y: -40, W: 80, H: 80, Valid: true},
+		// Entirely right of it
+		{URL: "https://example.com/off", X: 900, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, links, opts), 0)
+	if len(annots) != 1 || annots[0].URI != "https://example.com/bleed" {
+		t.Fatalf("got annotations %v, want only the one bleeding off the page", annots)
+	}
+	if want := [4]float64{0, 370, 30, 400}; annots[0].Rect != want {
+		t.Errorf("link is at %v, want it clamped to %v", annots[0].Rect, want)
+	}
+	if len(warnings) != 1 || warnings[0] != "link 'https://example.com/off' is entirely outside the page - leaving it out" {
+		t.Errorf("got warnings %q, want the link off the page", warnings)
+	}
+}
+
+func TestRotatedPages(t *testing.T) {
+	// 30 to 120 pt across and 60 to 90 pt down the page as it's shown
+	l := &PositionedLink{URL: "https://example.com/", X: 40, Y: 80, W: 120, H: 40, Valid: true}
+	for rotate, want := range map[int][4]float64{
+		0:   {30, 310, 120, 340},
+		90:  {60, 30, 90, 120},
+		180: {480, 60, 570, 90},
+		270: {510, 280, 540, 370},
+		-90: {510, 280, 540, 370},
+		450: {60, 30, 90, 120},
+	} {
+		pdf := pagePDF(fmt.Sprintf("/MediaBox [ 0 0 600 400 ] /Rotate %d", rotate))
+		annots := readAnnots(t, addLinks(t, pdf, nil, []*PositionedLink{l}, nil), 0)
+		if len(annots) != 1 || annots[0].Rect != want {
+			t.Errorf("rotate %d: got annotations %v, want one at %v", rotate, annots, want)
+		}
+	}
+}
+
+func TestNewWindow(t *testing.T) {
+	for _, c := range []struct {
+		url, action, uri string
+		newWindow        bool
+	}{
+		// Only actions opening files can ask for a new window
+		{"file:notes.txt", "Launch", "notes.txt", true},
+		{"file:other.pdf#page=2", "GoToR", "other.pdf", true},
+		{"embedded:attachment.pdf#page=1", "GoToE", "attachment.pdf", true},
+		{"https://example.com/", "URI", "https://example.com/", false},
+	} {
+		l := &PositionedLink{URL: c.url, NewWindow: true, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+		if len(annots) != 1 || annots[0].Action != c.action || annots[0].URI != c.uri || annots[0].NewWindow != c.newWindow {
+			t.Errorf("%s: got %v, want a /%s to %s with new window %t", c.url, annots, c.action, c.uri, c.newWindow)
+		}
+
+		// and without target="_blank" it opens where the viewer likes
+		l.NewWindow = false
+		annots = readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+		if len(annots) != 1 || annots[0].NewWindow {
+			t.Errorf("%s: got %v, want no new window", c.url, annots)
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	viewports := []*Viewport{{X: 0, Scale: 0.75}, {X: 800, Scale: 0.75}, {X: 1600, Scale: 0.75}}
+	for _, nested := range []bool{false, true} {
+		links := []*PositionedLink{
+			{URL: "#page=2", X: 100, Y: 10, W: 50, H: 20, Valid: true},
+			{URL: "#page=3", X: 900, Y: 10, W: 50, H: 20, Valid: true},
+		}
+		f := addLinks(t, testPDF(threePages(nested)...), nil, links, &Options{PageViewports: viewports})
+		doc, err := UnmarshalPDFFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, page := range []int{1, 2} {
+			annots := readAnnots(t, f, i)
+			want := []interface{}{doc.Kids[page].OwnRef, PDFName("Fit")}
+			if len(annots) != 1 || annots[0].Action != "GoTo" || !pdfValuesMatch(annots[0].Dest, want) {
+				t.Errorf("nested %t, %s: got %v, want a /GoTo to the whole of page %d", nested, links[i].URL, annots, page+1)
+			}
+		}
+	}
+
+	for _, c := range []struct{ url, reason string }{
+		{"#page=0", "has invalid page number"},
+		{"#page=-1", "has invalid page number"},
+		{"#page=two", "has invalid page number"},
+		{"#page=", "has invalid page number"},
+		{"#page=4", "points to page 4 but the PDF has 3"},
+	} {
+		var lerrs []*LinkError
+		opts := &Options{PageViewports: viewports, OnLinkError: func(lerr *LinkError) error {
+			lerrs = append(lerrs, lerr)
+			return nil
+		}}
+		l := &PositionedLink{URL: c.url, X: 100, Y: 10, W: 50, H: 20, Valid: true}
+		if annots := readAnnots(t, addLinks(t, testPDF(threePages(false)...), nil, []*PositionedLink{l}, opts), 0); len(annots) != 0 {
+			t.Errorf("%s: was added as %v", c.url, annots)
+		}
+		if len(lerrs) != 1 || lerrs[0].Reason != c.reason {
+			t.Errorf("%s: got link errors %v, want '%s'", c.url, lerrs, c.reason)
+		}
+	}
+}
+
+func TestEntityLinks(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg">
+<a id="a1" href="https://example.com/?a=1&amp;b=2"/>
+<a id="a2" href="&#35;foo"/>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := map[string]*PositionedObject{"foo": {ID: "foo", X: 100, Y: 100, W: 40, H: 40}}
+	for i, l := range links {
+		l.X, l.Y, l.W, l.H, l.Valid = 10, 10+float64(i)*30, 50, 20, true
+	}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), objects, links, nil), 0)
+	if len(annots) != 2 {
+		t.Fatalf("got %d annotations, want 2", len(annots))
+	}
+	if a := annots[0]; a.Action != "URI" || a.URI != "https://example.com/?a=1&b=2" {
+		t.Errorf("got %v, want a /URI with a plain &", a)
+	}
+	if a := annots[1]; a.Action != "GoTo" {
+		t.Errorf("got %v, want a /GoTo to foo", a)
+	}
+}
+
+func TestLinkPadding(t *testing.T) {
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 100, Y: 100, W: 40, H: 40}}
+	link := func() []*PositionedLink {
+		return []*PositionedLink{{URL: "#t", X: 10, Y: 10, W: 40, H: 40, Valid: true}}
+	}
+	plain := readAnnots(t, addLinks(t, testPDF(onePage...), objects, link(), nil), 0)
+	if len(plain) != 1 || plain[0].Action != "GoTo" || plain[0].Dest == nil {
+		t.Fatalf("got %v, want a /GoTo to t", plain)
+	}
+	for _, c := range []struct {
+		padding string
+		want    [4]float64
+	}{
+		{"0", [4]float64{7.5, 362.5, 37.5, 392.5}},
+		{"5", [4]float64{2.5, 357.5, 42.5, 397.5}},
+		// Half of the 30pt square on each side, clamped to the top left
+		// corner of the page
+		{"50%", [4]float64{0, 347.5, 52.5, 400}},
+	} {
+		m, err := ParseMargin(c.padding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annots := readAnnots(t, addLinks(t, testPDF(onePage...), objects, link(), &Options{LinkPadding: m}), 0)
+		if len(annots) != 1 {
+			t.Fatalf("padding %s: got %d annotations, want 1", c.padding, len(annots))
+		}
+		for i := range c.want {
+			if math.Abs(annots[0].Rect[i]-c.want[i]) > 1e-3 {
+				t.Errorf("padding %s: link is at %v, want %v", c.padding, annots[0].Rect, c.want)
+				break
+			}
+		}
+		if !pdfValuesMatch(annots[0].Dest, plain[0].Dest) {
+			t.Errorf("padding %s: link goes to %v, want %v as without padding", c.padding, annots[0].Dest, plain[0].Dest)
+		}
+	}
+}
+
+// marshalObj returns the body of the object m writes, checking it's written
+// as object ref
+func marshalObj(t *testing.T, m interface{ Marshal(io.Writer) (int, error) }, ref *PDFObjRef) string {
+	t.Helper()
+	b := bytes.Buffer{}
+	n, err := m.Marshal(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != b.Len() {
+		t.Errorf("Marshal returned %d for %d bytes written", n, b.Len())
+	}
+	s := b.String()
+	head := fmt.Sprintf("%d %d obj\n", ref.ID, ref.Gen)
+	if !strings.HasPrefix(s, head) || !strings.HasSuffix(s, "\nendobj\n") {
+		t.Fatalf("got %q, want object %s", s, ref)
+	}
+	return s[len(head) : len(s)-len("\nendobj\n")]
+}
+
+// parseDict parses the PDF dictionary in s
+func parseDict(t *testing.T, s string) map[PDFName]interface{} {
+	t.Helper()
+	v, err := ParsePDFValue(s)
+	if err != nil {
+		t.Fatalf("cannot parse %q: %s", s, err)
+	}
+	d, ok := v.(map[PDFName]interface{})
+	if !ok {
+		t.Fatalf("%q is not a dictionary", s)
+	}
+	return d
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<</Type/Catalog/Pages 12 3 R/Metadata 5 0 R>>",
+		"<< /Type /Catalog\r\n/Pages\n2 0 R /OpenAction [ 3 0 R /Fit ] /ViewerPreferences << /DisplayDocTitle true >> >>",
+		"<< /Pages 2 0 R /Outlines 7 0 R /PageMode /UseOutlines /Lang (en-AU) /Type /Catalog >>",
+	} {
+		c, err := UnmarshalPDFCatalog(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		c.OwnRef = &PDFObjRef{ID: 1}
+		want := parseDict(t, s)
+		if got := want["Pages"].(*PDFObjRef); *c.PagesRef != *got {
+			t.Errorf("%q: got pages %s, want %s", s, c.PagesRef, got)
+		}
+		if got := parseDict(t, marshalObj(t, c, c.OwnRef)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: marshaled as %v, want %v", s, got, want)
+		}
+
+		// A new page tree and the entries linkify adds change nothing
+		// else
+		c.PagesRef = &PDFObjRef{ID: 9, Gen: 1}
+		c.DestsRef = &PDFObjRef{ID: 10}
+		c.StructTreeRef = &PDFObjRef{ID: 11}
+		out := marshalObj(t, c, c.OwnRef)
+		want["Pages"] = c.PagesRef
+		want["Names"] = map[PDFName]interface{}{"Dests": c.DestsRef}
+		want["StructTreeRoot"] = c.StructTreeRef
+		if got := parseDict(t, out); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: updated as %v, want %v", s, got, want)
+		}
+		c2, err := UnmarshalPDFCatalog(out)
+		if err != nil {
+			t.Fatalf("%q: cannot read back %q: %s", s, out, err)
+		}
+		if *c2.PagesRef != *c.PagesRef {
+			t.Errorf("%q: read back pages %s, want %s", s, c2.PagesRef, c.PagesRef)
+		}
+	}
+}
+
+func TestPagesRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"<< /Type /Pages /Kids [ 3 0 R 4 0 R ] /Count 2 >>",
+		"<</Type/Pages/Count 3/Kids[3 0 R 4 0 R 5 1 R]/MediaBox[0 0 612 792]>>",
+		"<< /Type /Pages\r\n/Kids [\r\n3 0 R\r\n] /Count 1 /Parent 2 0 R /Resources << /Font << /F1 8 0 R >> >> >>",
+	} {
+		p, err := UnmarshalPDFPages(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		p.OwnRef = &PDFObjRef{ID: 2}
+		want := parseDict(t, s)
+		var kids []interface{}
+		for _, r := range p.KidRefs {
+			kids = append(kids, r)
+		}
+		if !reflect.DeepEqual(kids, want["Kids"]) {
+			t.Errorf("%q: got kids %v, want %v", s, kids, want["Kids"])
+		}
+		if got := parseDict(t, marshalObj(t, p, p.OwnRef)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: marshaled as %v, want %v", s, got, want)
+		}
+
+		// Kids rewritten as the page tree is, in reverse with one more
+		p.KidRefs = append([]*PDFObjRef{{ID: 20, Gen: 2}}, p.KidRefs...)
+		for i, j := 0, len(p.KidRefs)-1; i < j; i, j = i+1, j-1 {
+			p.KidRefs[i], p.KidRefs[j] = p.KidRefs[j], p.KidRefs[i]
+		}
+		out := marshalObj(t, p, p.OwnRef)
+		p2, err := UnmarshalPDFPages(out)
+		if err != nil {
+			t.Fatalf("%q: cannot read back %q: %s", s, out, err)
+		}
+		if !reflect.DeepEqual(p2.KidRefs, p.KidRefs) {
+			t.Errorf("%q: read back kids %v, want %v", s, p2.KidRefs, p.KidRefs)
+		}
+		delete(want, "Kids")
+		got := parseDict(t, out)
+		delete(got, "Kids")
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: updated as %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestPageRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		raw                 string
+		x, y, width, height float64
+		rotate              int
+	}{
+		{"<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 600 400 ] /Contents 4 0 R >>", 0, 0, 600, 400, 0},
+		{"<</Type/Page/Parent 2 0 R/MediaBox[0 0 612 792]/Contents 4 0 R>>", 0, 0, 612, 792, 0},
+		{"<< /Type /Page /Parent 2 0 R /MediaBox [ -10.5 20 600.25 400 ] /Rotate 270 /Contents [ 4 0 R 5 0 R ] >>", -10.5, 20, 610.75, 380, 270},
+		{"<< /Type /Page\r\n/MediaBox [ 600 400 0 0 ]\r\n/Resources << /XObject << /Im1 6 0 R >> >> /Parent 2 0 R >>", 0, 0, 600, 400, 0},
+	} {
+		p, err := UnmarshalPDFPage(c.raw)
+		if err != nil {
+			t.Fatalf("%q: %s", c.raw, err)
+		}
+		if p.X != c.x || p.Y != c.y || p.Width != c.width || p.Height != c.height || p.Rotate != c.rotate {
+			t.Errorf("%q: got %g,%g %gx%g rotated %d, want %g,%g %gx%g rotated %d", c.raw,
+				p.X, p.Y, p.Width, p.Height, p.Rotate, c.x, c.y, c.width, c.height, c.rotate)
+		}
+
+		// Without links, the page only gets an empty /Annots
+		p.OwnRef = &PDFObjRef{ID: 3, Gen: 1}
+		out := marshalObj(t, p, p.OwnRef)
+		got, want := parseDict(t, out), parseDict(t, c.raw)
+		if annots, ok := got["Annots"].([]interface{}); !ok || len(annots) != 0 {
+			t.Errorf("%q: got annotations %v, want none", c.raw, got["Annots"])
+		}
+		delete(got, "Annots")
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: marshaled as %v, want %v", c.raw, got, want)
+		}
+		p2, err := UnmarshalPDFPage(out)
+		if err != nil {
+			t.Fatalf("%q: cannot read back %q: %s", c.raw, out, err)
+		}
+		if p2.X != p.X || p2.Y != p.Y || p2.Width != p.Width || p2.Height != p.Height || p2.Rotate != p.Rotate {
+			t.Errorf("%q: read back as %g,%g %gx%g rotated %d", c.raw, p2.X, p2.Y, p2.Width, p2.Height, p2.Rotate)
+		}
+	}
+}
+
+func TestXrefTrailerRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		raw  string
+		size int
+		root PDFObjRef
+		prev int64
+	}{
+		{"<< /Size 5 /Root 1 0 R >>", 5, PDFObjRef{ID: 1}, 0},
+		{"<</Size 12/Root 3 2 R/Info 4 0 R/ID[<0123abcd><0123abcd>]>>", 12, PDFObjRef{ID: 3, Gen: 2}, 0},
+		{"<< /Root 1 0 R\r\n/Prev 123456789 /Size 8 /Encrypt 9 0 R >>", 8, PDFObjRef{ID: 1}, 123456789},
+	} {
+		tr, err := UnmarshalPDFXrefTrailer(c.raw)
+		if err != nil {
+			t.Fatalf("%q: %s", c.raw, err)
+		}
+		if tr.Size != c.size || *tr.Root != c.root || tr.Prev != c.prev {
+			t.Errorf("%q: got size %d, root %s and prev %d", c.raw, tr.Size, tr.Root, tr.Prev)
+		}
+		for _, prev := range []int64{tr.Prev, 0, 987654321} {
+			tr.Prev = prev
+			b := strings.Builder{}
+			if _, err := tr.Marshal(&b); err != nil {
+				t.Fatal(err)
+			}
+			out := b.String()
+			if !strings.HasPrefix(out, "trailer\n") {
+				t.Fatalf("%q: got %q, want a trailer", c.raw, out)
+			}
+			out = strings.TrimPrefix(out, "trailer\n")
+			want := parseDict(t, c.raw)
+			delete(want, "Prev")
+			if prev > 0 {
+				want["Prev"] = float64(prev)
+			}
+			if got := parseDict(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q with prev %d: marshaled as %v, want %v", c.raw, prev, got, want)
+			}
+			tr2, err := UnmarshalPDFXrefTrailer(out)
+			if err != nil {
+				t.Fatalf("%q: cannot read back %q: %s", c.raw, out, err)
+			}
+			if tr2.Size != tr.Size || *tr2.Root != *tr.Root || tr2.Prev != prev {
+				t.Errorf("%q: read back size %d, root %s and prev %d", c.raw, tr2.Size, tr2.Root, tr2.Prev)
+			}
+		}
+	}
+}
+
+func TestXrefRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"xref\n0 5\n0000000000 65535 f \n0000000009 00000 n \n0000000058 00000 n \n0000000117 00000 n \n0000000209 00000 n \n" +
+			"trailer\n<< /Size 5 /Root 1 0 R >>\nstartxref\n270\n%%EOF\n",
+		// Subsections, free entries linked as a list, CRLF line ends and
+		// more to the trailer
+		"xref\r\n0 2\r\n0000000003 65535 f\r\n0000000017 00000 n\r\n2 3\r\n0000000081 00002 n\r\n0000000000 00001 f\r\n0000000150 00000 n\r\n" +
+			"trailer\r\n<< /Size 5 /Root 1 0 R /Info 4 0 R >>\r\nstartxref\r\n200\r\n%%EOF\r\n",
+	} {
+		x, err := UnmarshalPDFXref(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		b := bytes.Buffer{}
+		n, err := x.Marshal(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != b.Len() {
+			t.Errorf("Marshal returned %d for %d bytes written", n, b.Len())
+		}
+		out := b.String()
+		b.WriteString("startxref\n0\n%%EOF\n")
+		x2, err := UnmarshalPDFXref(&b)
+		if err != nil {
+			t.Fatalf("%q: cannot read back %q: %s", s, out, err)
+		}
+		if len(x2.Entries) != len(x.Entries) {
+			t.Fatalf("%q: read back %d entries from %q, want %d", s, len(x2.Entries), out, len(x.Entries))
+		}
+		for id, e := range x.Entries {
+			if *x2.Entries[id] != *e {
+				t.Errorf("%q: object %d read back as %+v, want %+v", s, id, *x2.Entries[id], *e)
+			}
+		}
+		if x2.Trailer.Size != x.Trailer.Size || *x2.Trailer.Root != *x.Trailer.Root {
+			t.Errorf("%q: trailer read back as %q", s, x2.Trailer.Raw)
+		}
+		if got, want := parseDict(t, x2.Trailer.Raw), parseDict(t, x.Trailer.Raw); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: trailer read back as %v, want %v", s, got, want)
+		}
+	}
+}
+
+// shortReader is a memFile whose reads return at most a byte at a time, as
+// reads of pipes and network file systems may
+type shortReader struct {
+	*memFile
+}
+
+func (r shortReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.memFile.Read(p)
+}
+
+func TestStartxrefTail(t *testing.T) {
+	// An unused stream of an MB makes the offset of the xref 7 digits
+	// long, and trailing whitespace after %%EOF, as some tools leave, puts
+	// startxref well over 50 bytes from the end
+	padding := strings.Repeat("0", 1<<20)
+	objs := append(append([]string{}, onePage...), fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(padding), padding))
+	pdf := append(testPDF(objs...), []byte(strings.Repeat(" \r\n", 100))...)
+	tail := string(pdf[len(pdf)-50:])
+	if strings.Contains(tail, "startxref") {
+		t.Fatal("startxref is within the last 50 bytes")
+	}
+	m := regexp.MustCompile(`startxref\s+(\d+)`).FindStringSubmatch(string(pdf))
+	if len(m[1]) < 7 {
+		t.Fatalf("xref is at %s, want a large offset", m[1])
+	}
+
+	f := newMemFile(pdf)
+	if _, err := UnmarshalPDFFile(shortReader{f}); err != nil {
+		t.Fatal(err)
+	}
+	l := &PositionedLink{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+	annots := readAnnots(t, addLinks(t, pdf, nil, []*PositionedLink{l}, nil), 0)
+	if len(annots) != 1 || annots[0].URI != l.URL {
+		t.Errorf("got %v, want the link", annots)
+	}
+}
+
+func TestEOFEndings(t *testing.T) {
+	pdf := bytes.TrimSuffix(testPDF(onePage...), []byte("%%EOF\n"))
+	for _, end := range []string{"%%EOF", "%%EOF\n", "%%EOF\r\n", "%%EOF\r", "%%EOF \r\n\r\n\t"} {
+		for _, crlf := range []bool{false, true} {
+			b := append([]byte{}, pdf...)
+			if crlf {
+				// Only the lines around startxref, which leaves the
+				// offsets as they are
+				i := bytes.LastIndex(b, []byte("\nstartxref\n"))
+				b = append(b[:i:i], bytes.Replace(b[i:], []byte("\n"), []byte("\r"), -1)...)
+			}
+			b = append(b, end...)
+			name := fmt.Sprintf("%q, crlf %t", end, crlf)
+			l := &PositionedLink{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true}
+			f := addLinks(t, b, nil, []*PositionedLink{l}, nil)
+			if annots := readAnnots(t, f, 0); len(annots) != 1 {
+				t.Errorf("%s: got %v, want the link", name, annots)
+			}
+
+			// The update ends in a proper %%EOF of its own, without a
+			// newline, which is read again when updating it further
+			if !bytes.HasSuffix(f.b, []byte("\n%%EOF")) {
+				t.Errorf("%s: update ends in %q", name, f.b[len(f.b)-20:])
+			}
+			l2 := &PositionedLink{URL: "https://example.com/2", X: 10, Y: 100, W: 50, H: 20, Valid: true}
+			if annots := readAnnots(t, addLinks(t, f.b, nil, []*PositionedLink{l2}, nil), 0); len(annots) != 2 || annots[1].URI != l2.URL {
+				t.Errorf("%s: updated again, got %v, want both links", name, annots)
+			}
+		}
+	}
+}
+
+// eolPDF returns the onePage PDF with lines ending in eol instead of LF, as
+// converted by tools that rewrite line endings, with the offsets and stream
+// length to match
+func eolPDF(eol string) []byte {
+	objs := append([]string{}, onePage[:3]...)
+	objs = append(objs, fmt.Sprintf("<< /Length %d >>\nstream\n0 0 m S\nendstream", len("0 0 m S"+eol)))
+	b := bytes.Buffer{}
+	b.WriteString("%PDF-1.4" + eol)
+	offs := make([]int, len(objs))
+	for i, o := range objs {
+		offs[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj%s%s%sendobj%s", i+1, eol, strings.Replace(o, "\n", eol, -1), eol, eol)
+	}
+	// Entries are 20 bytes with either line ending
+	entryEOL := eol
+	if len(eol) == 1 {
+		entryEOL = " " + eol
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref%s0 %d%s0000000000 65535 f%s", eol, len(objs)+1, eol, entryEOL)
+	for _, off := range offs {
+		fmt.Fprintf(&b, "%010d 00000 n%s", off, entryEOL)
+	}
+	fmt.Fprintf(&b, "trailer%s<< /Size %d /Root 1 0 R >>%sstartxref%s%d%s%%%%EOF%s", eol, len(objs)+1, eol, eol, xref, eol, eol)
+	return b.Bytes()
+}
+
+func TestLineEndings(t *testing.T) {
+	objects := map[string]*PositionedObject{"t": {ID: "t", X: 100, Y: 100, W: 40, H: 40}}
+	for _, eol := range []string{"\n", "\r\n", "\r"} {
+		for _, reuse := range []bool{false, true} {
+			name := fmt.Sprintf("%q, reuse %t", eol, reuse)
+			pdf := eolPDF(eol)
+			doc, err := UnmarshalPDFFile(bytes.NewReader(pdf))
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if len(doc.Kids) != 1 || doc.Kids[0].Width != 600 || doc.Kids[0].Height != 400 {
+				t.Fatalf("%s: got pages %v, want the 600x400 page", name, doc.Kids)
+			}
+			links := []*PositionedLink{
+				{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+				{URL: "#t", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+			}
+			f := addLinks(t, pdf, objects, links, &Options{ReuseObjects: reuse})
+			if annots := readAnnots(t, f, 0); len(annots) != 2 {
+				t.Errorf("%s: got %v, want both links", name, annots)
+			}
+
+			// Every object the xref lists is where it says, in the
+			// original and the update alike
+			doc, err = UnmarshalPDFFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, e := range doc.Xref.Entries {
+				if e == nil || e.Free {
+					continue
+				}
+				head := fmt.Sprintf("%d %d obj", id, e.Gen)
+				if e.Offset+int64(len(head)) > int64(len(f.b)) || string(f.b[e.Offset:e.Offset+int64(len(head))]) != head {
+					t.Errorf("%s: object %d isn't at offset %d", name, id, e.Offset)
+				}
+			}
+		}
+	}
+}
+
+func TestMarshalBrokenLink(t *testing.T) {
+	page, err := UnmarshalPDFPage(onePage[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.OwnRef = &PDFObjRef{ID: 3}
+	page.Objects = map[string]*PositionedObject{}
+	page.Links = []*PositionedLink{
+		{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#missing", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	var lerrs []*LinkError
+	page.OnLinkError = func(lerr *LinkError) error {
+		lerrs = append(lerrs, lerr)
+		return nil
+	}
+	d := parseDict(t, marshalObj(t, page, page.OwnRef))
+	annots, _ := d["Annots"].([]interface{})
+	if len(annots) != 1 {
+		t.Fatalf("got annotations %v, want only the external link", d["Annots"])
+	}
+	if a := annots[0].(map[PDFName]interface{})["A"].(map[PDFName]interface{}); a["S"] != PDFName("URI") {
+		t.Errorf("got action %v, want the /URI", a)
+	}
+	if len(lerrs) != 1 || lerrs[0].Link != page.Links[1] || lerrs[0].Reason != "points to non-existing object" {
+		t.Errorf("got link errors %v, want the missing target", lerrs)
+	}
+
+	// With only the broken link, no annotation bytes are written at all
+	page.Links = page.Links[1:]
+	out := marshalObj(t, page, page.OwnRef)
+	if annots, ok := parseDict(t, out)["Annots"].([]interface{}); !ok || len(annots) != 0 || strings.Contains(out, "/Link") || strings.Contains(out, "/S ") {
+		t.Errorf("got %q, want no annotation", out)
+	}
+
+	// and the PDF gets only the link that can be built, the other reported
+	lerrs = nil
+	links := []*PositionedLink{
+		{URL: "https://example.com/", X: 10, Y: 10, W: 50, H: 20, Valid: true},
+		{URL: "#missing", X: 10, Y: 100, W: 50, H: 20, Valid: true},
+	}
+	opts := &Options{OnLinkError: page.OnLinkError}
+	if annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, links, opts), 0); len(annots) != 1 || annots[0].URI != links[0].URL {
+		t.Errorf("got %v, want only the external link", annots)
+	}
+	if len(lerrs) != 1 || lerrs[0].Link != links[1] {
+		t.Errorf("got link errors %v, want the missing target", lerrs)
+	}
+}
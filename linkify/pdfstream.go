@@ -0,0 +1,189 @@
+package linkify
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// splitPDFStream splits the body of a stream object into its dictionary and
+// its still encoded data. Only a direct /Length is trusted, otherwise the data
+// is taken to run up to endstream.
+func splitPDFStream(body string) (map[PDFName]interface{}, []byte, error) {
+	l := pdfLexer{s: body}
+	v, err := l.value()
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := v.(map[PDFName]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("PDF stream doesn't start with a dictionary")
+	}
+	l.skipSpace()
+	rest := strings.TrimPrefix(body[l.pos:], "stream")
+	if len(rest) == len(body)-l.pos {
+		return nil, nil, fmt.Errorf("cannot find PDF stream data")
+	}
+	if strings.HasPrefix(rest, "\r\n") {
+		rest = rest[2:]
+	} else if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r") {
+		rest = rest[1:]
+	}
+	if n, ok := dict["Length"].(float64); ok && int(n) >= 0 && int(n) <= len(rest) &&
+		strings.HasPrefix(strings.TrimLeft(rest[int(n):], "\r\n "), "endstream") {
+		return dict, []byte(rest[:int(n)]), nil
+	}
+	end := strings.LastIndex(rest, "endstream")
+	if end < 0 {
+		return nil, nil, fmt.Errorf("cannot find end of PDF stream")
+	}
+	return dict, []byte(strings.TrimRight(rest[:end], "\r\n")), nil
+}
+
+// decodePDFStream decodes stream data with no filter or FlateDecode, along
+// with PNG predictors, which is all inkscape uses for xref and object streams
+func decodePDFStream(dict map[PDFName]interface{}, data []byte) ([]byte, error) {
+	filter := dict["Filter"]
+	parms := dict["DecodeParms"]
+	if a, ok := filter.([]interface{}); ok && len(a) <= 1 {
+		filter = nil
+		if len(a) == 1 {
+			filter = a[0]
+		}
+		if p, ok := parms.([]interface{}); ok && len(p) == 1 {
+			parms = p[0]
+		}
+	}
+	switch filter {
+	case nil:
+		return data, nil
+	case PDFName("FlateDecode"):
+	default:
+		return nil, fmt.Errorf("unsupported PDF stream filter %v", filter)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := parms.(map[PDFName]interface{})
+	predictor, _ := p["Predictor"].(float64)
+	if predictor < 10 {
+		if predictor > 1 {
+			return nil, fmt.Errorf("unsupported PDF stream predictor %v", predictor)
+		}
+		return out, nil
+	}
+	columns := 1
+	if c, ok := p["Columns"].(float64); ok {
+		columns = int(c)
+	}
+	return unpredictPNG(out, columns)
+}
+
+// unpredictPNG reverses PNG prediction of rows of one byte components, each
+// row being prefixed with its predictor type
+func unpredictPNG(data []byte, columns int) ([]byte, error) {
+	if columns < 1 {
+		return nil, fmt.Errorf("invalid PDF stream columns %d", columns)
+	}
+	var out []byte
+	prev := make([]byte, columns)
+	for len(data) > 0 {
+		if len(data) < columns+1 {
+			return nil, fmt.Errorf("truncated PNG predicted PDF stream")
+		}
+		typ, row := data[0], append([]byte(nil), data[1:columns+1]...)
+		data = data[columns+1:]
+		for i := range row {
+			var left, upLeft byte
+			if i > 0 {
+				left, upLeft = row[i-1], prev[i-1]
+			}
+			up := prev[i]
+			switch typ {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("unknown PNG predictor %d in PDF stream", typ)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// objFromStream returns the body of the index'th object in the object stream
+// whose body is given
+func objFromStream(body string, index int) (string, error) {
+	dict, data, err := splitPDFStream(body)
+	if err != nil {
+		return "", err
+	}
+	if data, err = decodePDFStream(dict, data); err != nil {
+		return "", err
+	}
+	n, _ := dict["N"].(float64)
+	first, _ := dict["First"].(float64)
+	if dict["Type"] != PDFName("ObjStm") || index >= int(n) || int(first) > len(data) {
+		return "", fmt.Errorf("invalid PDF object stream")
+	}
+
+	// The stream starts with pairs of object numbers and offsets relative to
+	// First
+
+	header := strings.Fields(string(data[:int(first)]))
+	if len(header) < 2*int(n) {
+		return "", fmt.Errorf("invalid PDF object stream header")
+	}
+	start, err := strconv.Atoi(header[2*index+1])
+	if err != nil {
+		return "", fmt.Errorf("invalid PDF object stream header")
+	}
+	end := len(data) - int(first)
+	if index+1 < int(n) {
+		if end, err = strconv.Atoi(header[2*index+3]); err != nil {
+			return "", fmt.Errorf("invalid PDF object stream header")
+		}
+	}
+	if start < 0 || start > end || int(first)+end > len(data) {
+		return "", fmt.Errorf("invalid PDF object stream offsets")
+	}
+	return strings.TrimSpace(string(data[int(first)+start : int(first)+end])), nil
+}
@@ -0,0 +1,353 @@
+package linkify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// PDFName is a PDF name object, without the leading slash
+type PDFName string
+
+// String returns n in PDF syntax. Bytes that aren't regular characters are
+// written as #xx escapes so any string, including non-ASCII, can round trip
+// through a name.
+func (n PDFName) String() string {
+	b := strings.Builder{}
+	b.WriteByte('/')
+	for i := 0; i < len(n); i++ {
+		c := n[i]
+		if c <= ' ' || c > '~' || c == '#' || isPDFDelim(c) {
+			fmt.Fprintf(&b, "#%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapePDFName decodes the #xx escapes in the raw name s
+func unescapePDFName(s string) PDFName {
+	if !strings.Contains(s, "#") {
+		return PDFName(s)
+	}
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return PDFName(b.String())
+}
+
+// pdfString returns s as a PDF literal string, escaping backslashes,
+// parentheses and carriage returns (which readers would turn into newlines)
+func pdfString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", `\r`)
+	return "(" + r.Replace(s) + ")"
+}
+
+// pdfTextString returns s as a PDF text string. Text that isn't plain ASCII is
+// encoded as UTF-16BE with a byte order mark, in a hex string.
+func pdfTextString(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return pdfString(s)
+	}
+	b := strings.Builder{}
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// asciiURI percent-encodes the bytes of the UTF-8 URI u which aren't printable
+// ASCII, since URIs in PDFs must be 7-bit ASCII
+func asciiURI(u string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(u); i++ {
+		if c := u[i]; c <= ' ' || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// PDFKeyword is a bare PDF token such as true, false or null
+type PDFKeyword string
+
+// ParsePDFValue parses the PDF value at the start of s. Dictionaries are
+// returned as map[PDFName]interface{}, arrays as []interface{}, strings
+// (literal and hex) as string, numbers as float64 and indirect references as
+// *PDFObjRef.
+func ParsePDFValue(s string) (interface{}, error) {
+	l := pdfLexer{s: s}
+	return l.value()
+}
+
+// pdfDictEntry returns where the entry with the given key of the dictionary
+// at the start of s is: the key starts at keyStart and its value spans from
+// start to end. ok is false if there's no such entry.
+func pdfDictEntry(s string, key PDFName) (keyStart, start, end int, ok bool) {
+	l := pdfLexer{s: s}
+	l.skipSpace()
+	if !strings.HasPrefix(l.s[l.pos:], "<<") {
+		return 0, 0, 0, false
+	}
+	l.pos += 2
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.s) || strings.HasPrefix(l.s[l.pos:], ">>") {
+			return 0, 0, 0, false
+		}
+		keyStart = l.pos
+		k, err := l.value()
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		l.skipSpace()
+		start = l.pos
+		if _, err := l.value(); err != nil {
+			return 0, 0, 0, false
+		}
+		if k == key {
+			return keyStart, start, l.pos, true
+		}
+	}
+}
+
+// pdfDictAppend returns s, which starts with a dictionary, with entries added
+// just before the dictionary's own closing >>. That's found by parsing the
+// dictionary, so nested dictionaries or anything following it don't matter.
+func pdfDictAppend(s, entries string) (string, error) {
+	l := pdfLexer{s: s}
+	v, err := l.value()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := v.(map[PDFName]interface{}); !ok {
+		return "", fmt.Errorf("PDF object is not a dictionary")
+	}
+	end := l.pos - len(">>")
+	return s[:end] + entries + "\n" + s[end:], nil
+}
+
+type pdfLexer struct {
+	s   string
+	pos int
+}
+
+func isPDFWhite(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.s) {
+		c := l.s[l.pos]
+		if c == '%' {
+			for l.pos < len(l.s) && l.s[l.pos] != '\n' && l.s[l.pos] != '\r' {
+				l.pos++
+			}
+		} else if isPDFWhite(c) {
+			l.pos++
+		} else {
+			return
+		}
+	}
+}
+
+// regular reads a run of regular (non-white, non-delimiter) characters
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.s) && !isPDFWhite(l.s[l.pos]) && !isPDFDelim(l.s[l.pos]) {
+		l.pos++
+	}
+	return l.s[start:l.pos]
+}
+
+func (l *pdfLexer) value() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.s) {
+		return nil, fmt.Errorf("unexpected end of PDF value")
+	}
+	switch rest := l.s[l.pos:]; {
+	case strings.HasPrefix(rest, "<<"):
+		l.pos += 2
+		return l.dict()
+	case rest[0] == '<':
+		l.pos++
+		return l.hexString()
+	case rest[0] == '[':
+		l.pos++
+		return l.array()
+	case rest[0] == '(':
+		l.pos++
+		return l.literalString()
+	case rest[0] == '/':
+		l.pos++
+		return unescapePDFName(l.regular()), nil
+	case isPDFDelim(rest[0]):
+		return nil, fmt.Errorf("unexpected '%c' in PDF value", rest[0])
+	}
+
+	tok := l.regular()
+	n, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		return PDFKeyword(tok), nil
+	}
+
+	// An integer might be the start of an indirect reference "id gen R"
+
+	if id, err := strconv.Atoi(tok); err == nil {
+		save := l.pos
+		l.skipSpace()
+		if gen, err := strconv.Atoi(l.regular()); err == nil {
+			l.skipSpace()
+			if l.regular() == "R" {
+				return &PDFObjRef{ID: id, Gen: gen}, nil
+			}
+		}
+		l.pos = save
+	}
+	return n, nil
+}
+
+func (l *pdfLexer) dict() (map[PDFName]interface{}, error) {
+	d := map[PDFName]interface{}{}
+	for {
+		l.skipSpace()
+		if strings.HasPrefix(l.s[l.pos:], ">>") {
+			l.pos += 2
+			return d, nil
+		}
+		k, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := k.(PDFName)
+		if !ok {
+			return nil, fmt.Errorf("PDF dictionary key is not a name")
+		}
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		d[name] = v
+	}
+}
+
+func (l *pdfLexer) array() ([]interface{}, error) {
+	a := []interface{}{}
+	for {
+		l.skipSpace()
+		if l.pos < len(l.s) && l.s[l.pos] == ']' {
+			l.pos++
+			return a, nil
+		}
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+}
+
+func (l *pdfLexer) hexString() (string, error) {
+	end := strings.IndexByte(l.s[l.pos:], '>')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated PDF hex string")
+	}
+	hex := strings.Map(func(r rune) rune {
+		if r < 128 && isPDFWhite(byte(r)) {
+			return -1
+		}
+		return r
+	}, l.s[l.pos:l.pos+end])
+	l.pos += end + 1
+	if len(hex)%2 == 1 {
+		hex += "0"
+	}
+	b := make([]byte, len(hex)/2)
+	for i := range b {
+		v, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid PDF hex string")
+		}
+		b[i] = byte(v)
+	}
+	return string(b), nil
+}
+
+func (l *pdfLexer) literalString() (string, error) {
+	b := strings.Builder{}
+	depth := 0
+	for l.pos < len(l.s) {
+		c := l.s[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return b.String(), nil
+			}
+			depth--
+		case '\\':
+			if l.pos >= len(l.s) {
+				continue
+			}
+			c = l.s[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.s) && l.s[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2 && l.pos < len(l.s) && l.s[l.pos] >= '0' && l.s[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.s[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				}
+			}
+		}
+		b.WriteByte(c)
+	}
+	return "", fmt.Errorf("unterminated PDF string")
+}
@@ -0,0 +1,47 @@
+package linkify
+
+import "testing"
+
+func TestPDFNameRoundTrip(t *testing.T) {
+	for _, s := range []string{"plain", "my target", "café", "a(b)/c#1", "наш [1]"} {
+		v, err := ParsePDFValue(PDFName(s).String())
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+		} else if v != PDFName(s) {
+			t.Errorf("%q written as %s was read back as %q", s, PDFName(s), v)
+		}
+	}
+}
+
+func TestPDFString(t *testing.T) {
+	for s, want := range map[string]string{
+		`https://example.com/x?a=(1)&b=2\3`: `(https://example.com/x?a=\(1\)&b=2\\3)`,
+		"plain":                             "(plain)",
+		"a)b":                               `(a\)b)`,
+		"line\rbreak":                       `(line\rbreak)`,
+	} {
+		got := pdfString(s)
+		if got != want {
+			t.Errorf("%q: got %s, want %s", s, got, want)
+		}
+		if v, err := ParsePDFValue(got); err != nil || v != s {
+			t.Errorf("%q written as %s was read back as %q (%v)", s, got, v, err)
+		}
+	}
+}
+
+func TestPDFDictAppend(t *testing.T) {
+	for s, want := range map[string]string{
+		"<< /A 1 >>":                             "<< /A 1 /X 1\n>>",
+		"<< /R << /F << /F1 7 0 R >> >> >>":      "<< /R << /F << /F1 7 0 R >> >> /X 1\n>>",
+		"<< /T (a >> b) >>  \n":                  "<< /T (a >> b) /X 1\n>>  \n",
+		"<< /Length 2 >>\nstream\n>>\nendstream": "<< /Length 2 /X 1\n>>\nstream\n>>\nendstream",
+	} {
+		if got, err := pdfDictAppend(s, "/X 1"); err != nil || got != want {
+			t.Errorf("%q: got %q (%v), want %q", s, got, err, want)
+		}
+	}
+	if _, err := pdfDictAppend("[ 1 2 ]", "/X 1"); err == nil {
+		t.Error("appended to an array")
+	}
+}
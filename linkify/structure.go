@@ -0,0 +1,86 @@
+package linkify
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var pdfStructTreeRegexp = regexp.MustCompile(`/StructTreeRoot\b`)
+
+// PDFAnnot is a link annotation written as an object of its own, which
+// tagged PDFs need so that structure elements can refer to it
+type PDFAnnot struct {
+	OwnRef *PDFObjRef
+	Page   *PDFPage
+
+	// Index of the link among the links of Page
+	Index int
+
+	// StructParent is the key of the annotation's structure element in the
+	// parent tree
+	StructParent int
+}
+
+func (a *PDFAnnot) Marshal(w io.Writer) (int, error) {
+	p := a.Page
+	var ap *PDFAppearance
+	if a.Index < len(p.Appearances) {
+		ap = p.Appearances[a.Index]
+	}
+	annot, lerr := p.marshalLink(p.Links[a.Index], ap)
+	if lerr != nil {
+		// The object is already in the xref and the structure tree, so it
+		// cannot be left out as links on untagged pages are
+		return 0, lerr
+	}
+	annot, err := pdfDictAppend(annot, fmt.Sprintf("/StructParent %d", a.StructParent))
+	if err != nil {
+		return 0, err
+	}
+	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", a.OwnRef.ID, a.OwnRef.Gen, annot)
+}
+
+// PDFLinkElem is a /Link structure element tying a link annotation into the
+// structure tree
+type PDFLinkElem struct {
+	OwnRef *PDFObjRef
+	Annot  *PDFAnnot
+
+	// ParentRef is the structure tree root
+	ParentRef *PDFObjRef
+}
+
+func (e *PDFLinkElem) Marshal(w io.Writer) (int, error) {
+	l := e.Annot.Page.Links[e.Annot.Index]
+	alt := l.Title
+	if alt == "" {
+		alt = l.URL
+	}
+	pg := e.Annot.Page.OwnRef
+	return fmt.Fprintf(w, "%d %d obj\n"+
+		"<< /Type /StructElem /S /Link /P %s /Pg %s /Alt %s /K << /Type /OBJR /Obj %s /Pg %s >> >>\n"+
+		"endobj\n",
+		e.OwnRef.ID, e.OwnRef.Gen, e.ParentRef, pg, pdfTextString(alt), e.Annot.OwnRef, pg)
+}
+
+// PDFStructTree is a minimal structure tree holding only a /Link element for
+// each link, with the parent tree mapping the annotations back to them
+type PDFStructTree struct {
+	OwnRef *PDFObjRef
+	Elems  []*PDFLinkElem
+}
+
+func (t *PDFStructTree) Marshal(w io.Writer) (int, error) {
+	kids := strings.Builder{}
+	nums := strings.Builder{}
+	for _, e := range t.Elems {
+		fmt.Fprintf(&kids, " %s", e.OwnRef)
+		fmt.Fprintf(&nums, " %d %s", e.Annot.StructParent, e.OwnRef)
+	}
+	return fmt.Fprintf(w, "%d %d obj\n"+
+		"<< /Type /StructTreeRoot /K [%s ] /ParentTree << /Nums [%s ] >> /ParentTreeNextKey %d >>\n"+
+		"endobj\n",
+		t.OwnRef.ID, t.OwnRef.Gen, kids.String(), nums.String(), len(t.Elems))
+}
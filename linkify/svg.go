@@ -0,0 +1,539 @@
+package linkify
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	svgRootRegexp = regexp.MustCompile(`<svg\b[^>]*>`)
+	widthRegexp   = regexp.MustCompile(`\swidth\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	heightRegexp  = regexp.MustCompile(`\sheight\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	viewBoxRegexp = regexp.MustCompile(`\sviewBox\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	pageRegexp    = regexp.MustCompile(`<inkscape:page\b[^>]*>`)
+	xRegexp       = regexp.MustCompile(`\sx\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	yRegexp       = regexp.MustCompile(`\sy\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// rootAttr returns the value of the attribute matched by re in the root
+// element tag (or any other tag), which may be quoted with either single or
+// double quotes
+func rootAttr(re *regexp.Regexp, root string) (string, bool) {
+	m := re.FindStringSubmatch(root)
+	if m == nil {
+		return "", false
+	}
+	return m[1] + m[2], true
+}
+
+// hiddenElements are elements whose content is never rendered directly, so
+// anchors within them can't be clicked
+var hiddenElements = map[string]bool{
+	"clipPath": true,
+	"defs":     true,
+	"mask":     true,
+}
+
+// elementID returns the id attribute of the element, if any
+func elementID(e xml.StartElement) string {
+	for _, a := range e.Attr {
+		if a.Name.Space == "" && a.Name.Local == "id" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// syntheticID returns the id given to an anchor without one, made from its
+// href so it's the same from one run to the next. n counts the earlier
+// anchors without an id to the same href, which get their own ids.
+func syntheticID(href string, n int) string {
+	h := sha1.Sum([]byte(href))
+	id := "svglinkify-" + hex.EncodeToString(h[:4])
+	if n > 0 {
+		id += fmt.Sprintf("-%d", n+1)
+	}
+	return id
+}
+
+// inkscapeNamespace is the namespace of inkscape's own attributes
+const inkscapeNamespace = "http://www.inkscape.org/namespaces/inkscape"
+
+// anchorAliases returns the data-svglinkify-id and inkscape:label of the
+// anchor element, which unlike its id are kept as they are by inkscape
+func anchorAliases(e xml.StartElement) []string {
+	var data, label string
+	for _, a := range e.Attr {
+		switch {
+		case a.Name.Space == "" && a.Name.Local == "data-svglinkify-id":
+			data = a.Value
+		case (a.Name.Space == inkscapeNamespace || a.Name.Space == "inkscape") && a.Name.Local == "label":
+			label = a.Value
+		}
+	}
+	var aliases []string
+	for _, v := range []string{data, label} {
+		if v != "" {
+			aliases = append(aliases, v)
+		}
+	}
+	return aliases
+}
+
+// parseLinkRect parses the value of a data-link-rect attribute, x,y,w,h in
+// user units, into the link's geometry
+func parseLinkRect(l *PositionedLink, v string) error {
+	f := strings.Split(v, ",")
+	var r [4]float64
+	if len(f) == len(r) {
+		var err error
+		for i := range f {
+			if r[i], err = strconv.ParseFloat(strings.TrimSpace(f[i]), 64); err != nil {
+				break
+			}
+		}
+		if err == nil && r[2] > 0 && r[3] > 0 {
+			l.X, l.Y, l.W, l.H = r[0], r[1], r[2], r[3]
+			return nil
+		}
+	}
+	return fmt.Errorf("link '%s' has invalid data-link-rect '%s', expected x,y,w,h with a positive width and height", l.URL, v)
+}
+
+// newSVGDecoder returns a lenient decoder of the SVG in r, which also
+// decodes HTML entities such as &nbsp; that aren't defined in XML but are left
+// in SVGs exported from HTML, e.g. in links
+func newSVGDecoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	return d
+}
+
+// xlinkNamespace is the namespace of the xlink:href attribute used by SVG 1.1
+const xlinkNamespace = "http://www.w3.org/1999/xlink"
+
+// anchorAttr returns the attribute of the anchor element with the given local
+// name, either without a namespace or in the xlink one, with the former taking
+// precedence as in SVG 2
+func anchorAttr(e xml.StartElement, local string) string {
+	var plain, xlink string
+	for _, a := range e.Attr {
+		if a.Name.Local != local {
+			continue
+		}
+		switch a.Name.Space {
+		case "":
+			plain = a.Value
+		case xlinkNamespace, "xlink":
+			xlink = a.Value
+		}
+	}
+	if plain != "" {
+		return plain
+	}
+	return xlink
+}
+
+// anchorHref returns the link of the anchor element. Both href and the older
+// xlink:href are recognized, and href takes precedence as in SVG 2.
+func anchorHref(e xml.StartElement) string {
+	return anchorAttr(e, "href")
+}
+
+// ScanAnchors finds all the anchor elements in the SVG and returns their ids,
+// links, titles and the ids of the elements within them. The title is taken
+// from the title or xlink:title attribute (which inkscape sets) or else a
+// title element directly within the anchor. Anchors without an id are given
+// one made from their href (see PositionedLink.SyntheticID), and are placed
+// by their alias (see PositionedLink.Aliases) or the elements within them.
+// Those with neither, and anchors inside hidden elements (e.g. clip paths),
+// are skipped, and onSkip, if not nil, is called with each of them that has
+// a link. If maxLinks is positive and more anchors than that are found,
+// scanning stops with an error. Anchors with a data-link-rect attribute
+// ("x,y,w,h" in user units) get that as their geometry and are marked valid,
+// and a malformed one is an error.
+func ScanAnchors(r io.Reader, maxLinks int, onSkip func(l *PositionedLink, reason string)) ([]*PositionedLink, error) {
+	d := newSVGDecoder(r)
+	links := []*PositionedLink{}
+	anchors := 0
+	hidden := 0
+
+	// synthetic counts the anchors without an id given one by each href
+	synthetic := map[string]int{}
+
+	// open holds the currently open elements, with the link of those which
+	// are anchors
+	type openElement struct {
+		hidden bool
+		link   *PositionedLink
+
+		// titleOf is the link whose title this element holds, if any
+		titleOf *PositionedLink
+	}
+	var open []openElement
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := openElement{hidden: hiddenElements[t.Name.Local]}
+			if e.hidden {
+				hidden++
+			}
+			if id := elementID(t); id != "" {
+				for _, o := range open {
+					if o.link != nil {
+						o.link.Descendants = append(o.link.Descendants, id)
+					}
+				}
+			}
+			if t.Name.Local == "a" {
+				anchors++
+				if maxLinks > 0 && anchors > maxLinks {
+					return nil, fmt.Errorf("found more than %d links", maxLinks)
+				}
+				l := PositionedLink{ID: elementID(t), URL: anchorHref(t), Title: anchorAttr(t, "title"), Aliases: anchorAliases(t)}
+				l.NewWindow = anchorAttr(t, "target") == "_blank" || anchorAttr(t, "show") == "new"
+				if v := anchorAttr(t, "data-link-rect"); v != "" && l.URL != "" {
+					if err := parseLinkRect(&l, v); err != nil {
+						return nil, err
+					}
+					l.Valid = true
+				}
+				switch {
+				case l.URL == "":
+				case hidden > 0:
+					if onSkip != nil {
+						onSkip(&l, "is inside a hidden element")
+					}
+				default:
+					// Anchors without an id may still be placed by what
+					// they wrap, which isn't known until they end
+					links = append(links, &l)
+					e.link = &l
+				}
+			}
+			if t.Name.Local == "title" && len(open) > 0 {
+				if l := open[len(open)-1].link; l != nil && l.Title == "" {
+					e.titleOf = l
+				}
+			}
+			open = append(open, e)
+		case xml.CharData:
+			if len(open) > 0 && open[len(open)-1].titleOf != nil {
+				open[len(open)-1].titleOf.Title += string(t)
+			}
+		case xml.EndElement:
+			if len(open) == 0 {
+				continue
+			}
+			if l := open[len(open)-1].titleOf; l != nil {
+				l.Title = strings.Join(strings.Fields(l.Title), " ")
+			}
+			if open[len(open)-1].hidden {
+				hidden--
+			}
+			if l := open[len(open)-1].link; l != nil && l.ID == "" {
+				if len(l.Aliases) == 0 && !l.Valid && len(l.Descendants) == 0 {
+					for i := range links {
+						if links[i] == l {
+							links = append(links[:i], links[i+1:]...)
+							break
+						}
+					}
+					if onSkip != nil {
+						onSkip(l, "has no id")
+					}
+				} else {
+					l.ID, l.SyntheticID = syntheticID(l.URL, synthetic[l.URL]), true
+					synthetic[l.URL]++
+				}
+			}
+			open = open[:len(open)-1]
+		}
+	}
+}
+
+// DuplicateIDs returns the ids that more than one element in the SVG has, in
+// the order they're first repeated
+func DuplicateIDs(r io.Reader) ([]string, error) {
+	d := newSVGDecoder(r)
+	count := map[string]int{}
+	var dups []string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return dups, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := t.(xml.StartElement); ok {
+			if id := elementID(t); id != "" {
+				if count[id]++; count[id] == 2 {
+					dups = append(dups, id)
+				}
+			}
+		}
+	}
+}
+
+// Viewport maps SVG user units, in which inkscape reports bounding boxes, to
+// PDF points relative to the top left of the page
+type Viewport struct {
+	// X position of the page's left edge in user units
+	X float64
+
+	// Y position of the page's top edge in user units
+	Y float64
+
+	// Scale is the number of points per user unit
+	Scale float64
+}
+
+// CSS pixels, which SVG user units are when not scaled by a viewBox, and PDF
+// points are both fixed fractions of an inch. The export DPI only decides the
+// resolution filters are rasterized at and has no bearing on either.
+const (
+	pixelsPerInch = 96.0
+	pointsPerInch = 72.0
+)
+
+// DefaultViewport is used when the SVG root doesn't tell us any better: one
+// user unit is one pixel, i.e. 0.75 points
+var DefaultViewport = &Viewport{Scale: pointsPerInch / pixelsPerInch}
+
+// parseSVGLength parses an absolute length (unitless, px, pt, pc, mm, cm or in)
+// into pixels. Relative lengths such as percentages aren't known.
+func parseSVGLength(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	n := leadingNumberRegexp.FindString(s)
+	unit, ok := svgUnits[strings.TrimSpace(s[len(n):])]
+	if n == "" || !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(n, 64)
+	return v * unit, err == nil && v > 0
+}
+
+// ParseSVGViewport determines the viewport from the root svg element's width,
+// height and viewBox. When there is only a viewBox, its dimensions are taken
+// to be the size of the page in pixels, which is what inkscape does. When
+// width and height are given along with a viewBox, the viewBox is scaled
+// uniformly to fit and centered. Width and height may be in any absolute unit,
+// e.g. 210mm, as inkscape uses for paper sizes. An unusable viewBox is
+// ignored, in which case DefaultViewport is returned along with an error
+// saying why.
+func ParseSVGViewport(svg string) (*Viewport, error) {
+	root := svgRootRegexp.FindString(svg)
+	viewBox, ok := rootAttr(viewBoxRegexp, root)
+	if !ok {
+		return DefaultViewport, nil
+	}
+	f := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' })
+	if len(f) != 4 {
+		return DefaultViewport, fmt.Errorf("invalid viewBox '%s'", viewBox)
+	}
+	var vb [4]float64
+	for i := range f {
+		var err error
+		if vb[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+			return DefaultViewport, fmt.Errorf("invalid viewBox '%s'", viewBox)
+		}
+	}
+	if vb[2] <= 0 || vb[3] <= 0 {
+		return DefaultViewport, fmt.Errorf("viewBox '%s' has no area", viewBox)
+	}
+
+	vp := Viewport{X: vb[0], Y: vb[1], Scale: DefaultViewport.Scale}
+	var w, h float64
+	var wOk, hOk bool
+	if m, ok := rootAttr(widthRegexp, root); ok {
+		w, wOk = parseSVGLength(m)
+	}
+	if m, ok := rootAttr(heightRegexp, root); ok {
+		h, hOk = parseSVGLength(m)
+	}
+	switch {
+	case wOk && hOk:
+		// The viewBox is centered on the page (xMidYMid meet)
+		s := math.Min(w/vb[2], h/vb[3])
+		vp.Scale *= s
+		vp.X -= (w/s - vb[2]) / 2
+		vp.Y -= (h/s - vb[3]) / 2
+	case wOk:
+		vp.Scale *= w / vb[2]
+	case hOk:
+		vp.Scale *= h / vb[3]
+	}
+	return &vp, nil
+}
+
+// ParseSVGSize returns the size of the page in points as given by the root
+// svg element's width and height, or its viewBox if either is missing. ok is
+// false if the SVG doesn't say.
+func ParseSVGSize(svg string) (w, h float64, ok bool) {
+	root := svgRootRegexp.FindString(svg)
+	var wOk, hOk bool
+	if m, ok := rootAttr(widthRegexp, root); ok {
+		w, wOk = parseSVGLength(m)
+	}
+	if m, ok := rootAttr(heightRegexp, root); ok {
+		h, hOk = parseSVGLength(m)
+	}
+	if wOk && hOk {
+		return w * DefaultViewport.Scale, h * DefaultViewport.Scale, true
+	}
+	viewBox, ok := rootAttr(viewBoxRegexp, root)
+	if !ok {
+		return 0, 0, false
+	}
+	vp, err := ParseSVGViewport(svg)
+	if err != nil {
+		return 0, 0, false
+	}
+	f := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' })
+	vw, _ := strconv.ParseFloat(f[2], 64)
+	vh, _ := strconv.ParseFloat(f[3], 64)
+	return vw * vp.Scale, vh * vp.Scale, true
+}
+
+// ParseSVGPages returns the viewport of each page of a multi-page document,
+// as created by inkscape 1.2 and later, given vp, the viewport of the first
+// page. The other pages are offset from the first by their position on the
+// canvas. nil is returned for documents with a single page.
+func ParseSVGPages(svg string, vp *Viewport) ([]*Viewport, error) {
+	tags := pageRegexp.FindAllString(svg, -1)
+	if len(tags) < 2 {
+		return nil, nil
+	}
+	var vps []*Viewport
+	var x0, y0 float64
+	for i, tag := range tags {
+		x, errX := pageCoord(xRegexp, tag)
+		y, errY := pageCoord(yRegexp, tag)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid position of page %d", i+1)
+		}
+		if i == 0 {
+			x0, y0 = x, y
+		}
+		vps = append(vps, &Viewport{X: vp.X + x - x0, Y: vp.Y + y - y0, Scale: vp.Scale})
+	}
+	return vps, nil
+}
+
+// pageCoord parses the coordinate attribute matched by re in the tag of an
+// inkscape page, which defaults to 0
+func pageCoord(re *regexp.Regexp, tag string) (float64, error) {
+	m, ok := rootAttr(re, tag)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(m), 64)
+}
+
+// PageSizes maps the names of common page sizes to their width and height in
+// points
+var PageSizes = map[string][2]float64{
+	"a3":     {841.89, 1190.55},
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// ParsePageSize returns the width and height in points of a page size given
+// either by one of the names in PageSizes or explicitly as WxH in points,
+// e.g. 612x792
+func ParsePageSize(s string) (w, h float64, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if dims, ok := PageSizes[s]; ok {
+		return dims[0], dims[1], nil
+	}
+	i := strings.IndexByte(s, 'x')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("unknown page size '%s'", s)
+	}
+	w, werr := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+	h, herr := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+	if werr != nil || herr != nil || !(w > 0) || !(h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, 0, fmt.Errorf("page size '%s' isn't WxH with a positive width and height in points", s)
+	}
+	return w, h, nil
+}
+
+// ResizeSVG returns the SVG with the root element's width and height set to
+// the given size in points. The content is scaled to fit the new size through
+// the viewBox, which is added if the root doesn't have one already.
+func ResizeSVG(svg string, w, h float64) (string, error) {
+	loc := svgRootRegexp.FindStringIndex(svg)
+	if loc == nil {
+		return "", fmt.Errorf("cannot find root svg element")
+	}
+	root := svg[loc[0]:loc[1]]
+	if !viewBoxRegexp.MatchString(root) {
+		var origW, origH float64
+		var wOk, hOk bool
+		if m, ok := rootAttr(widthRegexp, root); ok {
+			origW, wOk = parseSVGLength(m)
+		}
+		if m, ok := rootAttr(heightRegexp, root); ok {
+			origH, hOk = parseSVGLength(m)
+		}
+		if !wOk || !hOk {
+			return "", fmt.Errorf("cannot resize SVG without a viewBox or absolute width and height")
+		}
+		root = strings.Replace(root, "<svg", fmt.Sprintf(`<svg viewBox="0 0 %g %g"`, origW, origH), 1)
+	}
+	root = widthRegexp.ReplaceAllString(root, "")
+	root = heightRegexp.ReplaceAllString(root, "")
+	root = strings.Replace(root, "<svg", fmt.Sprintf(`<svg width="%g" height="%g"`,
+		w/DefaultViewport.Scale, h/DefaultViewport.Scale), 1)
+	return svg[:loc[0]] + root + svg[loc[1]:], nil
+}
+
+// ScaleSVG returns the SVG with its size multiplied by s, as ResizeSVG does
+func ScaleSVG(svg string, s float64) (string, error) {
+	w, h, ok := ParseSVGSize(svg)
+	if !ok {
+		return "", fmt.Errorf("cannot scale SVG without a size")
+	}
+	return ResizeSVG(svg, w*s, h*s)
+}
+
+// HighlightSVG returns the SVG with a rectangle drawn at each of the links as
+// given by hl, so the highlight becomes part of the rendered page rather than
+// an appearance of the link annotation. The rectangles are the first children
+// of the root element so they're drawn behind everything else, and their
+// position is in the root's user units as the links' are. vp is the viewport
+// of the SVG, which the corner radius in points is converted with.
+func HighlightSVG(svg string, links []*PositionedLink, hl *Highlight, vp *Viewport) (string, error) {
+	loc := svgRootRegexp.FindStringIndex(svg)
+	if loc == nil || strings.HasSuffix(svg[loc[0]:loc[1]], "/>") {
+		return "", fmt.Errorf("cannot find root svg element")
+	}
+	c := hl.Color
+	fill := fmt.Sprintf("#%02x%02x%02x", int(math.Round(c[0]*255)), int(math.Round(c[1]*255)), int(math.Round(c[2]*255)))
+	b := strings.Builder{}
+	for _, l := range links {
+		r := math.Min(hl.Radius/vp.Scale, math.Min(l.W, l.H)/2)
+		fmt.Fprintf(&b, `<rect x="%g" y="%g" width="%g" height="%g" rx="%g" fill="%s" fill-opacity="%g" stroke="none"/>`,
+			l.X, l.Y, l.W, l.H, math.Max(r, 0), fill, hl.Opacity)
+	}
+	return svg[:loc[1]] + b.String() + svg[loc[1]:], nil
+}
@@ -0,0 +1,403 @@
+package linkify
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestScanAnchorsMaxLinks(t *testing.T) {
+	svg := `<svg><a id="a" href="#x"/><a id="b" href="#y"/><a id="c" href="#z"/></svg>`
+	if _, err := ScanAnchors(strings.NewReader(svg), 2, nil); err == nil || !strings.Contains(err.Error(), "more than 2 links") {
+		t.Errorf("expected the limit of 2 links to be exceeded, got %v", err)
+	}
+	for _, max := range []int{0, 3} {
+		links, err := ScanAnchors(strings.NewReader(svg), max, nil)
+		if err != nil {
+			t.Fatalf("max %d: %s", max, err)
+		}
+		if len(links) != 3 {
+			t.Errorf("max %d: got %d links, want 3", max, len(links))
+		}
+	}
+}
+
+func TestViewBoxOnlyPlacement(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="10 20 200 100">` +
+		`<a id="l" href="https://example.com/"><rect x="10" y="20" width="100" height="50"/></a></svg>`
+	vp, err := ParseSVGViewport(svg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *vp != (Viewport{X: 10, Y: 20, Scale: 0.75}) {
+		t.Errorf("got viewport %+v", *vp)
+	}
+	if w, h, ok := ParseSVGSize(svg); !ok || w != 150 || h != 75 {
+		t.Errorf("got size %gx%g (%t), want 150x75", w, h, ok)
+	}
+	l := &PositionedLink{URL: "https://example.com/", X: 10, Y: 20, W: 100, H: 50, Valid: true}
+	rects, err := LinkRects(bytes.NewReader(pagePDF("/MediaBox [ 0 0 150 75 ]")), nil, []*PositionedLink{l}, &Options{Viewport: vp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rects[l]; r == nil || r.Rect != [4]float64{0, 37.5, 75, 75} {
+		t.Errorf("got link at %+v, want [ 0 37.5 75 75 ]", r)
+	}
+}
+
+func TestScanAnchorsHidden(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">
+<defs><clipPath id="clip"><a id="in-clip" href="https://a.example/"><rect width="5" height="5"/></a></clipPath></defs>
+<mask id="m"><g><a id="in-mask" href="https://b.example/"><rect width="5" height="5"/></a></g></mask>
+<a id="shown" href="https://c.example/"><rect width="5" height="5"/></a>
+</svg>`
+	var skipped []string
+	links, err := ScanAnchors(strings.NewReader(svg), 0, func(l *PositionedLink, reason string) {
+		skipped = append(skipped, l.ID+" "+reason)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].ID != "shown" {
+		t.Errorf("got links %+v, want only 'shown'", links)
+	}
+	want := []string{"in-clip is inside a hidden element", "in-mask is inside a hidden element"}
+	if strings.Join(skipped, "\n") != strings.Join(want, "\n") {
+		t.Errorf("skipped %q, want %q", skipped, want)
+	}
+}
+
+func TestScanAnchorsXlinkHref(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+<a id="old" xlink:href="https://example.com/"><rect width="5" height="5"/></a>
+<a id="both" xlink:href="https://old.example/" href="https://new.example/"><rect width="5" height="5"/></a>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"old": "https://example.com/", "both": "https://new.example/"}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d", len(links), len(want))
+	}
+	for _, l := range links {
+		if l.URL != want[l.ID] {
+			t.Errorf("link '%s' goes to '%s', want '%s'", l.ID, l.URL, want[l.ID])
+		}
+		l.X, l.Y, l.W, l.H, l.Valid = 10, 10, 50, 20, true
+	}
+	annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, links[:1], nil), 0)
+	if len(annots) != 1 || annots[0].Action != "URI" || annots[0].URI != "https://example.com/" {
+		t.Errorf("got annotations %v, want the xlink:href URI", annots)
+	}
+}
+
+func TestScanAnchorsQuotes(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">
+<a href='https://example.com/?q="x"' id='single'><rect width="5" height="5"/></a>
+<a href="https://example.com/it's" id='mixed'><rect width="5" height="5"/></a>
+<a id="double" href="#single"><rect width="5" height="5"/></a>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"single", `https://example.com/?q="x"`},
+		{"mixed", "https://example.com/it's"},
+		{"double", "#single"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d", len(links), len(want))
+	}
+	for i, l := range links {
+		if [2]string{l.ID, l.URL} != want[i] {
+			t.Errorf("got link '%s' to '%s', want '%s' to '%s'", l.ID, l.URL, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestScanAnchorsAttributeLayout(t *testing.T) {
+	for _, tag := range []string{
+		`<a id="x" href="y">`,
+		`<a href="y" id="x">`,
+		"<a\n href=\"y\"\n id=\"x\">",
+		"<a\tid=\"x\"\thref=\"y\"\t>",
+		"<a id = \"x\"\r\n\thref = \"y\">",
+	} {
+		svg := `<svg xmlns="http://www.w3.org/2000/svg">` + tag + `<rect id="other" width="5" height="5"/></a></svg>`
+		links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+		if err != nil {
+			t.Errorf("%q: %s", tag, err)
+			continue
+		}
+		if len(links) != 1 || links[0].ID != "x" || links[0].URL != "y" {
+			t.Errorf("%q: got %+v, want one link 'x' to 'y'", tag, links)
+		}
+	}
+}
+
+func TestLinkTitle(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">
+<a id="attr" href="https://a.example/" title="Price (incl. tax) \ VAT"><rect width="5" height="5"/></a>
+<a id="elem" href="https://b.example/"><title>Café menu</title><rect width="5" height="5"/></a>
+<a id="none" href="https://c.example/"><rect width="5" height="5"/></a>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`Price (incl. tax) \ VAT`, "Café menu", ""}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d", len(links), len(want))
+	}
+	for i, l := range links {
+		if l.Title != want[i] {
+			t.Errorf("link '%s' has title %q, want %q", l.ID, l.Title, want[i])
+		}
+		l.X, l.Y, l.W, l.H, l.Valid = float64(i)*10, 10, 5, 5, true
+	}
+	f := addLinks(t, testPDF(onePage...), nil, links, nil)
+	_, annots := annotDicts(t, f, 0)
+	if len(annots) != len(want) {
+		t.Fatalf("got %d annotations, want %d", len(annots), len(want))
+	}
+	for i, a := range annots {
+		got, _ := a["Contents"].(string)
+		if want[i] == "" {
+			if _, ok := a["Contents"]; ok {
+				t.Errorf("link '%s' has /Contents %q, want none", links[i].ID, got)
+			}
+			continue
+		}
+		// Non-ASCII text is UTF-16BE with a byte order mark
+		if i == 1 {
+			got = decodeUTF16(t, got)
+		}
+		if got != want[i] {
+			t.Errorf("link '%s' has /Contents %q, want %q", links[i].ID, got, want[i])
+		}
+	}
+}
+
+// decodeUTF16 decodes a PDF text string in UTF-16BE with a byte order mark
+func decodeUTF16(t *testing.T, s string) string {
+	t.Helper()
+	if !strings.HasPrefix(s, "\xfe\xff") || len(s)%2 != 0 {
+		t.Fatalf("%q is not UTF-16BE with a byte order mark", s)
+	}
+	var u []uint16
+	for i := 2; i < len(s); i += 2 {
+		u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	return string(utf16.Decode(u))
+}
+
+func TestUserUnitDPI(t *testing.T) {
+	// Documents drawn at 72, 96 and 300 user units per inch, each 2 by 1
+	// inches
+	for _, c := range []struct {
+		dpi  float64
+		root string
+	}{
+		{72, `<svg xmlns="http://www.w3.org/2000/svg" width="144pt" height="72pt" viewBox="0 0 144 72">`},
+		{96, `<svg xmlns="http://www.w3.org/2000/svg" width="192" height="96">`},
+		{300, `<svg xmlns="http://www.w3.org/2000/svg" width="2in" height="1in" viewBox="0 0 600 300">`},
+	} {
+		vp, err := ParseSVGViewport(c.root + "</svg>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 72 / c.dpi; math.Abs(vp.Scale-want) > 1e-9 {
+			t.Errorf("%g dpi: got scale %g, want %g", c.dpi, vp.Scale, want)
+		}
+
+		// A link over the right half inch of the page, all the way down
+		l := &PositionedLink{URL: "https://example.com/", X: 1.5 * c.dpi, Y: 0, W: c.dpi / 2, H: c.dpi, Valid: true}
+		rects, err := LinkRects(bytes.NewReader(pagePDF("/MediaBox [ 0 0 144 72 ]")), nil, []*PositionedLink{l}, &Options{Viewport: vp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rects[l]
+		want := [4]float64{108, 0, 144, 72}
+		for i := range want {
+			if r == nil || math.Abs(r.Rect[i]-want[i]) > 1e-9 {
+				t.Errorf("%g dpi: link is at %+v, want %v", c.dpi, r, want)
+				break
+			}
+		}
+	}
+}
+
+func TestViewBoxUnits(t *testing.T) {
+	const mm = 72 / 25.4
+	for _, c := range []struct {
+		name, root string
+		w, h       float64
+	}{
+		// A4 in mm with user units of 1mm
+		{"mm", `<svg xmlns="http://www.w3.org/2000/svg" width="210mm" height="297mm" viewBox="0 0 210 297">`, 210 * mm, 297 * mm},
+		// The same in cm, still with user units of 1mm
+		{"cm", `<svg xmlns="http://www.w3.org/2000/svg" width="21cm" height="29.7cm" viewBox="0 0 210 297">`, 210 * mm, 297 * mm},
+		// Unitless sizes are pixels, here 2 to a user unit
+		{"unitless", `<svg xmlns="http://www.w3.org/2000/svg" width="420" height="594" viewBox="0 0 210 297">`, 315, 445.5},
+	} {
+		svg := c.root + "</svg>"
+		w, h, ok := ParseSVGSize(svg)
+		if !ok || math.Abs(w-c.w) > 1e-6 || math.Abs(h-c.h) > 1e-6 {
+			t.Errorf("%s: got size %gx%g (%t), want %gx%g", c.name, w, h, ok, c.w, c.h)
+		}
+		vp, err := ParseSVGViewport(svg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A link over the top left quarter of the page
+		l := &PositionedLink{URL: "https://example.com/", X: 0, Y: 0, W: 105, H: 148.5, Valid: true}
+		page := fmt.Sprintf("/MediaBox [ 0 0 %f %f ]", c.w, c.h)
+		rects, err := LinkRects(bytes.NewReader(pagePDF(page)), nil, []*PositionedLink{l}, &Options{Viewport: vp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rects[l]
+		want := [4]float64{0, c.h / 2, c.w / 2, c.h}
+		for i := range want {
+			if r == nil || math.Abs(r.Rect[i]-want[i]) > 1e-3 {
+				t.Errorf("%s: link is at %+v, want %v", c.name, r, want)
+				break
+			}
+		}
+	}
+}
+
+func TestDataLinkRect(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"><a id="a" href="https://example.com/" data-link-rect="10, 20,30.5,40"><rect/></a></svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("got %d links, want 1", len(links))
+	}
+	if l := links[0]; !l.Valid || l.X != 10 || l.Y != 20 || l.W != 30.5 || l.H != 40 {
+		t.Errorf("link is %+v, want a valid 10,20 30.5x40 rect", l)
+	}
+
+	for _, v := range []string{"10,20,30", "10,20,30,40,50", "a,b,c,d", "10,20,0,40", "10,20,30,-1", "10;20;30;40"} {
+		svg := `<svg xmlns="http://www.w3.org/2000/svg"><a href="https://example.com/" data-link-rect="` + v + `"/></svg>`
+		_, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+		if err == nil || !strings.Contains(err.Error(), "invalid data-link-rect '"+v+"'") {
+			t.Errorf("%q: got error %v, want invalid data-link-rect", v, err)
+		}
+	}
+}
+
+func TestScanAnchorsWithoutID(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg">
+<a href="https://example.com/"><rect id="r1"/></a>
+<a href="https://example.com/"><rect id="r2"/></a>
+<a href="https://example.org/"><g><rect id="r3"/></g></a>
+<a href="https://example.net/"><rect/></a>
+</svg>`
+	var skipped []string
+	scan := func() []*PositionedLink {
+		skipped = nil
+		links, err := ScanAnchors(strings.NewReader(svg), 0, func(l *PositionedLink, reason string) {
+			skipped = append(skipped, l.URL+" "+reason)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return links
+	}
+	links := scan()
+	if len(links) != 3 {
+		t.Fatalf("got %d links, want 3", len(links))
+	}
+	ids := map[string]bool{}
+	for i, want := range []string{"r1", "r2", "r3"} {
+		l := links[i]
+		if !l.SyntheticID || !strings.HasPrefix(l.ID, "svglinkify-") || ids[l.ID] {
+			t.Errorf("link %d has id '%s' (synthetic %t), want a new synthetic one", i, l.ID, l.SyntheticID)
+		}
+		ids[l.ID] = true
+		if len(l.Descendants) != 1 || l.Descendants[0] != want {
+			t.Errorf("link %d wraps %q, want %s", i, l.Descendants, want)
+		}
+	}
+	if len(skipped) != 1 || skipped[0] != "https://example.net/ has no id" {
+		t.Errorf("skipped %q, want the anchor wrapping nothing with an id", skipped)
+	}
+
+	// The same SVG gives the same ids
+	for i, l := range scan() {
+		if l.ID != links[i].ID {
+			t.Errorf("link %d has id '%s', then '%s'", i, links[i].ID, l.ID)
+		}
+	}
+}
+
+func TestScanAnchorsTarget(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+<a id="a1" href="https://example.com/" target="_blank"/>
+<a id="a2" xlink:href="https://example.com/" xlink:show="new"/>
+<a id="a3" href="https://example.com/" target="_self"/>
+<a id="a4" href="https://example.com/"/>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{true, true, false, false}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d", len(links), len(want))
+	}
+	for i, l := range links {
+		if l.NewWindow != want[i] {
+			t.Errorf("%s: new window is %t, want %t", l.ID, l.NewWindow, want[i])
+		}
+	}
+}
+
+func TestDuplicateIDs(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+<g id="b"><rect id="a"/><rect id="c"/></g>
+<rect id="a"/><rect id="b"/><rect id="a"/><rect/><rect/>
+</svg>`
+	dups, err := DuplicateIDs(strings.NewReader(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(dups, " "); got != "a b" {
+		t.Errorf("got %s, want a b", got)
+	}
+}
+
+func TestScanAnchorsEntities(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg">
+<a id="a1" href="https://example.com/?a=1&amp;b=2"/>
+<a id="a2" href="&#35;foo"/>
+<a id="a3" href="https://example.com/&quot;q&quot;"/>
+<a id="a4" href="https://example.com/a&nbsp;b"/>
+</svg>`
+	links, err := ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://example.com/?a=1&b=2", "#foo", `https://example.com/"q"`, "https://example.com/a\u00a0b"}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d", len(links), len(want))
+	}
+	for i, l := range links {
+		if l.URL != want[i] {
+			t.Errorf("%s: got %q, want %q", l.ID, l.URL, want[i])
+		}
+	}
+	// The decoded # makes it an internal link
+	if f := links[1].BareFragment(); f != "foo" {
+		t.Errorf("got fragment %q of %q, want foo", f, links[1].URL)
+	}
+}
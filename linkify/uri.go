@@ -0,0 +1,68 @@
+package linkify
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	uriSchemeRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+	telRegexp       = regexp.MustCompile(`^\+?[0-9()./ -]*[0-9][0-9()./ -]*(;[^;]+)*$`)
+)
+
+// ignoredURISchemes are schemes which PDF viewers refuse to open from links
+var ignoredURISchemes = map[string]bool{
+	"data":       true,
+	"javascript": true,
+	"vbscript":   true,
+}
+
+// uriScheme returns the scheme of the URI in lower case, or the empty string
+// if it doesn't have a valid one
+func uriScheme(uri string) string {
+	m := uriSchemeRegexp.FindStringSubmatch(uri)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(m[1])
+}
+
+// normalizeURI lower cases the scheme of the URI and, for mailto, turns bare
+// line breaks in its fields into CRLF as mail clients expect
+func normalizeURI(uri string) string {
+	scheme := uriScheme(uri)
+	if scheme == "" {
+		return uri
+	}
+	uri = scheme + uri[len(scheme):]
+	if scheme == "mailto" {
+		uri = strings.Replace(strings.Replace(uri, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	}
+	return uri
+}
+
+// URIWarning returns why PDF viewers may not open the URI of an external link
+// as intended, or the empty string if there's no reason to expect trouble
+func URIWarning(uri string) string {
+	scheme := uriScheme(uri)
+	if scheme == "" {
+		return "has no scheme, so viewers will resolve it against wherever the PDF is"
+	}
+	if ignoredURISchemes[scheme] {
+		return "uses the " + scheme + ": scheme which PDF viewers ignore"
+	}
+	rest := uri[len(scheme)+1:]
+	switch scheme {
+	case "mailto":
+		// The address may also be given as a to field instead
+		to := strings.SplitN(rest, "?", 2)
+		if strings.TrimSpace(to[0]) == "" && (len(to) == 1 || !strings.Contains("&"+to[1], "&to=")) {
+			return "has no address"
+		}
+	case "tel":
+		if !telRegexp.MatchString(rest) {
+			return "is not a valid phone number"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+package linkify
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailtoAndTel(t *testing.T) {
+	for _, u := range []string{"mailto:a@b.com?subject=Hi", "tel:+15551234"} {
+		if w := URIWarning(u); w != "" {
+			t.Errorf("%s: got warning '%s'", u, w)
+		}
+		l := &PositionedLink{URL: u, X: 10, Y: 10, W: 50, H: 20, Valid: true}
+		annots := readAnnots(t, addLinks(t, testPDF(onePage...), nil, []*PositionedLink{l}, nil), 0)
+		if len(annots) != 1 || annots[0].Action != "URI" || annots[0].URI != u {
+			t.Errorf("got %v, want a /URI action to %s", annots, u)
+		}
+	}
+
+	// Schemes are lower cased and mail fields get CRLF line breaks
+	if got, want := normalizeURI("MAILTO:a@b.com?body=a\nb"), "mailto:a@b.com?body=a\r\nb"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, c := range []struct {
+		uri, warning string
+	}{
+		{"mailto:?to=a@b.com", ""},
+		{"tel:+1 (555) 123-4;ext=5", ""},
+		{"mailto:?subject=Hi", "has no address"},
+		{"tel:call-me", "is not a valid phone number"},
+		{"javascript:alert(1)", "uses the javascript: scheme which PDF viewers ignore"},
+		{"example.com/page", "has no scheme"},
+	} {
+		if w := URIWarning(c.uri); (c.warning == "") != (w == "") || !strings.HasPrefix(w, c.warning) {
+			t.Errorf("%s: got warning '%s', want '%s'", c.uri, w, c.warning)
+		}
+	}
+}
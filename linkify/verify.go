@@ -0,0 +1,381 @@
+package linkify
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// pdfObjHeaderRegexp matches the start of an object, which must be right where
+// the xref says it is
+var pdfObjHeaderRegexp = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+obj\b`)
+
+// rectTolerance is the largest difference in points between two rectangle
+// coordinates for them to be considered the same
+const rectTolerance = 0.1
+
+// PDFLinkAnnot is a link annotation as read from a PDF page
+type PDFLinkAnnot struct {
+	// Rect is the normalized rectangle of the annotation (llx, lly, urx, ury)
+	Rect [4]float64
+
+	// Action is the /S type of the link action, e.g. URI or GoTo
+	Action string
+
+	// URI is the target of a URI action, the file of a GoToR or Launch
+	// action, or the name of the attachment a GoToE action goes to
+	URI string
+
+	// NewWindow is the /NewWindow flag of a GoToR, GoToE or Launch action
+	NewWindow bool
+
+	// Dest is the destination of a GoTo, GoToR or GoToE action or the name
+	// of a Named action
+	Dest interface{}
+}
+
+func (a *PDFLinkAnnot) String() string {
+	target := a.URI
+	switch a.Action {
+	case "URI", "Launch":
+	case "GoToR", "GoToE":
+		target = a.URI + " " + fmt.Sprint(a.Dest)
+	default:
+		target = fmt.Sprint(a.Dest)
+	}
+	if a.NewWindow {
+		target += " (new window)"
+	}
+	return fmt.Sprintf("%s %s [ %.2f %.2f %.2f %.2f ]",
+		a.Action, target, a.Rect[0], a.Rect[1], a.Rect[2], a.Rect[3])
+}
+
+// Matches reports whether both annotations have the same rectangle and action
+func (a *PDFLinkAnnot) Matches(o *PDFLinkAnnot) bool {
+	for i := range a.Rect {
+		if math.Abs(a.Rect[i]-o.Rect[i]) > rectTolerance {
+			return false
+		}
+	}
+	return a.Action == o.Action && a.URI == o.URI && a.NewWindow == o.NewWindow && pdfValuesMatch(a.Dest, o.Dest)
+}
+
+func pdfValuesMatch(a, b interface{}) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && math.Abs(a-b) <= rectTolerance
+	case *PDFObjRef:
+		b, ok := b.(*PDFObjRef)
+		return ok && *a == *b
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !pdfValuesMatch(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// resolvePDFValue follows v if it's an indirect reference
+func resolvePDFValue(f io.ReadSeeker, xref *PDFXref, v interface{}) (interface{}, error) {
+	ref, ok := v.(*PDFObjRef)
+	if !ok {
+		return v, nil
+	}
+	s, err := xref.ReadObj(f, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePDFValue(s)
+}
+
+// parseLinkAnnot converts a parsed annotation dictionary into a
+// PDFLinkAnnot, returning nil if the annotation isn't a link
+func parseLinkAnnot(f io.ReadSeeker, xref *PDFXref, annot map[PDFName]interface{}) (*PDFLinkAnnot, error) {
+	if annot["Subtype"] != PDFName("Link") {
+		return nil, nil
+	}
+	a := PDFLinkAnnot{}
+	rect, ok := annot["Rect"].([]interface{})
+	if !ok || len(rect) != 4 {
+		return nil, fmt.Errorf("link annotation has invalid /Rect")
+	}
+	for i, v := range rect {
+		if a.Rect[i], ok = v.(float64); !ok {
+			return nil, fmt.Errorf("link annotation has invalid /Rect")
+		}
+	}
+	a.Rect[0], a.Rect[2] = math.Min(a.Rect[0], a.Rect[2]), math.Max(a.Rect[0], a.Rect[2])
+	a.Rect[1], a.Rect[3] = math.Min(a.Rect[1], a.Rect[3]), math.Max(a.Rect[1], a.Rect[3])
+
+	v, err := resolvePDFValue(f, xref, annot["A"])
+	if err != nil {
+		return nil, err
+	}
+	if action, ok := v.(map[PDFName]interface{}); ok {
+		s, _ := action["S"].(PDFName)
+		a.Action = string(s)
+		a.URI, _ = action["URI"].(string)
+		if a.Action == "GoToR" || a.Action == "Launch" {
+			a.URI, _ = action["F"].(string)
+		}
+		if a.Action == "GoToE" {
+			if t, ok := action["T"].(map[PDFName]interface{}); ok {
+				a.URI, _ = t["N"].(string)
+			}
+		}
+		a.NewWindow = action["NewWindow"] == PDFKeyword("true")
+		if a.Dest, err = resolvePDFValue(f, xref, action["D"]); err != nil {
+			return nil, err
+		}
+		if a.Action == "Named" {
+			a.Dest = action["N"]
+		}
+	} else if dest, ok := annot["Dest"]; ok {
+		// Destination given directly on the annotation
+		a.Action = "GoTo"
+		if a.Dest, err = resolvePDFValue(f, xref, dest); err != nil {
+			return nil, err
+		}
+	}
+	return &a, nil
+}
+
+// ReadLinkAnnots returns all the link annotations on the given page of the
+// PDF, counting from 0
+func (p *PDFFile) ReadLinkAnnots(f io.ReadSeeker, page int) ([]*PDFLinkAnnot, error) {
+	v, err := ParsePDFValue(p.Kids[page].Raw)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[PDFName]interface{})
+	if !ok {
+		return nil, fmt.Errorf("PDF page is not a dictionary")
+	}
+	v, err = resolvePDFValue(f, p.Xref, dict["Annots"])
+	if err != nil {
+		return nil, err
+	}
+	annots, _ := v.([]interface{})
+
+	links := []*PDFLinkAnnot{}
+	for _, av := range annots {
+		if av, err = resolvePDFValue(f, p.Xref, av); err != nil {
+			return nil, err
+		}
+		annot, ok := av.(map[PDFName]interface{})
+		if !ok {
+			return nil, fmt.Errorf("PDF annotation is not a dictionary")
+		}
+		l, err := parseLinkAnnot(f, p.Xref, annot)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			continue
+		}
+		if name, ok := l.Dest.(string); ok && l.Action == "GoTo" {
+			if l.Dest, err = p.namedDest(f, name); err != nil {
+				return nil, err
+			}
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// namedDest looks up the destination with the given name in the /Dests name
+// tree of the catalog, returning nil if there's no such destination
+func (p *PDFFile) namedDest(f io.ReadSeeker, name string) (interface{}, error) {
+	v, err := ParsePDFValue(p.Catalog.Raw)
+	if err != nil {
+		return nil, err
+	}
+	catalog, _ := v.(map[PDFName]interface{})
+	if v, err = resolvePDFValue(f, p.Xref, catalog["Names"]); err != nil {
+		return nil, err
+	}
+	names, _ := v.(map[PDFName]interface{})
+	return p.findInNameTree(f, names["Dests"], name, 0)
+}
+
+// findInNameTree returns the value for key in the name tree node, following
+// its kids up to a sane depth
+func (p *PDFFile) findInNameTree(f io.ReadSeeker, node interface{}, key string, depth int) (interface{}, error) {
+	if depth > 32 {
+		return nil, fmt.Errorf("PDF name tree is too deep")
+	}
+	v, err := resolvePDFValue(f, p.Xref, node)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := v.(map[PDFName]interface{})
+	pairs, _ := n["Names"].([]interface{})
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] != key {
+			continue
+		}
+		dest, err := resolvePDFValue(f, p.Xref, pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := dest.(map[PDFName]interface{}); ok {
+			return resolvePDFValue(f, p.Xref, d["D"])
+		}
+		return dest, nil
+	}
+	kids, _ := n["Kids"].([]interface{})
+	for _, k := range kids {
+		if dest, err := p.findInNameTree(f, k, key, depth+1); dest != nil || err != nil {
+			return dest, err
+		}
+	}
+	return nil, nil
+}
+
+// VerifyLinks compares the link annotations in the PDF f against the links
+// derived from the SVG and writes a report to w. It returns false if any of
+// the links are missing from the PDF. Named destinations are resolved, so
+// opts.NamedDests doesn't matter, and opts.Highlight and opts.OnLinkError
+// aren't used.
+func VerifyLinks(w io.Writer, f io.ReadSeeker, allObjects map[string]*PositionedObject, links []*PositionedLink, opts *Options) (bool, error) {
+	opts = opts.withDefaults()
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		return false, err
+	}
+
+	// Derive the annotations we would have written for each page and read
+	// them back so they're comparable with what's in the PDF
+
+	ok := true
+	vopts := *opts
+	vopts.NamedDests = false
+	vopts.OnLinkError = func(e *LinkError) error {
+		ok = false
+		fmt.Fprintf(w, "%-8s %s\n", "invalid", e.Link.URL)
+		return nil
+	}
+	if err := pdf.setupPages(allObjects, links, &vopts); err != nil {
+		return false, err
+	}
+
+	for pi, page := range pdf.Kids {
+		found, err := pdf.ReadLinkAnnots(f, pi)
+		if err != nil {
+			return false, err
+		}
+		matched := make([]bool, len(found))
+
+		for _, l := range page.Links {
+			annot, lerr := page.marshalLink(l, nil)
+			v, err := ParsePDFValue(annot)
+			if lerr != nil || err != nil {
+				// We can't build a valid annotation for this link ourselves
+				ok = false
+				fmt.Fprintf(w, "%-8s %s\n", "invalid", l.URL)
+				continue
+			}
+			want, err := parseLinkAnnot(f, pdf.Xref, v.(map[PDFName]interface{}))
+			if err != nil {
+				return false, err
+			}
+			status := "missing"
+			for i, a := range found {
+				if !matched[i] && want.Matches(a) {
+					matched[i] = true
+					status = "ok"
+					break
+				}
+			}
+			if status != "ok" {
+				ok = false
+			}
+			fmt.Fprintf(w, "%-8s %s %s\n", status, l.URL, want)
+		}
+
+		for i, a := range found {
+			if !matched[i] {
+				fmt.Fprintf(w, "%-8s %s\n", "extra", a)
+			}
+		}
+	}
+
+	return ok, nil
+}
+
+// CheckPDF reads the PDF in f back the way a viewer would, as a sanity check
+// after AddLinksToPDF: the xref section must point back to the one it
+// updates, every object in use in the xref must be found where the xref says,
+// and every page which links go on, as for AddLinksToPDF with the same
+// arguments, must have annotations.
+func CheckPDF(f io.ReadSeeker, allObjects map[string]*PositionedObject, links []*PositionedLink, opts *Options) error {
+	opts = opts.withDefaults()
+	opts.OnLinkError = nil
+	opts.Warnf = nil
+	pdf, err := UnmarshalPDFFile(f)
+	if err != nil {
+		return err
+	}
+	// Earlier sections were already read along with the PDF, so it's enough
+	// that the update points back to one before it
+
+	if prev := pdf.Xref.Trailer.Prev; prev == 0 {
+		return fmt.Errorf("PDF xref trailer has no /Prev pointing to the original xref")
+	} else if prev >= pdf.Xref.OwnOffset {
+		return fmt.Errorf("PDF xref trailer /Prev %d doesn't point to an earlier xref than its own at %d", prev, pdf.Xref.OwnOffset)
+	}
+	for id, e := range pdf.Xref.Entries {
+		if e.Free || id == 0 {
+			continue
+		}
+		ref := &PDFObjRef{ID: id, Gen: e.Gen}
+		if e.StreamID > 0 {
+			if _, err := pdf.Xref.ReadObj(f, ref); err != nil {
+				return fmt.Errorf("cannot read PDF object %s: %s", ref, err)
+			}
+			continue
+		}
+		if err := pdf.Xref.SeekObj(f, ref); err != nil {
+			return err
+		}
+		header := make([]byte, 32)
+		n, err := io.ReadFull(f, header)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		m := pdfObjHeaderRegexp.FindSubmatch(header[:n])
+		if m == nil || string(m[1]) != strconv.Itoa(id) || string(m[2]) != strconv.Itoa(e.Gen) {
+			return fmt.Errorf("PDF object %s is not at offset %d given by xref", ref, e.Offset)
+		}
+		if _, err := pdf.Xref.ReadObj(f, ref); err != nil {
+			return fmt.Errorf("cannot read PDF object %s: %s", ref, err)
+		}
+	}
+	if err := pdf.setupPages(allObjects, links, opts); err != nil {
+		return err
+	}
+	for i, page := range pdf.Kids {
+		if len(page.Links) == 0 {
+			continue
+		}
+		annots, err := pdf.ReadLinkAnnots(f, i)
+		if err != nil {
+			return err
+		}
+		if len(annots) == 0 {
+			return fmt.Errorf("page %d of PDF has no link annotations", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package linkify
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckPDFCorrupted(t *testing.T) {
+	links := []*PositionedLink{{URL: "https://example.com/", X: 100, Y: 100, W: 200, H: 100, Valid: true}}
+	opts := &Options{Highlight: &Highlight{Color: [3]float64{1, 1, 0}, Opacity: 0.5}}
+	f := newMemFile(testPDF(onePage...))
+	if err := AddLinksToPDF(f, nil, links, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPDF(f, nil, links, opts); err != nil {
+		t.Fatalf("intact PDF fails the check: %s", err)
+	}
+	update := bytes.LastIndex(f.b, []byte("\nxref\n"))
+	entryRegexp := regexp.MustCompile(`(?m)^(\d{10}) 00000 n \r?$`)
+	for _, c := range []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		err     string
+	}{
+		{"shifted offset", func(b []byte) []byte {
+			// The last entry of the update is the appearance stream
+			ms := entryRegexp.FindAllSubmatchIndex(b[update:], -1)
+			m := ms[len(ms)-1]
+			off, _ := strconv.Atoi(string(b[update+m[2] : update+m[3]]))
+			return append(append(append([]byte(nil), b[:update+m[2]]...), fmt.Sprintf("%010d", off+4)...), b[update+m[3]:]...)
+		}, "is not at offset"},
+		{"annotations lost", func(b []byte) []byte {
+			i := bytes.LastIndex(b[:update], []byte("/Annots"))
+			return append(append(append([]byte(nil), b[:i]...), "/Xnnots"...), b[i+7:]...)
+		}, "has no link annotations"},
+		{"no /Prev", func(b []byte) []byte {
+			return regexp.MustCompile(`/Prev \d+`).ReplaceAll(append([]byte(nil), b...), []byte("/Xrev 0"))
+		}, "has no /Prev"},
+	} {
+		err := CheckPDF(newMemFile(c.corrupt(f.b)), nil, links, opts)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want an error with '%s'", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oxplot/svglinkify/linkify"
+)
+
+// scanLinks finds all the anchor elements in the SVG with svgContent and
+// extracts their ids and links, warning about what may misplace them
+func scanLinks(svgContent string) []*linkify.PositionedLink {
+	links, err := linkify.ScanAnchors(strings.NewReader(svgContent), *maxLinks, func(l *linkify.PositionedLink, reason string) {
+		if *strict {
+			linkError(l.URL, "link '%s' %s - ignoring link", l.URL, reason)
+		}
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(links) == 0 {
+		log.Print("did not find any links")
+	}
+	if dups, err := linkify.DuplicateIDs(strings.NewReader(svgContent)); err != nil {
+		fatal(err)
+	} else if len(dups) > 0 {
+		log.Printf("more than one element has each of the ids %s - the first with each is used, so links on or to the others may be misplaced", strings.Join(dups, ", "))
+	}
+	return links
+}
+
+// placeLinks copies the anchors and places each of them by its bounding box
+// among allObjects, unless it's given in the SVG. It returns all of them and
+// those that could be placed, reporting the others with linkError.
+func placeLinks(anchors []*linkify.PositionedLink, allObjects map[string]*linkify.PositionedObject) (allLinks, validLinks []*linkify.PositionedLink) {
+	allLinks = []*linkify.PositionedLink{}
+	validLinks = []*linkify.PositionedLink{}
+	for _, a := range anchors {
+		l := *a
+		allLinks = append(allLinks, &l)
+		if l.BareFragment() == "" && !strings.HasPrefix(strings.ToLower(l.URL), "file:") {
+			if w := linkify.URIWarning(l.URL); w != "" {
+				log.Printf("link '%s' %s", l.URL, w)
+			}
+		}
+		if id := l.TargetID(); id != "" && allObjects[id] == nil {
+			linkError(l.URL, "link '%s' points to non-existing object - ignoring link", l.URL)
+		} else if l.Valid {
+			// The clickable area is given explicitly in the SVG
+			verbosef("link '%s' at %g,%g size %gx%g px from data-link-rect", l.URL, l.X, l.Y, l.W, l.H)
+			validLinks = append(validLinks, &l)
+		} else if o := linkify.ResolveLinkBox(&l, allObjects, *linkResolve); o != nil {
+			l.X, l.Y, l.W, l.H = o.X, o.Y, o.W, o.H
+			l.Valid = true
+			verbosef("link '%s' at %g,%g size %gx%g px", l.URL, l.X, l.Y, l.W, l.H)
+			validLinks = append(validLinks, &l)
+		} else {
+			linkError(l.URL, "%s didn't tell us the bounding box for link '%s' - ignoring link", *backendName, l.URL)
+		}
+	}
+	return allLinks, validLinks
+}
+
+// verifyOutput compares the links in the PDF given with -verify against the
+// valid links and prints a report, exiting with 1 if they don't match. The
+// links are also written as JSON to linksPath unless it's empty.
+func verifyOutput(linksPath string, allObjects map[string]*linkify.PositionedObject, allLinks, validLinks []*linkify.PositionedLink, opts *linkify.Options) {
+	f, err := os.Open(*verifyPath)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+	ok, err := linkify.VerifyLinks(os.Stdout, f, allObjects, validLinks, opts)
+	if err != nil {
+		fatal(err)
+	}
+	reportLinkRects(linksPath, f, allObjects, allLinks, validLinks, opts)
+	if !ok {
+		removeTempFiles()
+		os.Exit(1)
+	}
+}
+
+// linkJSON is a link as written by -links-out
+type linkJSON struct {
+	*linkify.PositionedLink
+
+	// PDF is where the link is in the PDF, nil if it isn't in it
+	PDF *linkify.LinkRect `json:"pdf,omitempty"`
+}
+
+// reportLinkRects finds where the valid links are placed in the PDF in f and
+// logs it with -verbose. The links are also written as JSON to path unless
+// it's empty. It returns how many links are placed, which is only counted for
+// the summary, and is 0 with -quiet unless -verbose or -links-out need it.
+func reportLinkRects(path string, f io.ReadSeeker, allObjects map[string]*linkify.PositionedObject, allLinks, validLinks []*linkify.PositionedLink, opts *linkify.Options) int {
+	if path == "" && !*verbose && *quiet {
+		return 0
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(err)
+	}
+	rects, err := linkify.LinkRects(f, allObjects, validLinks, opts)
+	if err != nil {
+		fatal(err)
+	}
+	for _, l := range validLinks {
+		if r := rects[l]; r != nil {
+			verbosef("link '%s' at [ %.2f %.2f %.2f %.2f ] pt on page %d", l.URL, r.Rect[0], r.Rect[1], r.Rect[2], r.Rect[3], r.Page+1)
+		}
+	}
+	if path != "" {
+		writeLinksJSON(path, allObjects, allLinks, rects)
+	}
+	return len(rects)
+}
+
+// writeLinksJSON writes the links and objects as JSON to path. rects has
+// where links are in the PDF and may be nil.
+func writeLinksJSON(path string, allObjects map[string]*linkify.PositionedObject, links []*linkify.PositionedLink, rects map[*linkify.PositionedLink]*linkify.LinkRect) {
+	out := struct {
+		Links   []linkJSON                  `json:"links"`
+		Objects []*linkify.PositionedObject `json:"objects"`
+	}{Links: []linkJSON{}, Objects: []*linkify.PositionedObject{}}
+	for _, l := range links {
+		out.Links = append(out.Links, linkJSON{l, rects[l]})
+	}
+	for _, o := range allObjects {
+		out.Objects = append(out.Objects, o)
+	}
+	sort.Slice(out.Objects, func(i, j int) bool { return out.Objects[i].ID < out.Objects[j].ID })
+	v, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append(v, '\n'), 0666); err != nil {
+		fatal(err)
+	}
+}
+
+// printLinks writes a table of the links with their bounding boxes to w
+func printLinks(w io.Writer, links []*linkify.PositionedLink) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tURL\tX\tY\tW\tH\tVALID")
+	for _, l := range links {
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%.2f\t%.2f\t%.2f\t%t\n", l.ID, l.URL, l.X, l.Y, l.W, l.H, l.Valid)
+	}
+	tw.Flush()
+}
+
+// printObjects prints the id and bounding box of each of the objects as a
+// table, sorted by id
+func printObjects(w io.Writer, allObjects map[string]*linkify.PositionedObject) {
+	ids := make([]string, 0, len(allObjects))
+	for id := range allObjects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tX\tY\tW\tH")
+	for _, id := range ids {
+		o := allObjects[id]
+		fmt.Fprintf(tw, "%s\t%.2f\t%.2f\t%.2f\t%.2f\n", id, o.X, o.Y, o.W, o.H)
+	}
+	tw.Flush()
+}
+
+// countLinks adds the links of a PDF written, of which placed are in it, to
+// stats
+func countLinks(allLinks []*linkify.PositionedLink, placed int) {
+	stats.found += len(allLinks)
+	stats.placed += placed
+	for _, l := range allLinks {
+		if l.BareFragment() != "" {
+			stats.internal++
+		} else {
+			stats.external++
+		}
+	}
+}
+
+// logSummary logs how many links were found and placed in all the PDFs
+// written, unless -quiet is given
+func logSummary() {
+	if !*quiet && stats.found > 0 {
+		log.Printf("%d link(s) found (%d internal, %d external), %d placed in the PDF and %d left out",
+			stats.found, stats.internal, stats.external, stats.placed, stats.found-stats.placed)
+	}
+}
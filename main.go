@@ -1,78 +1,135 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	_log "log"
+	"math"
 	"os"
 	"os/exec"
-	"regexp"
-	"strconv"
+	"path/filepath"
 	"strings"
+
+	"github.com/oxplot/svglinkify/linkify"
 )
 
 var (
 	inkscapePath *string
+	rsvgPath     *string
 	inputPath    string
 	outputPath   string
-	exportDPI    = flag.Int("dpi", 96, "Resolution for rasterization of filters")
+	exportDPI    = flag.Int("dpi", 96, "Resolution for rasterization of filters (doesn't affect where links are placed)")
+	dryRun       = flag.Bool("dry-run", false, "print the links found and their bounding boxes without generating a PDF")
+	listIDs      = flag.Bool("list-ids", false, "print the id and bounding box of every object the backend reports, sorted by id, instead of converting")
+	verifyPath   = flag.String("verify", "", "compare links in this PDF against the links in the SVG instead of converting")
+	skipRender   = flag.Bool("skip-render", false, "add links to the existing output PDF instead of rendering it, e.g. when it's produced by another tool")
+	checkOutput  = flag.Bool("check-output", false, "after adding links, read the PDF back and check that all of its objects and the links can be found")
+	linksOut     = flag.String("links-out", "", "also write the links found, their bounding boxes and where they end up in the PDF as JSON to this file")
+	keepPath     = flag.String("keep-intermediate", "", "also keep a copy of the PDF as rendered, before links are added, at this path")
+	bgColor      = flag.String("background-color", "", "page background color used for export, e.g. #ffffff, or #ffffff80 with an opacity (default is the document's)")
+	bgOpacity    = flag.String("background-opacity", "", "page background opacity used for export, 0.0 to 1.0 (default is the document's)")
+	pageSize     = flag.String("page-size", "", "page size to export to instead of the SVG's own, as a3, a4, a5, letter, legal or WxH in points (e.g. 612x792)")
+	scale        = flag.Float64("scale", 1, "factor to scale the page size and drawing by, e.g. 2 for twice the size (-dpi still applies to the scaled size)")
+	pageSizes    = flag.String("page-sizes", "", "comma separated page sizes (as with -page-size) to export to, each to its own PDF")
+	failFast     = flag.Bool("fail-fast", false, "stop at the first link that cannot be resolved instead of reporting all of them")
+	strict       = flag.Bool("strict", false, "also treat links that are skipped in the SVG (no id, or inside a hidden element) as errors")
+	highlightOn  = flag.Bool("highlight", false, "draw a translucent highlight over links, see -highlight-mode")
+	hlColor      = flag.String("highlight-color", "", "highlight color as #rrggbb (default contrasts with -background-color)")
+	hlOpacity    = flag.Float64("highlight-opacity", 0.3, "highlight opacity from 0.0 to 1.0")
+	hlRadius     = flag.Float64("highlight-radius", 0, "corner radius of the highlight in points")
+	hlMode       = flag.String("highlight-mode", HighlightAnnotation, "how -highlight is drawn: "+HighlightAnnotation+" (as the appearance of each link) or "+HighlightContent+" (behind the drawing in the page itself)")
+	borderWidth  = flag.Float64("border-width", 0, "width in points of a visible outline around links, 0 for none")
+	borderColor  = flag.String("border-color", "", "color of the link outline as r,g,b with each from 0.0 to 1.0 (default is the viewer's)")
+	internalFit  = flag.String("internal-fit", linkify.FitR, "how internal link targets are viewed: "+linkify.FitR+" (zoom to the target), "+linkify.Fit+" (whole page), "+linkify.FitB+" (page content) or "+linkify.XYZ+" (scroll to the target, keeping the zoom)")
+	fitMargin    = flag.String("fit-margin", "0", "room to leave around internal link targets with -internal-fit "+linkify.FitR+", in points (e.g. 6) or percent of the target's size (e.g. 10%)")
+	linkPadding  = flag.String("link-padding", "0", "room to add around the clickable area of each link, in points (e.g. 4) or percent of the link's size (e.g. 20%), without changing where internal links go")
+	namedDests   = flag.Bool("named-dests", false, "refer to internal link targets by name from the catalog instead of repeating the destination in each link")
+	reuseObjects = flag.Bool("reuse-objects", false, "rewrite the pages and catalog under their own object numbers instead of appending new ones, so the PDF's object table doesn't grow when it's updated again (e.g. with -skip-render)")
+	delinearize  = flag.Bool("delinearize", false, "strip the linearization (fast web view) of the PDF, e.g. one given with -skip-render, before adding links, which would otherwise leave it stale")
+	tagged       = flag.Bool("tagged", false, "add a structure tree with a Link element for each link, so screen readers find them (as PDF/UA requires)")
+	linkResolve  = flag.String("link-resolve", linkify.ResolveExact, "how the clickable area of a link is found: "+linkify.ResolveExact+", "+linkify.ResolveFirstChild+" or "+linkify.ResolveUnion)
+	noBBoxes     = flag.String("no-bboxes", NoBBoxesError, "what to do when no bounding boxes are obtained at all, e.g. as inkscape doesn't support the query: "+NoBBoxesError+" (stop before writing the PDF) or "+NoBBoxesWarn+" (write it without the links that need them)")
+	backendName  = flag.String("backend", BackendInkscape, "what renders the SVG: "+BackendInkscape+" or "+BackendRsvg+" (rsvg-convert, with bounding boxes computed from the SVG)")
+	queryIDs     = flag.Bool("query-ids", false, "ask inkscape only for the bounding boxes of the objects links need instead of all of them, which is faster for large drawings with few links (-links-out then only has those)")
+	noCache      = flag.Bool("no-cache", false, "always ask inkscape for bounding boxes instead of reusing those from an earlier run on the same SVG")
+	timeout      = flag.Duration("timeout", 0, "give up if inkscape or rsvg-convert take longer than this altogether, e.g. 2m (0 for no limit)")
+	verbose      = flag.Bool("verbose", false, "log what is found and written at each stage")
+	quiet        = flag.Bool("quiet", false, "don't log the summary of the links found and placed at the end")
+	errorFormat  = flag.String("error-format", ErrorFormatText, "how the error svglinkify stops at is reported on stderr: "+ErrorFormatText+" or "+ErrorFormatJSON+" (an object with the stage it failed at, the message and the exit code, with distinct exit codes for each stage)")
+	batchDir     = flag.String("batch", "", "convert every SVG in this directory and below to a PDF next to it instead of a single SVG")
+	jobs         = flag.Int("jobs", 1, "number of SVGs to convert at the same time with -batch")
+	maxLinks     = flag.Int("max-links", 100000, "maximum number of links to process before giving up (0 for no limit)")
+	maxSVGSize   = flag.Int64("max-svg-size", 256<<20, "maximum size in bytes of the SVG, once decompressed if it's an .svgz, before giving up (0 for no limit)")
 
 	log = _log.New(os.Stderr, "", 0)
 
-	anchorRegexp   = regexp.MustCompile(`<a\s[^>]*\bhref="([^">]+)"[^>]*>`)
-	anchorIdRegexp = regexp.MustCompile(`\bid="([^"]+)"`)
-	bboxRegexp     = regexp.MustCompile(`(?m)^([^,\n]+),([^,\n]+),([^,\n]+),([^,\n]+),([^,\n]+)$`)
-)
+	// inkscapeArgs are extra arguments for inkscape when exporting, see
+	// -inkscape-arg
+	inkscapeArgs stringsFlag
 
-type PositionedObject struct {
-	// SVG ID
-	ID string
+	// margin is the parsed -fit-margin
+	margin linkify.Margin
 
-	// X position of in pixels
-	X float64
+	// padding is the parsed -link-padding
+	padding linkify.Margin
 
-	// Y position of in pixels
-	Y float64
+	// highlight is how links are highlighted, nil if they aren't
+	highlight *linkify.Highlight
 
-	// Width of in pixels
-	W float64
+	// border is the outline drawn around links, nil if there is none
+	border *linkify.Border
 
-	// Height in pixels
-	H float64
-}
+	// badLinks are the URLs of the links that could not be resolved, each
+	// once
+	badLinks []string
+
+	// stats counts the links of all the PDFs written, for the summary at
+	// the end
+	stats struct {
+		found, internal, external, placed int
+	}
 
-type PositionedLink struct {
-	// SVG ID
-	ID string
+	// stage is what svglinkify is doing, which failures are reported under
+	// with -error-format json
+	stage = StageSetup
 
-	// URL of the link
-	URL string
+	// backend renders the SVG and finds the bounding boxes of its objects
+	backend Backend
 
-	// X position of in pixels
-	X float64
+	// tempFiles are the temporary files to remove when done, such as the
+	// one the output PDF is generated in until it's complete, see
+	// removeTempFiles
+	tempFiles = map[string]bool{}
 
-	// Y position of in pixels
-	Y float64
+	// workFile is the open temporary file links are being added to, which
+	// removeTempFiles closes first as open files cannot be removed on all
+	// systems
+	workFile *os.File
 
-	// Width of in pixels
-	W float64
+	// ctx bounds all the runs of the backend, see -timeout, and cancel
+	// releases it
+	ctx    = context.Background()
+	cancel = context.CancelFunc(func() {})
+)
 
-	// Height in pixels
-	H float64
+// stringsFlag is a flag that can be given multiple times, collecting each
+// value in order
+type stringsFlag []string
 
-	// Valid indicates if this link has all the requirements to be used
-	Valid bool
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
 }
 
-// BareFragment returns the ID portion of the URL, if the URL starts with #
-// otherwise returns the empty string
-func (l *PositionedLink) BareFragment() string {
-	if l.URL[0] == '#' {
-		return l.URL[1:]
-	} else {
-		return ""
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// verbosef logs the diagnostic if -verbose is given
+func verbosef(format string, v ...interface{}) {
+	if *verbose {
+		log.Printf(format, v...)
 	}
 }
 
@@ -80,6 +137,10 @@ func init() {
 	// Attempt to determine inkscape's path automatically
 	defaultInkscapePath, _ := exec.LookPath("inkscape")
 	inkscapePath = flag.String("inkscape-path", defaultInkscapePath, "path to inkscape binary")
+	defaultRsvgPath, _ := exec.LookPath("rsvg-convert")
+	rsvgPath = flag.String("rsvg-path", defaultRsvgPath, "path to rsvg-convert binary, used with -backend "+BackendRsvg)
+	flag.BoolVar(verbose, "v", false, "short for -verbose")
+	flag.Var(&inkscapeArgs, "inkscape-arg", "extra argument for inkscape when exporting the PDF, e.g. --export-text-to-path (can be repeated)")
 	flag.Usage = func() {
 		fmt.Fprint(flag.CommandLine.Output(), `
 svglinkify converts SVGs to PDFs using inkscape while preserving hyperlinks
@@ -89,491 +150,256 @@ Link". Enter a URL in Href field and save your SVG. Then use svglinkify to
 convert your SVG file.
 
 If the hyper link is '#some-id', an internal link is created which when
-clicked, will pan and zoom onto the object with id 'some-id'.
+clicked, will pan and zoom onto the object with id 'some-id'. The other kinds
+of links and how the options below work are described at
+https://github.com/oxplot/svglinkify.
 
 Usage: svglinkify [options] input.svg output.pdf
+       svglinkify [options] -batch dir
+       svglinkify [options] -verify output.pdf input.svg
+       svglinkify [options] -dry-run input.svg
+       svglinkify [options] -list-ids input.svg
 
 `)
 		flag.PrintDefaults()
 	}
-	flag.Parse()
-	if len(flag.Args()) != 2 {
-		flag.Usage()
-		os.Exit(2)
-	}
-	inputPath = flag.Args()[0]
-	outputPath = flag.Args()[1]
 }
 
-func readPDFObj(r io.Reader) (string, error) {
-	objRegexp := regexp.MustCompile(`(?ms)^\d+\s+\d+\s+obj\s+(.*?)\s*^endobj$`)
-	buf := make([]byte, 4096)
-	if _, err := r.Read(buf); err != nil {
-		return "", err
+// setup parses and checks the command line and finds the backend
+func setup() {
+	flag.Parse()
+	if *errorFormat != ErrorFormatText && *errorFormat != ErrorFormatJSON {
+		log.Fatalf("unknown -error-format '%s'", *errorFormat)
 	}
-	m := objRegexp.FindStringSubmatch(string(buf))
-	if m == nil {
-		return "", fmt.Errorf("cannot find read PDF object")
+	nArgs := 2
+	if *verifyPath != "" || *dryRun || *listIDs {
+		nArgs = 1
 	}
-	return m[1], nil
-}
-
-type PDFXrefEntry struct {
-	Offset int64
-	Gen    int
-	Free   bool
-}
-
-func (e *PDFXrefEntry) Marshal(w io.Writer) (int, error) {
-	var free string
-	if e.Free {
-		free = "f"
-	} else {
-		free = "n"
+	if *listIDs && (*dryRun || *verifyPath != "" || *skipRender || *batchDir != "" || *linksOut != "" || *keepPath != "" ||
+		*pageSize != "" || *pageSizes != "" || *scale != 1) {
+		fatal("-list-ids cannot be used with -dry-run, -verify, -skip-render, -batch, -links-out, -keep-intermediate, -page-size, -page-sizes or -scale")
 	}
-	return fmt.Fprintf(w, "%010d %05d %s \n", e.Offset, e.Gen, free)
-}
-
-var PDFXrefFreeEntry = &PDFXrefEntry{Gen: 65535, Free: true}
-
-type PDFObjRef struct {
-	ID  int
-	Gen int
-}
-
-func (r *PDFObjRef) String() string {
-	return fmt.Sprintf("%d %d R", r.ID, r.Gen)
-}
-
-type PDFXrefTrailer struct {
-	Size int
-	Root *PDFObjRef
-	Raw  string
-}
-
-func (t *PDFXrefTrailer) Marshal(w io.Writer) (int, error) {
-	s := regexp.MustCompile(`/Size\s+\d+`).ReplaceAllStringFunc(t.Raw, func(s string) string {
-		return fmt.Sprintf("/Size %d", t.Size)
-	})
-	s = regexp.MustCompile(`/Root\s+\d+\s+\d+\s+R`).ReplaceAllStringFunc(s, func(s string) string {
-		return fmt.Sprintf("/Root %s", t.Root)
-	})
-	return w.Write([]byte("trailer\n" + s + "\n"))
-}
-
-type PDFCatalog struct {
-	OwnRef   *PDFObjRef
-	PagesRef *PDFObjRef
-	Raw      string
-}
-
-func UnmarshalPDFCatalog(r io.Reader) (*PDFCatalog, error) {
-	s, err := readPDFObj(r)
-	if err != nil {
-		return nil, err
-	}
-	re := regexp.MustCompile(`/Pages\s+(\d+)\s+(\d+)\s+R`)
-	m := re.FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("cannot read PDF catalog")
+	if *batchDir != "" {
+		nArgs = 0
+		if *verifyPath != "" || *linksOut != "" || *keepPath != "" {
+			fatal("-batch cannot be used with -verify, -links-out or -keep-intermediate")
+		}
 	}
-	id, _ := strconv.ParseInt(m[1], 10, 32)
-	gen, _ := strconv.ParseInt(m[2], 10, 32)
-	return &PDFCatalog{PagesRef: &PDFObjRef{ID: int(id), Gen: int(gen)}, Raw: s}, nil
-}
-
-func (c *PDFCatalog) Marshal(w io.Writer) (int, error) {
-	s := regexp.MustCompile(`/Pages\s+\d+\s+\d+\s+R`).ReplaceAllStringFunc(c.Raw, func(s string) string {
-		return fmt.Sprintf("/Pages %s", c.PagesRef)
-	})
-
-	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", c.OwnRef.ID, c.OwnRef.Gen, s)
-}
-
-type PDFPages struct {
-	OwnRef   *PDFObjRef
-	Page1Ref *PDFObjRef
-	Raw      string
-}
-
-func UnmarshalPDFPages(r io.Reader) (*PDFPages, error) {
-	s, err := readPDFObj(r)
-	if err != nil {
-		return nil, err
+	if *jobs < 1 {
+		fatal("-jobs must be at least 1")
 	}
-	re := regexp.MustCompile(`/Kids\s+\[\s+(\d+)\s+(\d+)\s+R`)
-	m := re.FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("cannot read PDF pages")
+	if len(flag.Args()) != nArgs {
+		flag.Usage()
+		os.Exit(2)
 	}
-	id, _ := strconv.ParseInt(m[1], 10, 32)
-	gen, _ := strconv.ParseInt(m[2], 10, 32)
-	return &PDFPages{Page1Ref: &PDFObjRef{ID: int(id), Gen: int(gen)}, Raw: s}, nil
-}
-
-func (p *PDFPages) Marshal(w io.Writer) (int, error) {
-	s := regexp.MustCompile(`/Kids\s+\[\s+\d+\s+\d+\s+R`).ReplaceAllStringFunc(p.Raw, func(s string) string {
-		return fmt.Sprintf("/Kids [ %s", p.Page1Ref)
-	})
-
-	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", p.OwnRef.ID, p.OwnRef.Gen, s)
-}
-
-type PDFPage struct {
-	OwnRef  *PDFObjRef
-	Links   []*PositionedLink
-	Objects map[string]*PositionedObject
-	Height  float64
-	Raw     string
-}
-
-func UnmarshalPDFPage(r io.Reader) (*PDFPage, error) {
-	s, err := readPDFObj(r)
-	if err != nil {
-		return nil, err
+	if *pageSize != "" && *pageSizes != "" {
+		fatal("-page-size cannot be used with -page-sizes")
 	}
-	m := regexp.MustCompile(`/MediaBox\s+\[\s+\S+\s+\S+\s+\S+\s+(\S+)`).FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("cannot find PDF page media box")
+	if !(*scale > 0) || math.IsInf(*scale, 0) {
+		fatal("-scale must be positive")
 	}
-	h, err := strconv.ParseFloat(m[1], 64)
-	if err != nil {
-		return nil, fmt.Errorf("invalid PDF media box height '%s' found", m[1])
+	if *scale != 1 && (*pageSize != "" || *pageSizes != "") {
+		fatal("-scale cannot be used with -page-size or -page-sizes")
 	}
-	return &PDFPage{Raw: s, Height: h}, nil
-}
-
-func (p *PDFPage) Marshal(w io.Writer) (int, error) {
-	b := strings.Builder{}
-	for _, l := range p.Links {
-		bareFragLink := l.BareFragment()
-		var action string
-		if bareFragLink != "" {
-			t := p.Objects[bareFragLink]
-			if t == nil {
-				action = ""
-				log.Printf("link '%s' points to non-existing object", l.URL)
-			} else {
-				action = fmt.Sprintf("/GoTo /D [ %d %d R /FitR %f %f %f %f ]",
-					p.OwnRef.ID, p.OwnRef.Gen, t.X*0.75, p.Height-(t.H+t.Y)*0.75, (t.W+t.X)*0.75, p.Height-t.Y*0.75)
-			}
-		} else {
-			action = "/URI /URI (" + l.URL + ")"
+	if *pageSize != "" {
+		if _, _, err := linkify.ParsePageSize(*pageSize); err != nil {
+			fatal(err)
 		}
-		b.WriteString(fmt.Sprintf(
-			` << /Type /Annot /Subtype /Link /Border [ 0 0 0 ] /A << /S %s >> /Rect [ %f %f %f %f ] >> `,
-			action, l.X*0.75, p.Height-l.Y*0.75, (l.W+l.X)*0.75, p.Height-(l.H+l.Y)*0.75,
-		))
-	}
-	s := regexp.MustCompile(">>$").ReplaceAllStringFunc(p.Raw, func(s string) string {
-		return fmt.Sprintf("/Annots [ %s ]\n>>", b.String())
-	})
-	return fmt.Fprintf(w, "%d %d obj\n%s\nendobj\n", p.OwnRef.ID, p.OwnRef.Gen, s)
-}
-
-func UnmarshalPDFXrefTrailer(s string) (*PDFXrefTrailer, error) {
-	re := regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
-	m := re.FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("cannot read PDF xref trailer")
 	}
-	id, _ := strconv.ParseInt(m[1], 10, 32)
-	gen, _ := strconv.ParseInt(m[2], 10, 32)
-	return &PDFXrefTrailer{Root: &PDFObjRef{ID: int(id), Gen: int(gen)}, Raw: s}, nil
-}
-
-type PDFXref struct {
-	OwnOffset int64
-	ObjStart  int
-	ObjCount  int
-	Entries   []*PDFXrefEntry
-	Trailer   *PDFXrefTrailer
-}
-
-func UnmarshalPDFXref(r io.Reader) (*PDFXref, error) {
-	buf, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
+	if *verifyPath != "" && *pageSizes != "" {
+		fatal("-verify cannot be used with -page-sizes")
 	}
-	re := regexp.MustCompile(`(?s)^xref\s+(\d+)\s+(\d+)\s+(.*?)\s+trailer\s+(.*?)\s+startxref\s+`)
-	m := re.FindStringSubmatch(string(buf))
-	if m == nil {
-		return nil, fmt.Errorf("cannot find valid xref in PDF")
+	if *keepPath != "" && (*verifyPath != "" || *dryRun) {
+		fatal("-keep-intermediate cannot be used with -verify or -dry-run")
 	}
-	objStart, _ := strconv.ParseInt(m[1], 10, 32)
-	objCount, _ := strconv.ParseInt(m[2], 10, 32)
-	trailer, err := UnmarshalPDFXrefTrailer(m[4])
-	if err != nil {
-		return nil, err
-	}
-	xref := PDFXref{
-		ObjStart: int(objStart),
-		ObjCount: int(objCount),
-		Trailer:  trailer,
-	}
-	re = regexp.MustCompile(`(?m)^(\d+)\s+(\d+)\s+([fn])[^\S\r\n]*$`)
-	entriesM := re.FindAllStringSubmatch(m[3], -1)
-	if entriesM == nil {
-		return nil, fmt.Errorf("found empty xref")
-	}
-	for _, e := range entriesM {
-		offset, _ := strconv.ParseInt(e[1], 10, 64)
-		gen, _ := strconv.ParseInt(e[2], 10, 32)
-		entry := PDFXrefEntry{
-			Offset: offset,
-			Gen:    int(gen),
-			Free:   e[3] == "f",
-		}
-		xref.Entries = append(xref.Entries, &entry)
+	if *verifyPath != "" && *dryRun {
+		fatal("-verify cannot be used with -dry-run")
 	}
-	return &xref, nil
-}
-
-func (x *PDFXref) Marshal(w io.Writer) (int, error) {
-	var err error
-	var nTotal, n int
-	if n, err = fmt.Fprintf(w, "xref\n0 %d\n", len(x.Entries)); err != nil {
-		return nTotal + n, err
+	if *skipRender && (*verifyPath != "" || *dryRun || *pageSizes != "") {
+		fatal("-skip-render cannot be used with -verify, -dry-run or -page-sizes")
 	}
-	nTotal += n
-
-	for _, e := range x.Entries {
-		if n, err = e.Marshal(w); err != nil {
-			return nTotal + n, err
-		}
-		nTotal += n
+	if nArgs > 1 && flag.Args()[1] == "-" && (*pageSizes != "" || *skipRender) {
+		fatal("the output cannot be stdout with -page-sizes or -skip-render")
 	}
-
-	if n, err = x.Trailer.Marshal(w); err != nil {
-		return nTotal + n, err
+	switch *linkResolve {
+	case linkify.ResolveExact, linkify.ResolveFirstChild, linkify.ResolveUnion:
+	default:
+		fatalf("unknown -link-resolve strategy '%s'", *linkResolve)
 	}
-	nTotal += n
-
-	return nTotal, nil
-}
-
-// addLinksToPDF incrementally updates the PDF output of inkscape to add
-// clickable links
-func addLinksToPDF(f io.ReadWriteSeeker, allObjects map[string]*PositionedObject, links []*PositionedLink) error {
-	var err error
-	startxrefRegexp := regexp.MustCompile(`(?m)^startxref\s+(\d+)`)
-
-	// Load original xref, catalog, pages and page 1 of the PDF
-
-	buf := make([]byte, 50)
-	f.Seek(-50, io.SeekEnd)
-	if _, err := f.Read(buf); err != nil {
-		return err
+	switch *hlMode {
+	case HighlightAnnotation, HighlightContent:
+	default:
+		fatalf("unknown -highlight-mode '%s'", *hlMode)
 	}
-	sxrefM := startxrefRegexp.FindStringSubmatch(string(buf))
-	if sxrefM == nil {
-		return fmt.Errorf("cannot find startxref in PDF")
+	if *hlMode == HighlightContent && *skipRender && *highlightOn {
+		fatalf("-highlight-mode %s cannot be used with -skip-render as it changes what's rendered", HighlightContent)
 	}
-	origXrefOff, _ := strconv.ParseInt(sxrefM[1], 10, 64)
-
-	f.Seek(origXrefOff, io.SeekStart)
-
-	xref, err := UnmarshalPDFXref(f)
-	if err != nil {
-		return err
+	switch *noBBoxes {
+	case NoBBoxesError, NoBBoxesWarn:
+	default:
+		fatalf("unknown -no-bboxes action '%s'", *noBBoxes)
 	}
-	xref.OwnOffset = origXrefOff
-
-	f.Seek(xref.Entries[xref.Trailer.Root.ID].Offset, io.SeekStart)
-	catalog, err := UnmarshalPDFCatalog(f)
-	if err != nil {
-		return err
+	switch *internalFit {
+	case linkify.FitR, linkify.Fit, linkify.FitB, linkify.XYZ:
+	default:
+		fatalf("unknown -internal-fit mode '%s'", *internalFit)
 	}
-	catalog.OwnRef = xref.Trailer.Root
-
-	f.Seek(xref.Entries[catalog.PagesRef.ID].Offset, io.SeekStart)
-	pages, err := UnmarshalPDFPages(f)
+	m, err := linkify.ParseMargin(*fitMargin)
 	if err != nil {
-		return err
+		fatal(err)
 	}
-	pages.OwnRef = catalog.PagesRef
-
-	f.Seek(xref.Entries[pages.Page1Ref.ID].Offset, io.SeekStart)
-	page1, err := UnmarshalPDFPage(f)
-	if err != nil {
-		return err
+	margin = m
+	if padding, err = linkify.ParseMargin(*linkPadding); err != nil {
+		fatal(err)
 	}
-	page1.OwnRef = pages.Page1Ref
-
-	// Update the page 1 with the new links and objects
-
-	page1.Links = links
-	page1.Objects = allObjects
-
-	// Write new catalog, pages, and page 1
-
-	var outN int
-
-	nextOff := xref.OwnOffset
-	page1Off := nextOff
-	xref.Entries[page1.OwnRef.ID] = PDFXrefFreeEntry
-	page1.OwnRef = &PDFObjRef{ID: len(xref.Entries)}
-	f.Seek(nextOff, io.SeekStart)
-	if outN, err = page1.Marshal(f); err != nil {
-		return err
+	if *timeout < 0 {
+		fatal("-timeout cannot be negative")
 	}
-
-	nextOff += int64(outN)
-	pagesOff := nextOff
-	pages.Page1Ref = page1.OwnRef
-	xref.Entries[pages.OwnRef.ID] = PDFXrefFreeEntry
-	pages.OwnRef = &PDFObjRef{ID: len(xref.Entries) + 1}
-	if outN, err = pages.Marshal(f); err != nil {
-		return err
-	}
-
-	nextOff += int64(outN)
-	catalogOff := nextOff
-	catalog.PagesRef = pages.OwnRef
-	xref.Entries[catalog.OwnRef.ID] = PDFXrefFreeEntry
-	catalog.OwnRef = &PDFObjRef{ID: len(xref.Entries) + 2}
-	if outN, err = catalog.Marshal(f); err != nil {
-		return err
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
 	}
-
-	// Write back updated original xref
-
-	nextOff += int64(outN)
-	xrefNewOff := nextOff
-	xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: page1Off})
-	xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: pagesOff})
-	xref.Entries = append(xref.Entries, &PDFXrefEntry{Offset: catalogOff})
-	xref.Trailer.Root = catalog.OwnRef
-	xref.Trailer.Size = len(xref.Entries)
-
-	if _, err = xref.Marshal(f); err != nil {
-		return err
-	}
-
-	if _, err := fmt.Fprintf(f, "startxref\n%d\n%%EOF", xrefNewOff); err != nil {
-		return err
+	if *bgColor != "" {
+		if _, _, err := linkify.ParseRGBA(*bgColor); err != nil {
+			fatal(err)
+		}
+		if len(*bgColor) == 9 && *bgOpacity != "" {
+			fatal("-background-opacity cannot be used with a -background-color that has an opacity")
+		}
 	}
-
-	return nil
-}
-
-func main() {
-
-	// Load the SVG file
-
-	svgContent := func() string {
-		f, err := os.Open(inputPath)
+	switch *backendName {
+	case BackendInkscape:
+		if *inkscapePath == "" {
+			fatal("cannot find inkscape in PATH - install Inkscape (https://inkscape.org) or give the path to it with -inkscape-path")
+		}
+		p, err := resolveToolPath("inkscape", *inkscapePath)
 		if err != nil {
-			log.Fatal(err)
+			fatalf("%s - install Inkscape (https://inkscape.org) or fix -inkscape-path", err)
 		}
-		defer f.Close()
-		v, err := ioutil.ReadAll(f)
+		if backend, err = newInkscapeBackend(ctx, p); err != nil {
+			fatal(err)
+		}
+	case BackendRsvg:
+		if *rsvgPath == "" {
+			fatal("cannot find rsvg-convert in PATH - install librsvg or give the path to it with -rsvg-path")
+		}
+		p, err := resolveToolPath("rsvg-convert", *rsvgPath)
 		if err != nil {
-			log.Fatal(err)
+			fatalf("%s - install librsvg or fix -rsvg-path", err)
 		}
-		return string(v)
-	}()
-
-	links := []*PositionedLink{}
-
-	// Find all the anchor elements and extract their id and links.
-
-	anchorMatches := anchorRegexp.FindAllStringSubmatch(svgContent, -1)
-
-	for _, a := range anchorMatches {
-		l := PositionedLink{URL: a[1]}
-		idm := anchorIdRegexp.FindStringSubmatch(a[0])
-		if idm == nil {
-			continue
+		if *bgOpacity != "" {
+			fatalf("-background-opacity is not supported by the %s backend", BackendRsvg)
+		}
+		if len(inkscapeArgs) > 0 {
+			fatalf("-inkscape-arg is not supported by the %s backend", BackendRsvg)
+		}
+		backend = &rsvgBackend{path: p}
+	default:
+		fatalf("unknown -backend '%s'", *backendName)
+	}
+	if *highlightOn {
+		highlight = &linkify.Highlight{Opacity: *hlOpacity, Radius: *hlRadius}
+		var err error
+		if *hlColor != "" {
+			if highlight.Color, err = linkify.ParseColor(*hlColor); err != nil {
+				fatal(err)
+			}
+		} else {
+			// Without a background color, we assume the page is white
+			bg := [3]float64{1, 1, 1}
+			if *bgColor != "" {
+				bg, _, _ = linkify.ParseRGBA(*bgColor)
+			}
+			highlight.Color = linkify.ContrastColor(bg)
 		}
-		l.ID = idm[1]
-		links = append(links, &l)
 	}
-
-	if len(links) == 0 {
-		log.Print("did not find any links")
+	if *borderWidth < 0 {
+		fatal("-border-width cannot be negative")
 	}
-
-	// Determine the final bounding boxes of all the links
-
-	inkBBoxOut, err := exec.Command(*inkscapePath, "-S", inputPath).Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Stderr.Write(exitErr.Stderr)
-			log.Fatal("inkscape errored when calculating bounding boxes")
-		}
-		log.Fatal(err)
+	if *borderWidth > 0 {
+		border = &linkify.Border{Width: *borderWidth}
 	}
-	bboxMatches := bboxRegexp.FindAllStringSubmatch(string(inkBBoxOut), -1)
-
-	// Parse all bounding box as objects
-	allObjects := map[string]*PositionedObject{}
-
-	for _, bb := range bboxMatches {
-		o := PositionedObject{ID: bb[1]}
-		o.X, err = strconv.ParseFloat(bb[2], 64)
+	if *borderColor != "" {
+		c, err := linkify.ParseRGB(*borderColor)
 		if err != nil {
-			log.Printf("inkscape gave us '%s' which is invalid as X for id '%s' - ignoring object", bb[2], o.ID)
-			continue
+			fatal(err)
 		}
-		o.Y, err = strconv.ParseFloat(bb[3], 64)
-		if err != nil {
-			log.Printf("inkscape gave us '%s' which is invalid as Y for '%s' - ignoring object", bb[3], o.ID)
-			continue
+		if border != nil {
+			border.Color = &c
 		}
-		o.W, err = strconv.ParseFloat(bb[4], 64)
-		if err != nil {
-			log.Printf("inkscape gave us '%s' which is invalid as W for '%s' - ignoring object", bb[4], o.ID)
-			continue
+	}
+	if nArgs > 0 {
+		inputPath = flag.Args()[0]
+	}
+	if nArgs > 1 {
+		outputPath = flag.Args()[1]
+		if inputPath != "-" && outputPath != "-" && samePath(inputPath, outputPath) {
+			fatal("input and output must be different files")
 		}
-		o.H, err = strconv.ParseFloat(bb[5], 64)
-		if err != nil {
-			log.Printf("inkscape gave us '%s' which is invalid as W for '%s' - ignoring object", bb[5], o.ID)
-			continue
+		if *keepPath != "" && (samePath(*keepPath, outputPath) || inputPath != "-" && samePath(*keepPath, inputPath)) {
+			fatal("-keep-intermediate must be different from the input and output")
 		}
-		allObjects[o.ID] = &o
 	}
+}
 
-	for _, l := range links {
-		if o, ok := allObjects[l.ID]; ok {
-			l.X, l.Y, l.W, l.H = o.X, o.Y, o.W, o.H
-			l.Valid = true
-		} else {
-			log.Print("inkscape didn't tell us the bounding box for link '%s' - ignoring link", l.URL)
+// samePath reports whether both paths refer to the same file, whether or not
+// it exists yet
+func samePath(a, b string) bool {
+	if ai, err := os.Stat(a); err == nil {
+		if bi, err := os.Stat(b); err == nil {
+			return os.SameFile(ai, bi)
 		}
 	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
 
-	validLinks := links[:0]
-	for _, l := range links {
-		if l.Valid {
-			validLinks = append(validLinks, l)
-		}
-	}
+// Ways links are highlighted, see -highlight-mode
+const (
+	HighlightAnnotation = "annotation"
+	HighlightContent    = "content"
+)
 
-	// Generate the PDF
-	args := []string{
-		"--export-dpi", strconv.Itoa(*exportDPI),
-		"--export-pdf", outputPath,
-		inputPath,
-	}
-	if err := exec.Command(*inkscapePath, args...).Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Stderr.Write(exitErr.Stderr)
-			log.Fatal("inkscape errored while generating PDF")
+// What's done when no bounding boxes are obtained, see -no-bboxes
+const (
+	NoBBoxesError = "error"
+	NoBBoxesWarn  = "warn"
+)
+
+func main() {
+	setup()
+	defer cancel()
+
+	if *batchDir != "" {
+		if !convertBatch(*batchDir) {
+			os.Exit(1)
 		}
-		log.Fatal(err)
+		return
 	}
 
-	// Add links to PDF
+	stage = StageParse
+	svgPath, svgContent := loadSVG()
 
-	func() {
-		f, err := os.OpenFile(outputPath, os.O_RDWR, 0666)
+	// Only report what the backend finds
+
+	if *listIDs {
+		stage = StageRender
+		allObjects, err := backend.BoundingBoxes(ctx, svgPath, svgContent, nil)
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer f.Close()
-		if err := addLinksToPDF(f, allObjects, validLinks); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-	}()
+		printObjects(os.Stdout, allObjects)
+		removeTempFiles()
+		return
+	}
+
+	links := scanLinks(svgContent)
+	convertAll(svgPath, svgContent, links)
+
+	removeTempFiles()
+	logSummary()
+	if len(badLinks) > 0 {
+		stage = StageLinks
+		fatalf("%d link(s) could not be resolved: %s", len(badLinks), strings.Join(badLinks, ", "))
+	}
 }
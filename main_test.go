@@ -0,0 +1,2117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxplot/svglinkify/linkify"
+)
+
+// asSvglinkifyEnv makes the test binary run as svglinkify itself, see
+// runSvglinkify
+const asSvglinkifyEnv = "SVGLINKIFY_TEST_MAIN"
+
+// TestMain runs the test binary as svglinkify when asked to by
+// runSvglinkify, or as a fake inkscape or rsvg-convert when run under their
+// names, see fakeTools
+func TestMain(m *testing.M) {
+	switch filepath.Base(os.Args[0]) {
+	case "inkscape":
+		os.Exit(fakeInkscape(os.Args[1:]))
+	case "rsvg-convert":
+		os.Exit(fakeRsvg(os.Args[1:]))
+	}
+	if os.Getenv(asSvglinkifyEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeTools returns a directory with a fake inkscape and rsvg-convert in it,
+// which are the test binary under those names
+func fakeTools(t *testing.T) string {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"inkscape", "rsvg-convert"} {
+		if err := os.Symlink(self, filepath.Join(dir, name)); err != nil {
+			t.Skipf("cannot link fake %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+// runSvglinkify runs svglinkify in dir with the given arguments and stdin,
+// using the fake inkscape in tools, and returns what it writes to stdout and
+// stderr and its exit status. env is added to its environment, which the
+// fake tools see too.
+func runSvglinkify(t *testing.T, dir, tools, stdin string, env []string, args ...string) (string, string, int) {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(self, append([]string{"-inkscape-path", filepath.Join(tools, "inkscape")}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), asSvglinkifyEnv+"=1", "XDG_CACHE_HOME="+filepath.Join(dir, ".cache"))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+// fakeInkscape is a stand-in for inkscape 1.x, or the version in
+// FAKE_INKSCAPE_VERSION, which computes bounding boxes from the SVG as the
+// rsvg backend does, for all the objects or only those with the ids asked
+// for, and exports a PDF of the size of the SVG without any of its content.
+// Each run, --version included, is logged as a line of its arguments to the
+// file in FAKE_INKSCAPE_LOG.
+func fakeInkscape(args []string) int {
+	if !fakeLog(strings.Join(args, " ")) {
+		return 1
+	}
+	if len(args) == 1 && args[0] == "--shell" {
+		return fakeShell()
+	}
+	return fakeCommand(args)
+}
+
+// fakeLog appends the line to the file in FAKE_INKSCAPE_LOG, if any
+func fakeLog(line string) bool {
+	p := os.Getenv("FAKE_INKSCAPE_LOG")
+	if p == "" {
+		return true
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+	return true
+}
+
+// fakeShell is inkscape 0.92's --shell, which runs each line of its stdin as
+// the arguments of fakeCommand and then prompts for the next with a '>'. The
+// lines are logged with "shell: " in front. FAKE_INKSCAPE_SHELL makes it
+// misbehave: "none" fails to start it as if there were no shell mode,
+// "noisy" has it output lines starting with '>' a bit at a time before each
+// answer about the SVG, as warnings about it may be, "exit" has it exit after its first command and "hang" never
+// answers any.
+func fakeShell() int {
+	mode := os.Getenv("FAKE_INKSCAPE_SHELL")
+	if mode == "none" {
+		fmt.Fprintln(os.Stderr, "unknown option --shell")
+		return 1
+	}
+	fmt.Print("Inkscape 0.92.4 interactive shell mode. Type 'quit' to quit.\n>")
+	in := bufio.NewScanner(os.Stdin)
+	for n := 0; in.Scan(); n++ {
+		line := in.Text()
+		if line == "quit" {
+			return 0
+		}
+		if !fakeLog("shell: " + line) {
+			return 1
+		}
+		switch mode {
+		case "exit":
+			if n > 0 {
+				return 1
+			}
+		case "hang":
+			for ppid := os.Getppid(); os.Getppid() == ppid; {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return 1
+		case "noisy":
+			if strings.Contains(line, "svglinkify-marker") {
+				break
+			}
+			for _, bit := range []string{">", " not a prompt\n>", "> nor this\n"} {
+				fmt.Print(bit)
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		fakeCommand(fakeShellSplit(line))
+		fmt.Print(">")
+	}
+	return 0
+}
+
+// fakeShellSplit splits the command line into arguments as inkscape's shell
+// does, which is enough for those svglinkify quotes with shellQuote
+func fakeShellSplit(line string) []string {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && !quoted:
+			escaped, inArg = true, true
+		case c == '\'':
+			quoted, inArg = !quoted, true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// fakeCommand is a single run of fakeInkscape with the given arguments
+func fakeCommand(args []string) int {
+	if len(args) == 1 && args[0] == "--version" {
+		v := os.Getenv("FAKE_INKSCAPE_VERSION")
+		if v == "" {
+			v = "Inkscape 1.0.2 (e86c870879, 2021-01-15)"
+		}
+		fmt.Println(v)
+		return 0
+	}
+	svgPath := args[len(args)-1]
+	svg, err := ioutil.ReadFile(svgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i, a := range args {
+		var pdfPath string
+		switch {
+		case a == "--query-all" || a == "-S":
+			if !fakeRendezvous("query", "export") || !fakeSucceeds("query") {
+				return 1
+			}
+			return fakeQueryAll(svg)
+		case strings.HasPrefix(a, "--query-id="):
+			return fakeQueryIDs(svg, strings.Split(strings.TrimPrefix(a, "--query-id="), ","), args)
+		case a == "-I":
+			return fakeQueryIDs(svg, []string{args[i+1]}, args)
+		case strings.HasPrefix(a, "--export-filename="):
+			pdfPath = strings.TrimPrefix(a, "--export-filename=")
+		case a == "--export-pdf":
+			pdfPath = args[i+1]
+		default:
+			continue
+		}
+		if !fakeRendezvous("export", "query") || !fakeSucceeds("export") {
+			return 1
+		}
+		if os.Getenv("FAKE_INKSCAPE_HANG") != "" {
+			// Leave a partial PDF behind until killed, or svglinkify is
+			// and this is left an orphan
+			ioutil.WriteFile(pdfPath, []byte("%PDF-1.4\n"), 0666)
+			for ppid := os.Getppid(); os.Getppid() == ppid; {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return 1
+		}
+		return fakeExport(svg, pdfPath)
+	}
+	fmt.Fprintf(os.Stderr, "fake inkscape cannot handle %q\n", args)
+	return 1
+}
+
+// fakeSucceeds is false if the run is the one in FAKE_INKSCAPE_FAIL, "query"
+// or "export", after writing to stderr a warning, a blank line and an error
+// as inkscape would, the error with a Windows line ending
+func fakeSucceeds(run string) bool {
+	if os.Getenv("FAKE_INKSCAPE_FAIL") != run {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "** WARNING **: fake %s warning\n\nfake %s failed\r\n", run, run)
+	return false
+}
+
+// fakeRendezvous marks that this run has started in the directory in
+// FAKE_INKSCAPE_RENDEZVOUS and waits for the other run to do the same, so the
+// two only finish if they run at the same time
+func fakeRendezvous(this, other string) bool {
+	dir := os.Getenv("FAKE_INKSCAPE_RENDEZVOUS")
+	if dir == "" {
+		return true
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, this), nil, 0666); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(dir, other)); err == nil {
+			return true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "fake inkscape %s never ran alongside %s\n", this, other)
+	return false
+}
+
+// fakeQueryAll writes the bounding boxes of the objects in the SVG as inkscape
+// does when queried for all of them, or the content of the file in
+// FAKE_INKSCAPE_QUERY instead. Like inkscape, numbers have a decimal comma in
+// a German locale.
+func fakeQueryAll(svg []byte) int {
+	if p := os.Getenv("FAKE_INKSCAPE_QUERY"); p != "" {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(b)
+		return 0
+	}
+	objects, err := linkify.SVGBoundingBoxes(bytes.NewReader(svg))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ids := make([]string, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	locale := os.Getenv("LC_ALL")
+	if locale == "" {
+		locale = os.Getenv("LC_NUMERIC")
+	}
+	num := func(v float64) string {
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if strings.HasPrefix(locale, "de_") {
+			s = strings.Replace(s, ".", ",", 1)
+		}
+		return s
+	}
+	for _, id := range ids {
+		o := objects[id]
+		fmt.Printf("%s,%s,%s,%s,%s\n", id, num(o.X), num(o.Y), num(o.W), num(o.H))
+	}
+	return 0
+}
+
+// fakeQueryIDs writes the x, y, width or height of the objects with the
+// given ids, as asked for in args, as inkscape does when queried for them
+// with --query-id (or -I by 0.92): a line for each asked for, with the values
+// of all the objects separated by commas. Like inkscape, it fails if any of
+// the ids isn't found.
+func fakeQueryIDs(svg []byte, ids []string, args []string) int {
+	var fields []int
+	for _, a := range args {
+		if f, ok := fakeQueryFields[a]; ok {
+			fields = append(fields, f)
+		}
+	}
+	objects, err := linkify.SVGBoundingBoxes(bytes.NewReader(svg))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lines := make([][]string, len(fields))
+	for _, id := range ids {
+		o := objects[id]
+		if o == nil {
+			fmt.Fprintf(os.Stderr, "Object with id=\"%s\" not found\n", id)
+			return 1
+		}
+		for i, f := range fields {
+			v := [4]float64{o.X, o.Y, o.W, o.H}[f]
+			lines[i] = append(lines[i], strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	}
+	for _, l := range lines {
+		fmt.Println(strings.Join(l, ","))
+	}
+	return 0
+}
+
+// fakeQueryFields are the index among x, y, width and height of what each
+// query option of inkscape asks for
+var fakeQueryFields = map[string]int{
+	"-X": 0, "--query-x": 0,
+	"-Y": 1, "--query-y": 1,
+	"-W": 2, "--query-width": 2,
+	"-H": 3, "--query-height": 3,
+}
+
+// fakeExport writes a PDF with a blank page for each page of the SVG to
+// pdfPath, or only the first half of it if FAKE_INKSCAPE_TRUNCATE is set. The
+// pages are the size in FAKE_INKSCAPE_PAGE_SIZE (WxH in points) if set,
+// rather than of the SVG. The SVG is also copied to FAKE_INKSCAPE_EXPORTED if
+// set, for checking what would have been drawn.
+func fakeExport(svg []byte, pdfPath string) int {
+	if p := os.Getenv("FAKE_INKSCAPE_EXPORTED"); p != "" {
+		if err := ioutil.WriteFile(p, svg, 0666); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	w, h, ok := linkify.ParseSVGSize(string(svg))
+	if !ok {
+		w, h = 600, 400
+	}
+	if size := os.Getenv("FAKE_INKSCAPE_PAGE_SIZE"); size != "" {
+		fmt.Sscanf(size, "%gx%g", &w, &h)
+	}
+	n := bytes.Count(svg, []byte("<inkscape:page "))
+	if n == 0 {
+		n = 1
+	}
+	pdf := fakePDF(n, w, h)
+	if os.Getenv("FAKE_INKSCAPE_TRUNCATE") != "" {
+		pdf = pdf[:len(pdf)/2]
+	}
+	if err := ioutil.WriteFile(pdfPath, pdf, 0666); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// fakeRsvg is a stand-in for rsvg-convert, exporting as fakeInkscape does
+// and failing as it does with FAKE_INKSCAPE_FAIL=export
+func fakeRsvg(args []string) int {
+	svg, err := ioutil.ReadFile(args[len(args)-1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i, a := range args {
+		if a == "--output" {
+			if !fakeSucceeds("export") {
+				return 1
+			}
+			return fakeExport(svg, args[i+1])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "fake rsvg-convert cannot handle %q\n", args)
+	return 1
+}
+
+// fakePDF returns a PDF with n blank pages of w by h points, laid out as
+// cairo does with the page tree first
+func fakePDF(n int, w, h float64) []byte {
+	objs := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	var kids []string
+	for i := 0; i < n; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objs)+1))
+		objs = append(objs, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 %g %g ] /Resources << >> >>", w, h))
+	}
+	objs[1] = fmt.Sprintf("<< /Type /Pages /Kids [ %s ] /Count %d >>", strings.Join(kids, " "), n)
+	return pdfOf(objs...)
+}
+
+// pdfOf returns a PDF holding the given object bodies, numbered from 1, with
+// the first object as the catalog
+func pdfOf(objs ...string) []byte {
+	b := bytes.Buffer{}
+	b.WriteString("%PDF-1.5\n")
+	offs := make([]int, len(objs))
+	for i, o := range objs {
+		offs[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offs {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return b.Bytes()
+}
+
+// writeFile writes content to the file name in dir, creating any directories
+// name has in it, and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// setFlags sets the given command line flags, as name and value pairs, until
+// the end of the test
+func setFlags(t *testing.T, nameValues ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		f := flag.Lookup(nameValues[i])
+		if f == nil {
+			t.Fatalf("no flag -%s", nameValues[i])
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(nameValues[i+1]); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+}
+
+func TestExportArgsBackground(t *testing.T) {
+	for _, c := range []struct {
+		color, opacity string
+		want           []string
+	}{
+		{"", "", nil},
+		{"#ffffff", "", []string{"--export-background", "#ffffff"}},
+		{"#ff000080", "", []string{"--export-background", "#ff0000", "--export-background-opacity", "0.502"}},
+		{"#ffffff", "0.5", []string{"--export-background", "#ffffff", "--export-background-opacity", "0.5"}},
+		{"", "0", []string{"--export-background-opacity", "0"}},
+	} {
+		setFlags(t, "background-color", c.color, "background-opacity", c.opacity)
+		for _, major := range []int{0, 1} {
+			b := &inkscapeBackend{path: "inkscape", major: major}
+			want := append([]string{"--export-dpi", "96"}, c.want...)
+			if major == 0 {
+				want = append(want, "--export-pdf", "out.pdf", "in.svg")
+			} else {
+				want = append(want, "--export-type=pdf", "--export-filename=out.pdf", "in.svg")
+			}
+			if got := b.exportArgs("in.svg", "out.pdf"); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q %q with inkscape %d: got %q, want %q", c.color, c.opacity, major, got, want)
+			}
+		}
+	}
+}
+
+// linkSVG is an 800x600 pixels SVG with an external link on a rect and an
+// internal link to it
+const linkSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="ext" href="https://example.com/"><rect id="r1" x="100" y="100" width="200" height="100"/></a>
+<a id="int" href="#r1"><rect id="r2" x="400" y="300" width="100" height="100"/></a>
+</svg>`
+
+func TestSameInputAndOutput(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	svgPath := writeFile(t, dir, "a.svg", linkSVG)
+	if err := os.Symlink("a.svg", filepath.Join(dir, "link.svg")); err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{"a.svg", "./a.svg", svgPath, "../" + filepath.Base(dir) + "/a.svg", "link.svg"} {
+		_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "a.svg", out)
+		if code == 0 || !strings.Contains(stderr, "input and output must be different files") {
+			t.Errorf("output %s: got status %d and %q, want the guard to stop it", out, code, stderr)
+		}
+		if b, _ := ioutil.ReadFile(svgPath); string(b) != linkSVG {
+			t.Fatalf("output %s: SVG was overwritten", out)
+		}
+	}
+	if _, stderr, code := runSvglinkify(t, dir, tools, "", nil, "a.svg", "a.pdf"); code != 0 {
+		t.Errorf("converting to another file failed with %d: %s", code, stderr)
+	}
+}
+
+func TestResolveToolPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	bin := filepath.Join(home, "bin")
+	if err := os.Mkdir(bin, 0777); err != nil {
+		t.Fatal(err)
+	}
+	ink := writeFile(t, bin, "inkscape", "#!/bin/sh\n")
+	if err := os.Chmod(ink, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, bin, "plain", "")
+	if p, err := resolveToolPath("inkscape", "~/bin/inkscape"); err != nil || p != ink {
+		t.Errorf("~/bin/inkscape resolved to '%s' (%v), want '%s'", p, err, ink)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(home); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if p, err := resolveToolPath("inkscape", "bin/inkscape"); err != nil || p != ink {
+		t.Errorf("bin/inkscape resolved to '%s' (%v), want '%s'", p, err, ink)
+	}
+	for path, want := range map[string]string{
+		"~/bin/missing":      "cannot find inkscape at '" + filepath.Join(bin, "missing") + "'",
+		"bin/plain":          "inkscape at '" + filepath.Join(bin, "plain") + "' is not executable",
+		"~/bin":              "inkscape at '" + bin + "' is not executable",
+		"svglinkify-missing": "cannot find inkscape 'svglinkify-missing' in PATH",
+	} {
+		if _, err := resolveToolPath("inkscape", path); err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %q", path, err, want)
+		}
+	}
+}
+
+func TestParseInkscapeVersion(t *testing.T) {
+	for _, c := range []struct {
+		out          string
+		major, minor int
+		query        string
+	}{
+		{"Inkscape 0.92.4 (5da689c313, 2019-01-14)\n", 0, 92, "-S"},
+		{"Inkscape 0.48.5 r10040 (Jun  5 2014)", 0, 48, "-S"},
+		{"Inkscape 1.0.2 (e86c870879, 2021-01-15)\n", 1, 0, "--query-all"},
+		{"Inkscape 1.2.2 (b0a8486541, 2022-12-01)\n", 1, 2, "--query-all"},
+		// Warnings may come before the version
+		{"Gtk-Message: Failed to load module \"canberra-gtk-module\"\nInkscape 1.3 (0e150ed6c4, 2023-07-21)\n", 1, 3, "--query-all"},
+	} {
+		major, minor, err := parseInkscapeVersion(c.out)
+		if err != nil || major != c.major || minor != c.minor {
+			t.Errorf("%q: got %d.%d (%v), want %d.%d", c.out, major, minor, err, c.major, c.minor)
+		}
+		if q := (&inkscapeBackend{major: major}).queryArg(); q != c.query {
+			t.Errorf("%q: queries with %s, want %s", c.out, q, c.query)
+		}
+	}
+	for _, out := range []string{"", "inkscape: command not found", "Inkscape version unknown"} {
+		if _, _, err := parseInkscapeVersion(out); err == nil {
+			t.Errorf("%q: got a version", out)
+		}
+	}
+}
+
+func TestQueryAllOutput(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+
+	// As inkscape 1.x outputs it, with warnings on stdout too
+	out := "svg1,0,0,800,600\n" +
+		"\n" +
+		"layer1, 1.5e2 ,2.5E+01,1e-3,  40\r\n" +
+		"rect 1,-1.25e1,3,10,20   \n" +
+		"id,with,commas,1,2,3,4\n" +
+		"\n" +
+		"** (org.inkscape.Inkscape:1234): WARNING **: something\n" +
+		"path2,7,8,9,10"
+	t.Setenv("FAKE_INKSCAPE_QUERY", writeFile(t, dir, "query.txt", out))
+	b := &inkscapeBackend{path: filepath.Join(tools, "inkscape"), major: 1}
+	objects, err := b.queryBoundingBoxes(context.Background(), writeFile(t, dir, "a.svg", linkSVG), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*linkify.PositionedObject{
+		"svg1":           {ID: "svg1", W: 800, H: 600},
+		"layer1":         {ID: "layer1", X: 150, Y: 25, W: 0.001, H: 40},
+		"rect 1":         {ID: "rect 1", X: -12.5, Y: 3, W: 10, H: 20},
+		"id,with,commas": {ID: "id,with,commas", X: 1, Y: 2, W: 3, H: 4},
+		"path2":          {ID: "path2", X: 7, Y: 8, W: 9, H: 10},
+	}
+	if !reflect.DeepEqual(objects, want) {
+		for id, o := range objects {
+			t.Logf("%s: %+v", id, *o)
+		}
+		t.Errorf("got %d objects, want %d", len(objects), len(want))
+	}
+}
+
+// stubBackend is a Backend with the given bounding boxes, which renders a
+// blank page
+type stubBackend struct {
+	objects map[string]*linkify.PositionedObject
+}
+
+func (b *stubBackend) BoundingBoxes(ctx context.Context, svgPath, svgContent string, ids []string) (map[string]*linkify.PositionedObject, error) {
+	return b.objects, nil
+}
+
+func (b *stubBackend) Render(ctx context.Context, svgPath, pdfPath string) error {
+	return ioutil.WriteFile(pdfPath, fakePDF(1, 600, 450), 0666)
+}
+
+// captureLog returns what's logged for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	b := &bytes.Buffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func TestMissingBBoxMessage(t *testing.T) {
+	defer func(old Backend) { backend = old }(backend)
+	backend = &stubBackend{objects: map[string]*linkify.PositionedObject{"svg1": {ID: "svg1", W: 800, H: 600}}}
+	dir := t.TempDir()
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="lost" href="https://example.com/100%25?q=%s"><rect id="r" width="10" height="10"/></a>
+</svg>`
+	svgPath := filepath.Join(dir, "a.svg")
+	if err := ioutil.WriteFile(svgPath, []byte(svg), 0666); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := linkify.ScanAnchors(strings.NewReader(svg), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := captureLog(t)
+	defer func(old []string) { badLinks = old }(badLinks)
+	convert(svgPath, svg, filepath.Join(dir, "a.pdf"), "", "", anchors)
+	want := "inkscape didn't tell us the bounding box for link 'https://example.com/100%25?q=%s' - ignoring link\n"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("got log %q, want %q", logged.String(), want)
+	}
+	if strings.Contains(logged.String(), "%!") {
+		t.Errorf("log has a formatting error: %q", logged.String())
+	}
+}
+
+// gzipped returns s compressed as in an .svgz
+func gzipped(s string) string {
+	b := bytes.Buffer{}
+	z := gzip.NewWriter(&b)
+	z.Write([]byte(s))
+	z.Close()
+	return b.String()
+}
+
+func TestReadSVG(t *testing.T) {
+	big := "<svg>" + strings.Repeat(" ", 1000) + "</svg>"
+	for _, c := range []struct {
+		name, in   string
+		max        int64
+		compressed bool
+		err        string
+	}{
+		{"plain", linkSVG, 0, false, ""},
+		{"plain at the limit", big, int64(len(big)), false, ""},
+		{"plain over the limit", big, int64(len(big)) - 1, false, "SVG is larger than 1010 bytes - see -max-svg-size"},
+		{"compressed", gzipped(linkSVG), 0, true, ""},
+		// What counts is the size once decompressed
+		{"compressed over the limit", gzipped(big), 100, true, "SVG is larger than 100 bytes - see -max-svg-size"},
+		{"corrupt", gzipped(big)[:20], 0, true, "cannot decompress SVG: unexpected EOF"},
+	} {
+		got, compressed, err := readSVG(strings.NewReader(c.in), c.max)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else if compressed != c.compressed || (got != linkSVG && got != big) {
+			t.Errorf("%s: got %d bytes, compressed %t", c.name, len(got), compressed)
+		}
+	}
+}
+
+func TestSVGZ(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "docs/a.svgz", gzipped(linkSVG))
+	logPath := filepath.Join(dir, "inkscape.log")
+	env := []string{"FAKE_INKSCAPE_LOG=" + logPath}
+	_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "docs/a.svgz", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	annots := readPDFAnnots(t, pdf)
+	if len(annots) != 2 || annots[0].URI != "https://example.com/" || annots[1].Action != "GoTo" {
+		t.Errorf("got annotations %v, want the two links of the SVG", annots)
+	}
+
+	// Inkscape gets the SVG decompressed next to the .svgz, so relative
+	// references still resolve, and it's removed afterwards
+	runs, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range strings.Split(strings.TrimSpace(string(runs)), "\n") {
+		if run == "--version" {
+			continue
+		}
+		args := strings.Fields(run)
+		if p := args[len(args)-1]; filepath.Dir(p) != filepath.Join(dir, "docs") && filepath.Dir(p) != "docs" ||
+			!strings.HasPrefix(filepath.Base(p), ".svglinkify-") {
+			t.Errorf("inkscape ran on %s, want a decompressed copy in docs", p)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "docs", ".svglinkify-*")); len(left) != 0 {
+		t.Errorf("left behind %v", left)
+	}
+
+	// Compressed SVGs are found for -batch and can come from stdin too
+	_, stderr, code = runSvglinkify(t, dir, tools, "", env, "-no-cache", "-batch", "docs")
+	if code != 0 || !strings.Contains(stderr, "converted 1 of 1 SVG(s)") {
+		t.Fatalf("batch failed with %d: %s", code, stderr)
+	}
+	stdout, stderr, code := runSvglinkify(t, dir, tools, gzipped(linkSVG), env, "-no-cache", "-", "-")
+	if code != 0 {
+		t.Fatalf("stdin failed with %d: %s", code, stderr)
+	}
+	for _, p := range []string{"docs/a.pdf", "-"} {
+		pdf := []byte(stdout)
+		if p != "-" {
+			if pdf, err = ioutil.ReadFile(filepath.Join(dir, p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if annots := readPDFAnnots(t, pdf); len(annots) != 2 {
+			t.Errorf("%s: got annotations %v, want the two links of the SVG", p, annots)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	svg := strings.Replace(linkSVG, "</svg>", `<a id="empty" href="https://e.example/"><g id="eg"/></a>
+</svg>`, 1)
+	writeFile(t, dir, "a.svg", svg)
+	logPath := filepath.Join(dir, "inkscape.log")
+	stdout, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, "-dry-run", "a.svg")
+	want := "" +
+		"ID     URL                   X       Y       W       H       VALID\n" +
+		"ext    https://example.com/  100.00  100.00  200.00  100.00  true\n" +
+		"int    #r1                   400.00  300.00  100.00  100.00  true\n" +
+		"empty  https://e.example/    0.00    0.00    0.00    0.00    false\n"
+	if stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", stdout, want)
+	}
+	if code == 0 || !strings.Contains(stderr, "https://e.example/") {
+		t.Errorf("got status %d and %q, want the empty link reported", code, stderr)
+	}
+	if runs, _ := ioutil.ReadFile(logPath); strings.Contains(string(runs), "export") {
+		t.Errorf("inkscape exported with -dry-run:\n%s", runs)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.pdf")); len(files) > 0 {
+		t.Errorf("-dry-run wrote %v", files)
+	}
+}
+
+func TestListIDs(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	// Out of order, and with a negative position
+	svg := strings.Replace(linkSVG, "</svg>", `<g id="b-group"><rect id="a-rect" x="-10.5" y="20.25" width="30" height="40"/></g>
+</svg>`, 1)
+	writeFile(t, dir, "a.svg", svg)
+	logPath := filepath.Join(dir, "inkscape.log")
+	want := "" +
+		"ID       X       Y       W       H\n" +
+		"a-rect   -10.50  20.25   30.00   40.00\n" +
+		"b-group  -10.50  20.25   30.00   40.00\n" +
+		"ext      100.00  100.00  200.00  100.00\n" +
+		"int      400.00  300.00  100.00  100.00\n" +
+		"r1       100.00  100.00  200.00  100.00\n" +
+		"r2       400.00  300.00  100.00  100.00\n"
+	for _, backend := range []string{BackendInkscape, BackendRsvg} {
+		os.Remove(logPath)
+		env := []string{"FAKE_INKSCAPE_LOG=" + logPath, "PATH=" + tools + string(os.PathListSeparator) + os.Getenv("PATH")}
+		stdout, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "-backend", backend, "-list-ids", "a.svg")
+		if code != 0 {
+			t.Fatalf("%s: failed with %d: %s", backend, code, stderr)
+		}
+		if stdout != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", backend, stdout, want)
+		}
+		if runs, _ := ioutil.ReadFile(logPath); strings.Contains(string(runs), "export") {
+			t.Errorf("%s: exported with -list-ids:\n%s", backend, runs)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.pdf")); len(files) > 0 {
+			t.Errorf("%s: -list-ids wrote %v", backend, files)
+		}
+	}
+
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-list-ids", "-dry-run", "a.svg")
+	if code == 0 || !strings.Contains(stderr, "-list-ids cannot be used with") {
+		t.Errorf("exited with %d: %s, want -list-ids with -dry-run rejected", code, stderr)
+	}
+}
+
+func TestLinksJSONRoundTrip(t *testing.T) {
+	links := []*linkify.PositionedLink{
+		{ID: "ext", URL: "https://example.com/", Title: "Example", X: 100, Y: 100, W: 200, H: 100, Valid: true, Descendants: []string{"r1"}},
+		{ID: "lost", URL: "#nowhere", Aliases: []string{"label"}},
+	}
+	objects := map[string]*linkify.PositionedObject{
+		"r1": {ID: "r1", X: 100, Y: 100, W: 200, H: 100},
+		"a":  {ID: "a", X: 1.5, Y: -2, W: 3, H: 4},
+	}
+	rects := map[*linkify.PositionedLink]*linkify.LinkRect{links[0]: {Page: 0, Rect: [4]float64{75, 300, 225, 375}}}
+	p := filepath.Join(t.TempDir(), "links.json")
+	writeLinksJSON(p, objects, links, rects)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Links   []linkJSON                  `json:"links"`
+		Objects []*linkify.PositionedObject `json:"objects"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Links) != 2 || !reflect.DeepEqual(got.Links[0].PositionedLink, links[0]) ||
+		!reflect.DeepEqual(got.Links[1].PositionedLink, links[1]) {
+		t.Errorf("links don't round trip:\n%s", b)
+	}
+	if !reflect.DeepEqual(got.Links[0].PDF, rects[links[0]]) || got.Links[1].PDF != nil {
+		t.Errorf("PDF rects don't round trip:\n%s", b)
+	}
+	if len(got.Objects) != 2 || *got.Objects[0] != *objects["a"] || *got.Objects[1] != *objects["r1"] {
+		t.Errorf("objects don't round trip, sorted by id:\n%s", b)
+	}
+
+	// The names are what other tools look for
+	var raw struct {
+		Links []map[string]interface{} `json:"links"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"id", "url", "title", "x", "y", "w", "h", "valid", "descendants", "pdf"} {
+		if _, ok := raw.Links[0][key]; !ok {
+			t.Errorf("link has no '%s': %v", key, raw.Links[0])
+		}
+	}
+	if pdf, _ := raw.Links[0]["pdf"].(map[string]interface{}); pdf["page"] != 0.0 || pdf["rect"] == nil {
+		t.Errorf("link has PDF rect %v", raw.Links[0]["pdf"])
+	}
+}
+
+// readLinksJSON returns the links written by -links-out to path
+func readLinksJSON(t *testing.T, path string) []linkJSON {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Links []linkJSON `json:"links"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Links
+}
+
+// readPDFAnnots returns the link annotations on the first page of the PDF
+func readPDFAnnots(t *testing.T, pdf []byte) []*linkify.PDFLinkAnnot {
+	t.Helper()
+	doc, err := linkify.UnmarshalPDFFile(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	annots, err := doc.ReadLinkAnnots(bytes.NewReader(pdf), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return annots
+}
+
+func TestGroupedAnchor(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="a" href="https://example.com/"><g id="g">
+<rect id="r1" x="100" y="100" width="100" height="50"/>
+<rect id="r2" x="300" y="200" width="100" height="100"/>
+</g></a>
+</svg>`)
+
+	// Inkscape leaves out the anchor and group when it doesn't report them
+	query := writeFile(t, dir, "query.txt", "svg1,0,0,800,600\nr1,100,100,100,50\nr2,300,200,100,100\n")
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_QUERY=" + query}, "-no-cache", "-links-out", "links.json", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+	if len(links) != 1 {
+		t.Fatalf("got %d links, want 1", len(links))
+	}
+	l := links[0]
+	if l.X != 100 || l.Y != 100 || l.W != 300 || l.H != 200 || !l.Valid {
+		t.Errorf("link is at %g,%g size %gx%g, want the union 100,100 size 300x200", l.X, l.Y, l.W, l.H)
+	}
+	if l.PDF == nil || l.PDF.Rect != [4]float64{75, 225, 300, 375} {
+		t.Errorf("link is at %+v in the PDF, want [ 75 225 300 375 ]", l.PDF)
+	}
+}
+
+func TestInkscapeArgs(t *testing.T) {
+	defer func(old stringsFlag) { inkscapeArgs = old }(inkscapeArgs)
+	inkscapeArgs = nil
+	fs := flag.NewFlagSet("svglinkify", flag.ContinueOnError)
+	fs.Var(&inkscapeArgs, "inkscape-arg", "")
+	if err := fs.Parse([]string{"-inkscape-arg", "--export-text-to-path", "-inkscape-arg=--export-area-page", "-inkscape-arg", "--export-pdf-version=1.5"}); err != nil {
+		t.Fatal(err)
+	}
+	extra := []string{"--export-text-to-path", "--export-area-page", "--export-pdf-version=1.5"}
+	for major, out := range map[int][]string{
+		0: {"--export-pdf", "out.pdf", "in.svg"},
+		1: {"--export-type=pdf", "--export-filename=out.pdf", "in.svg"},
+	} {
+		want := append(append([]string{"--export-dpi", "96"}, extra...), out...)
+		if got := (&inkscapeBackend{major: major}).exportArgs("in.svg", "out.pdf"); !reflect.DeepEqual(got, want) {
+			t.Errorf("inkscape %d: got %q, want %q", major, got, want)
+		}
+	}
+
+	// And through to inkscape itself
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath},
+		"-inkscape-arg", "--export-text-to-path", "-inkscape-arg", "--export-area-page", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	runs, _ := ioutil.ReadFile(logPath)
+	if !regexp.MustCompile(`(?m)^--export-dpi 96 --export-text-to-path --export-area-page --export-type=pdf --export-filename=\S+ \S+$`).Match(runs) {
+		t.Errorf("inkscape didn't export with the extra arguments in order:\n%s", runs)
+	}
+}
+
+func TestExportDPIKeepsPlacement(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	for _, dpi := range []string{"72", "96", "300"} {
+		_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, "-dpi", dpi, "-links-out", "links.json", "a.svg", "a.pdf")
+		if code != 0 {
+			t.Fatalf("-dpi %s failed with %d: %s", dpi, code, stderr)
+		}
+		// -dpi is only the resolution filters are rasterized at
+		links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+		if len(links) != 2 || links[0].PDF == nil || links[0].PDF.Rect != [4]float64{75, 300, 225, 375} {
+			t.Errorf("-dpi %s: got links %+v, want the first at [ 75 300 225 375 ]", dpi, links)
+		}
+		if runs, _ := ioutil.ReadFile(logPath); !strings.Contains(string(runs), "--export-dpi "+dpi+" ") {
+			t.Errorf("-dpi %s not passed to inkscape:\n%s", dpi, runs)
+		}
+	}
+}
+
+func TestSkipRender(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+
+	// As another tool may write it, with the page size and rotation given
+	// once for all pages in the root of a nested page tree
+	pdf := pdfOf(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [ 3 0 R ] /Count 1 /MediaBox [ 0 0 450 600 ] /Rotate 90 >>",
+		"<< /Type /Pages /Parent 2 0 R /Kids [ 4 0 R ] /Count 1 >>",
+		"<< /Type /Page /Parent 3 0 R /Resources << >> >>",
+	)
+	pdfPath := filepath.Join(dir, "a.pdf")
+	if err := ioutil.WriteFile(pdfPath, pdf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "inkscape.log")
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, "-skip-render", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	if strings.Contains(stderr, "links may be misplaced") {
+		t.Errorf("inherited page size was not used: %s", stderr)
+	}
+	if runs, _ := ioutil.ReadFile(logPath); strings.Contains(string(runs), "export") {
+		t.Errorf("inkscape exported with -skip-render:\n%s", runs)
+	}
+
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := linkify.UnmarshalPDFFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annots, err := doc.ReadLinkAnnots(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annots) != 2 {
+		t.Fatalf("got %d annotations, want 2", len(annots))
+	}
+	// The page is shown turned a quarter clockwise, so the top left of the
+	// SVG is at the bottom left of the media box
+	if want := [4]float64{75, 75, 150, 225}; annots[0].Rect != want {
+		t.Errorf("link is at %v, want %v", annots[0].Rect, want)
+	}
+}
+
+func TestMungedIDs(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" width="800" height="600">
+<a id="a1" data-svglinkify-id="buy" inkscape:label="Buy button" href="https://example.com/buy"><rect width="10" height="10"/></a>
+<a id="a2" inkscape:label="help" href="https://example.com/help"><rect width="10" height="10"/></a>
+<a id="a3" inkscape:label="gone" href="https://example.com/gone"><rect width="10" height="10"/></a>
+</svg>`)
+
+	// Inkscape reports the anchors by other ids than they had, which are
+	// those the aliases give
+	query := writeFile(t, dir, "query.txt", "svg1,0,0,800,600\nbuy,100,100,200,100\nBuy button,0,0,1,1\nhelp,400,300,100,100\n")
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_QUERY=" + query}, "-no-cache", "-links-out", "links.json", "a.svg", "a.pdf")
+	if code == 0 || !strings.Contains(stderr, "https://example.com/gone") {
+		t.Errorf("got status %d and %q, want the link with no alias reported", code, stderr)
+	}
+	links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+	if len(links) != 3 {
+		t.Fatalf("got %d links, want 3", len(links))
+	}
+	for i, want := range []struct {
+		aliases    []string
+		x, y, w, h float64
+		valid      bool
+	}{
+		// data-svglinkify-id goes before the label
+		{[]string{"buy", "Buy button"}, 100, 100, 200, 100, true},
+		{[]string{"help"}, 400, 300, 100, 100, true},
+		{[]string{"gone"}, 0, 0, 0, 0, false},
+	} {
+		l := links[i]
+		if !reflect.DeepEqual(l.Aliases, want.aliases) || l.X != want.x || l.Y != want.y || l.W != want.w || l.H != want.h || l.Valid != want.valid {
+			t.Errorf("link %s: got %+v, want %+v", l.ID, *l.PositionedLink, want)
+		}
+	}
+}
+
+func TestQueryAndExportOverlap(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	meet := filepath.Join(dir, "meet")
+	if err := os.Mkdir(meet, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// Either run fails unless the other starts before it finishes
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_RENDEZVOUS=" + meet}, "-no-cache", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	for _, run := range []string{"query", "export"} {
+		if _, err := os.Stat(filepath.Join(meet, run)); err != nil {
+			t.Errorf("inkscape %s didn't run: %s", run, err)
+		}
+	}
+}
+
+func TestBoundingBoxCache(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	queries := 0
+	run := func(what string, wantQuery bool, env ...string) {
+		t.Helper()
+		_, stderr, code := runSvglinkify(t, dir, tools, "", append(env, "FAKE_INKSCAPE_LOG="+logPath), "-links-out", "links.json", "a.svg", "a.pdf")
+		if code != 0 {
+			t.Fatalf("%s: failed with %d: %s", what, code, stderr)
+		}
+		runs, _ := ioutil.ReadFile(logPath)
+		n := strings.Count(string(runs), "--query-all")
+		if queried := n > queries; queried != wantQuery {
+			t.Errorf("%s: queried inkscape is %t, want %t", what, queried, wantQuery)
+		}
+		queries = n
+		if links := readLinksJSON(t, filepath.Join(dir, "links.json")); len(links) != 2 || !links[0].Valid || !links[1].Valid {
+			t.Errorf("%s: got links %+v, want both placed", what, links)
+		}
+	}
+	run("miss", true)
+	run("hit", false)
+	if m, _ := filepath.Glob(filepath.Join(dir, ".cache", "svglinkify", "*.json")); len(m) != 1 {
+		t.Errorf("got cache files %q, want one", m)
+	}
+
+	// Any change to the SVG or inkscape misses
+	writeFile(t, dir, "a.svg", strings.Replace(linkSVG, "https://example.com/", "https://example.org/", 1))
+	run("changed SVG", true)
+	run("changed SVG hit", false)
+	run("other inkscape", true, "FAKE_INKSCAPE_VERSION=Inkscape 1.1 (c4e8f9e, 2021-05-24)")
+
+	// And -no-cache always asks
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, "-no-cache", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("-no-cache: failed with %d: %s", code, stderr)
+	}
+	if runs, _ := ioutil.ReadFile(logPath); strings.Count(string(runs), "--query-all") != queries+1 {
+		t.Errorf("-no-cache didn't query inkscape")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	start := time.Now()
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_HANG=1"}, "-no-cache", "-timeout", "500ms", "a.svg", "a.pdf")
+	if code == 0 {
+		t.Fatal("hung render succeeded")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("took %s to give up after a timeout of 500ms", d)
+	}
+	if !strings.Contains(stderr, "context deadline exceeded") {
+		t.Errorf("got %q, want the timeout reported", stderr)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*.pdf"))
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*"))
+	if left = append(left, hidden...); len(left) != 0 {
+		t.Errorf("left %q behind", left)
+	}
+}
+
+func TestFailedLinkifyLeavesNoPDF(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	old := writeFile(t, dir, "old.pdf", "an earlier PDF")
+	env := []string{"FAKE_INKSCAPE_TRUNCATE=1"}
+	for _, out := range []string{"new.pdf", "old.pdf"} {
+		_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "a.svg", out)
+		if code == 0 || !strings.Contains(stderr, "cannot find startxref") {
+			t.Fatalf("%s: adding links to a truncated PDF exited with %d: %s", out, code, stderr)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.pdf")); !os.IsNotExist(err) {
+		t.Errorf("broken new.pdf was left behind: %v", err)
+	}
+	if v, _ := ioutil.ReadFile(old); string(v) != "an earlier PDF" {
+		t.Errorf("old.pdf was replaced with %q", v)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*")); len(m) != 0 {
+		t.Errorf("left %q behind", m)
+	}
+}
+
+func TestCrashBeforeRename(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	old := writeFile(t, dir, "a.pdf", "an earlier PDF")
+	if err := os.Chmod(old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill svglinkify once inkscape has rendered to the temporary file
+	cmd := exec.Command(self, "-inkscape-path", filepath.Join(tools, "inkscape"), "-no-cache", "a.svg", "a.pdf")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), asSvglinkifyEnv+"=1", "FAKE_INKSCAPE_HANG=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*.pdf"))
+		if len(m) == 1 {
+			if v, _ := ioutil.ReadFile(m[0]); len(v) > 0 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatal("inkscape never rendered")
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if v, _ := ioutil.ReadFile(old); string(v) != "an earlier PDF" {
+		t.Errorf("a.pdf was replaced with %q", v)
+	}
+
+	// And once it's done, the PDF keeps its permissions
+	if _, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "a.svg", "a.pdf"); code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	if fi, err := os.Stat(old); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("a.pdf has mode %v, want 0600", fi.Mode())
+	}
+}
+
+func TestStdin(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	_, stderr, code := runSvglinkify(t, dir, tools, linkSVG, nil, "-no-cache", "-", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annots := readPDFAnnots(t, pdf); len(annots) != 2 || annots[0].URI != "https://example.com/" {
+		t.Errorf("got annotations %v, want the two links of the SVG", annots)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*")); len(m) != 0 {
+		t.Errorf("left %q behind", m)
+	}
+}
+
+func TestStdout(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	stdout, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-v", "-check-output", "a.svg", "-")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "%PDF-") || !strings.HasSuffix(stdout, "\n%%EOF") {
+		t.Fatalf("stdout isn't only a PDF: %q", stdout)
+	}
+	if annots := readPDFAnnots(t, []byte(stdout)); len(annots) != 2 || annots[0].URI != "https://example.com/" {
+		t.Errorf("got annotations %v, want the two links of the SVG", annots)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*")); len(m) != 0 {
+		t.Errorf("left %q behind", m)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "docs/a.svg", linkSVG)
+	writeFile(t, dir, "docs/sub/b.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	env := []string{"FAKE_INKSCAPE_LOG=" + logPath}
+	_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "-jobs", "2", "-batch", "docs")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stderr, "converted 2 of 2 SVG(s)") {
+		t.Errorf("got %q, want both reported converted", stderr)
+	}
+	for _, p := range []string{"docs/a.pdf", "docs/sub/b.pdf"} {
+		pdf, err := ioutil.ReadFile(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if annots := readPDFAnnots(t, pdf); len(annots) != 2 {
+			t.Errorf("%s: got annotations %v, want the two links of the SVG", p, annots)
+		}
+	}
+	// Inkscape is asked for its version once for all of them
+	if runs, _ := ioutil.ReadFile(logPath); strings.Count(string(runs), "--version") != 1 {
+		t.Errorf("inkscape wasn't asked for its version once:\n%s", runs)
+	}
+
+	// One failing doesn't stop the other
+	writeFile(t, dir, "docs/sub/b.svg", strings.Replace(linkSVG, "<a ", `<a data-link-rect="bad" `, 1))
+	_, stderr, code = runSvglinkify(t, dir, tools, "", env, "-no-cache", "-batch", "docs")
+	if code == 0 {
+		t.Fatal("batch with a broken SVG succeeded")
+	}
+	if !strings.Contains(stderr, "converted 1 of 2 SVG(s)") || !strings.Contains(stderr, "failed: "+filepath.Join("docs", "sub", "b.svg")) {
+		t.Errorf("got %q, want b.svg reported failed", stderr)
+	}
+
+	// An SVG named like an option is converted too
+	dir = t.TempDir()
+	writeFile(t, dir, "-x.svg", linkSVG)
+	_, stderr, code = runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-batch", ".")
+	if code != 0 || !strings.Contains(stderr, "converted 1 of 1 SVG(s)") {
+		t.Fatalf("exited with %d: %s, want -x.svg converted", code, stderr)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "-x.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annots := readPDFAnnots(t, pdf); len(annots) != 2 {
+		t.Errorf("got annotations %v, want the two links of -x.svg", annots)
+	}
+}
+
+func TestAnchorWithoutID(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a href="https://example.com/"><rect id="r1" x="100" y="100" width="200" height="100"/></a>
+</svg>`)
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-query-ids", "-links-out", "links.json", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+	if len(links) != 1 || !links[0].Valid || !links[0].SyntheticID || !strings.HasPrefix(links[0].ID, "svglinkify-") {
+		t.Fatalf("got links %+v, want one placed with a synthetic id", links)
+	}
+	if l := links[0]; l.X != 100 || l.Y != 100 || l.W != 200 || l.H != 100 {
+		t.Errorf("link is at %g,%g %gx%g, want r1's box", l.X, l.Y, l.W, l.H)
+	}
+}
+
+func TestUseOfSymbol(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="800" height="600">
+<defs><symbol id="button"><rect x="0" y="0" width="50" height="20"/></symbol></defs>
+<a id="a1" href="https://example.com/"><use id="u1" xlink:href="#button" x="100" y="200" transform="translate(10,0)"/></a>
+</svg>`)
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-links-out", "links.json", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+	if len(links) != 1 || !links[0].Valid {
+		t.Fatalf("got links %+v, want one placed", links)
+	}
+	if l := links[0]; l.X != 110 || l.Y != 200 || l.W != 50 || l.H != 20 {
+		t.Errorf("link is at %g,%g %gx%g, want the used symbol at 110,200 50x20", l.X, l.Y, l.W, l.H)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page is 600x450 pt
+	if annots := readPDFAnnots(t, pdf); len(annots) != 1 || annots[0].Rect != [4]float64{82.5, 285, 120, 300} {
+		t.Errorf("got annotations %v, want one at [82.5 285 120 300]", annots)
+	}
+}
+
+func TestContentHighlight(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	exported := filepath.Join(dir, "exported.svg")
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_EXPORTED=" + exported},
+		"-no-cache", "-highlight", "-highlight-mode", "content", "-highlight-color", "#ff8000", "-highlight-opacity", "0.5", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+
+	// The highlights are drawn behind the rest of the SVG at the links
+	svg, err := ioutil.ReadFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">` +
+		`<rect x="100" y="100" width="200" height="100" rx="0" fill="#ff8000" fill-opacity="0.5" stroke="none"/>` +
+		`<rect x="400" y="300" width="100" height="100" rx="0" fill="#ff8000" fill-opacity="0.5" stroke="none"/>`
+	if !strings.HasPrefix(string(svg), want) {
+		t.Errorf("exported SVG doesn't start with the highlights:\n%s", svg)
+	}
+
+	// and not as appearances of the links
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annots := readPDFAnnots(t, pdf); len(annots) != 2 {
+		t.Errorf("got annotations %v, want the two links", annots)
+	}
+	if bytes.Contains(pdf, []byte("/AP")) {
+		t.Error("links have appearances as well")
+	}
+}
+
+func TestLetterPageSize(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-page-size", "letter", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := linkify.UnmarshalPDFFile(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := doc.Kids[0].ShownSize(); w != 612 || h != 792 {
+		t.Errorf("page is %gx%g points, want letter", w, h)
+	}
+	// The 800x600 drawing is scaled by 0.765 to fit the width and centered
+	// down the page
+	annots := readPDFAnnots(t, pdf)
+	if len(annots) != 2 {
+		t.Fatalf("got %d annotations, want 2", len(annots))
+	}
+	want := [4]float64{76.5, 472.5, 229.5, 549}
+	for i := range want {
+		if math.Abs(annots[0].Rect[i]-want[i]) > 1e-3 {
+			t.Errorf("link is at %v, want %v", annots[0].Rect, want)
+			break
+		}
+	}
+
+	// A page of another size than asked for is an error
+	_, stderr, code = runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_PAGE_SIZE=600x450"}, "-no-cache", "-page-size", "letter", "a.svg", "b.pdf")
+	if code == 0 || !strings.Contains(stderr, "exported a 600x450 points page instead of 612x792") {
+		t.Errorf("exited with %d: %s, want the wrong page size reported", code, stderr)
+	}
+}
+
+func TestBogusInkscapePath(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	plain := writeFile(t, dir, "plain", "")
+	bogus := filepath.Join(dir, "bogus", "inkscape")
+	for path, want := range map[string]string{
+		bogus: "cannot find inkscape at '" + bogus + "' - install Inkscape (https://inkscape.org) or fix -inkscape-path\n",
+		plain: "inkscape at '" + plain + "' is not executable - install Inkscape (https://inkscape.org) or fix -inkscape-path\n",
+		"":    "cannot find inkscape in PATH - install Inkscape (https://inkscape.org) or give the path to it with -inkscape-path\n",
+	} {
+		// The last -inkscape-path replaces the fake one
+		_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-inkscape-path", path, "a.svg", "a.pdf")
+		if code == 0 || stderr != want {
+			t.Errorf("-inkscape-path '%s': exited with %d: %q, want %q", path, code, stderr, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.pdf")); !os.IsNotExist(err) {
+		t.Errorf("a.pdf was written: %v", err)
+	}
+}
+
+func TestNoBBoxes(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	// One link can be placed without a bounding box
+	writeFile(t, dir, "a.svg", strings.Replace(linkSVG, `<a id="ext"`, `<a id="ext" data-link-rect="100,100,200,100"`, 1))
+	env := []string{"FAKE_INKSCAPE_QUERY=" + writeFile(t, dir, "query.txt", "")}
+	_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "a.svg", "a.pdf")
+	if code == 0 || !strings.Contains(stderr, "inkscape gave no bounding boxes at all, so links without data-link-rect cannot be placed - use -no-bboxes warn to write the PDF anyway") {
+		t.Errorf("exited with %d: %s, want no bounding boxes to be an error", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.pdf")); !os.IsNotExist(err) {
+		t.Errorf("a.pdf was written: %v", err)
+	}
+
+	_, stderr, code = runSvglinkify(t, dir, tools, "", env, "-no-cache", "-no-bboxes", "warn", "a.svg", "a.pdf")
+	if !strings.Contains(stderr, "inkscape gave no bounding boxes at all, so links without data-link-rect cannot be placed\n") {
+		t.Errorf("got %q, want a warning about no bounding boxes", stderr)
+	}
+	// The link that needs one is still reported as lost
+	if code == 0 {
+		t.Error("lost link didn't fail the conversion")
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annots := readPDFAnnots(t, pdf); len(annots) != 1 || annots[0].URI != "https://example.com/" {
+		t.Errorf("got annotations %v, want only the link with data-link-rect", annots)
+	}
+}
+
+func TestQueryLocale(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	svgPath := writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="a1" href="https://example.com/"><rect id="r1" x="100.5" y="50.25" width="200" height="99.5"/></a>
+</svg>`)
+
+	// Left to itself in a German locale, inkscape writes decimal commas
+	cmd := exec.Command(filepath.Join(tools, "inkscape"), "--query-all", svgPath)
+	cmd.Env = append(os.Environ(), "LC_ALL=de_DE.UTF-8")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "r1,100,5,50,25,200,99,5\n") {
+		t.Fatalf("fake inkscape doesn't write decimal commas: %q", out)
+	}
+
+	// but it's queried in the C locale
+	env := []string{"LC_ALL=de_DE.UTF-8", "LC_NUMERIC=de_DE.UTF-8", "LANG=de_DE.UTF-8"}
+	_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "-links-out", "links.json", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+	if len(links) != 1 || !links[0].Valid || links[0].X != 100.5 || links[0].Y != 50.25 || links[0].W != 200 || links[0].H != 99.5 {
+		t.Errorf("got links %+v, want one at 100.5,50.25 200x99.5", links)
+	}
+}
+
+func TestKeepIntermediate(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-keep-intermediate", "raw.pdf", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "raw.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What the fake inkscape exports for the 800x600 SVG
+	if want := fakePDF(1, 600, 450); !bytes.Equal(raw, want) {
+		t.Errorf("intermediate PDF is\n%s\nwant\n%s", raw, want)
+	}
+	if annots := readPDFAnnots(t, raw); len(annots) != 0 {
+		t.Errorf("intermediate PDF has links %v", annots)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, raw) || len(readPDFAnnots(t, pdf)) != 2 {
+		t.Error("linked PDF isn't the intermediate one with the links added")
+	}
+}
+
+func TestDuplicateIDs(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="a1" href="https://example.com/1"><rect id="r1" x="100" y="100" width="200" height="100"/></a>
+<a id="a1" href="https://example.com/2"><rect id="r1" x="400" y="300" width="100" height="100"/></a>
+</svg>`)
+	for _, c := range []struct {
+		name string
+		env  []string
+	}{
+		{"svg boxes", nil},
+		// inkscape lists every element, those with the same id in
+		// document order
+		{"inkscape query", []string{"FAKE_INKSCAPE_QUERY=" + writeFile(t, dir, "query.txt",
+			"svg1,0,0,800,600\na1,100,100,200,100\nr1,100,100,200,100\na1,400,300,100,100\nr1,400,300,100,100\n")}},
+	} {
+		_, stderr, code := runSvglinkify(t, dir, tools, "", c.env, "-no-cache", "-links-out", "links.json", "a.svg", "a.pdf")
+		if code != 0 {
+			t.Fatalf("%s: failed with %d: %s", c.name, code, stderr)
+		}
+		if !strings.Contains(stderr, "more than one element has each of the ids a1, r1 - the first with each is used") {
+			t.Errorf("%s: got %q, want a warning about a1 and r1", c.name, stderr)
+		}
+		links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+		if len(links) != 2 {
+			t.Fatalf("%s: got %d links, want 2", c.name, len(links))
+		}
+		for _, l := range links {
+			if !l.Valid || l.X != 100 || l.Y != 100 || l.W != 200 || l.H != 100 {
+				t.Errorf("%s: link to %s is at %g,%g %gx%g, want the first a1's box", c.name, l.URL, l.X, l.Y, l.W, l.H)
+			}
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	for _, c := range []struct {
+		args []string
+		w, h float64
+		rect [4]float64
+	}{
+		{[]string{"-scale", "1"}, 600, 450, [4]float64{75, 300, 225, 375}},
+		{[]string{"-scale", "2"}, 1200, 900, [4]float64{150, 600, 450, 750}},
+		// -dpi is only the resolution of filters, whatever the scale
+		{[]string{"-scale", "2", "-dpi", "192"}, 1200, 900, [4]float64{150, 600, 450, 750}},
+	} {
+		name := strings.Join(c.args, " ")
+		os.Remove(logPath)
+		args := append(append([]string{"-no-cache"}, c.args...), "a.svg", "a.pdf")
+		_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, args...)
+		if code != 0 {
+			t.Fatalf("%s: failed with %d: %s", name, code, stderr)
+		}
+		pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := linkify.UnmarshalPDFFile(bytes.NewReader(pdf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, h := doc.Kids[0].ShownSize(); w != c.w || h != c.h {
+			t.Errorf("%s: page is %gx%g points, want %gx%g", name, w, h, c.w, c.h)
+		}
+		annots := readPDFAnnots(t, pdf)
+		if len(annots) != 2 {
+			t.Fatalf("%s: got %d annotations, want 2", name, len(annots))
+		}
+		for i := range c.rect {
+			if math.Abs(annots[0].Rect[i]-c.rect[i]) > 1e-3 {
+				t.Errorf("%s: link is at %v, want %v", name, annots[0].Rect, c.rect)
+				break
+			}
+		}
+		log, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dpi := strings.Contains(string(log), "--export-dpi 192"); dpi != strings.Contains(name, "-dpi") {
+			t.Errorf("%s: inkscape was run as %q", name, log)
+		}
+	}
+
+	// A page of another size than the scaled one is an error
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_PAGE_SIZE=600x450"}, "-no-cache", "-scale", "2", "a.svg", "b.pdf")
+	if code == 0 || !strings.Contains(stderr, "exported a 600x450 points page instead of 1200x900") {
+		t.Errorf("exited with %d: %s, want the wrong page size reported", code, stderr)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600">
+<a id="ext" href="https://example.com/"><rect id="r1" x="100" y="100" width="200" height="100"/></a>
+<a id="int" href="#r1"><rect id="r2" x="400" y="300" width="100" height="100"/></a>
+<a id="off" href="https://example.com/off"><rect id="r3" x="900" y="100" width="100" height="100"/></a>
+<a id="top" href="#action:firstpage"><rect id="r4" x="600" y="100" width="100" height="100"/></a>
+</svg>`)
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "a.svg", "a.pdf")
+	if code != 0 {
+		t.Fatalf("failed with %d: %s", code, stderr)
+	}
+	if want := "4 link(s) found (2 internal, 2 external), 3 placed in the PDF and 1 left out"; !strings.Contains(stderr, want) {
+		t.Errorf("got %q, want %q", stderr, want)
+	}
+	_, stderr, code = runSvglinkify(t, dir, tools, "", nil, "-no-cache", "-quiet", "a.svg", "a.pdf")
+	if code != 0 || strings.Contains(stderr, "link(s) found") {
+		t.Errorf("exited with %d: %q, want no summary with -quiet", code, stderr)
+	}
+}
+
+func TestQueryIDs(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	queries := func() []string {
+		t.Helper()
+		b, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q []string
+		for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			if strings.Contains(l, "-I ") || strings.Contains(l, "--query") || strings.HasPrefix(l, "-S ") {
+				q = append(q, l)
+			}
+		}
+		return q
+	}
+	checkLinks := func(name string) {
+		t.Helper()
+		links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+		if len(links) != 2 {
+			t.Fatalf("%s: got %d links, want 2", name, len(links))
+		}
+		if l := links[0]; !l.Valid || l.X != 100 || l.Y != 100 || l.W != 200 || l.H != 100 {
+			t.Errorf("%s: ext is at %g,%g %gx%g, want r1's box", name, l.X, l.Y, l.W, l.H)
+		}
+		if l := links[1]; !l.Valid || l.X != 400 || l.Y != 300 || l.W != 100 || l.H != 100 {
+			t.Errorf("%s: int is at %g,%g %gx%g, want r2's box", name, l.X, l.Y, l.W, l.H)
+		}
+	}
+	for _, c := range []struct {
+		name, version string
+		want          []string
+	}{
+		// The links, what's in them and the target of the internal one,
+		// all in one run
+		{"inkscape 1", "", []string{"--query-id=ext,r1,int,r2 --query-x --query-y --query-width --query-height"}},
+		// and a run for each with 0.92 without a shell mode, see
+		// TestInkscapeShell
+		{"inkscape 0.92", "Inkscape 0.92.4 (5da689c313, 2019-01-14)", []string{"-I ext -X -Y -W -H", "-I int -X -Y -W -H", "-I r1 -X -Y -W -H", "-I r2 -X -Y -W -H"}},
+	} {
+		os.Remove(logPath)
+		env := []string{"FAKE_INKSCAPE_LOG=" + logPath, "FAKE_INKSCAPE_SHELL=none"}
+		if c.version != "" {
+			env = append(env, "FAKE_INKSCAPE_VERSION="+c.version)
+		}
+		_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-query-ids", "-links-out", "links.json", "a.svg", "a.pdf")
+		if code != 0 {
+			t.Fatalf("%s: failed with %d: %s", c.name, code, stderr)
+		}
+		q := queries()
+		sort.Strings(q)
+		if len(q) != len(c.want) {
+			t.Fatalf("%s: inkscape was queried with %q, want %q", c.name, q, c.want)
+		}
+		for i := range q {
+			if !strings.HasPrefix(q[i], c.want[i]+" ") {
+				t.Errorf("%s: inkscape was queried with %q, want %q", c.name, q[i], c.want[i])
+			}
+		}
+		checkLinks(c.name)
+	}
+
+	// An id inkscape can't find fails the run, and one with a comma can't be
+	// given, so all the objects are queried instead
+	for _, svg := range []string{
+		strings.Replace(linkSVG, `href="#r1"`, `href="#missing"`, 1),
+		strings.Replace(linkSVG, `id="ext"`, `id="e,xt"`, 1),
+	} {
+		writeFile(t, dir, "b.svg", svg)
+		os.Remove(logPath)
+		_, stderr, _ := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, "-query-ids", "b.svg", "b.pdf")
+		if q := queries(); len(q) == 0 || !strings.HasPrefix(q[len(q)-1], "--query-all ") {
+			t.Errorf("inkscape was queried with %q, want all objects at the end: %s", q, stderr)
+		}
+	}
+}
+
+func TestIDQueryBoxes(t *testing.T) {
+	boxes := idQueryBoxes([]byte("1,10.5\n2,20\n3,30\n4,40e1\n"), 2)
+	want := []linkify.PositionedObject{{X: 1, Y: 2, W: 3, H: 4}, {X: 10.5, Y: 20, W: 30, H: 400}}
+	if !reflect.DeepEqual(boxes, want) {
+		t.Errorf("got %v, want %v", boxes, want)
+	}
+	for _, out := range []string{"", "1\n2\n3\n", "1,2\n2\n3\n4\n", "1\n2\n3\nx\n", "** (inkscape:1): WARNING **\n"} {
+		if boxes := idQueryBoxes([]byte(out), 1); boxes != nil {
+			t.Errorf("%q: got %v, want nothing", out, boxes)
+		}
+	}
+}
+
+func TestInkscapeShell(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	ids := []string{"ext", "int", "r1", "r2"}
+	queries := func(prefix string) []string {
+		t.Helper()
+		b, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q []string
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(l, prefix+"-I ") && !strings.Contains(l, "svglinkify-marker") {
+				q = append(q, strings.Fields(strings.TrimPrefix(l, prefix))[1])
+			}
+		}
+		sort.Strings(q)
+		return q
+	}
+	for _, c := range []struct {
+		mode string
+		// whether the ids are queried in the shell or each in a run
+		// of its own
+		inShell, ownRuns bool
+	}{
+		{"", true, false},
+		// Without a shell, or with one that exits, the ids each get a
+		// run of their own (after the first with the shell exiting)
+		{"none", false, true},
+		{"exit", false, true},
+	} {
+		os.Remove(logPath)
+		env := []string{"FAKE_INKSCAPE_LOG=" + logPath, "FAKE_INKSCAPE_SHELL=" + c.mode, "TMPDIR=" + dir,
+			"FAKE_INKSCAPE_VERSION=Inkscape 0.92.4 (5da689c313, 2019-01-14)"}
+		_, stderr, code := runSvglinkify(t, dir, tools, "", env, "-no-cache", "-query-ids", "-links-out", "links.json", "a.svg", "a.pdf")
+		if code != 0 {
+			t.Fatalf("shell %q: failed with %d: %s", c.mode, code, stderr)
+		}
+		if got := queries("shell: "); c.inShell != reflect.DeepEqual(got, ids) {
+			t.Errorf("shell %q: queried %v in the shell", c.mode, got)
+		}
+		if got := queries(""); c.ownRuns != reflect.DeepEqual(got, ids) {
+			t.Errorf("shell %q: queried %v in runs of their own", c.mode, got)
+		}
+		links := readLinksJSON(t, filepath.Join(dir, "links.json"))
+		if len(links) != 2 || links[0].X != 100 || links[0].Y != 100 || links[0].W != 200 || links[0].H != 100 ||
+			links[1].X != 400 || links[1].Y != 300 || links[1].W != 100 || links[1].H != 100 {
+			t.Errorf("shell %q: got links %+v, want them on r1 and r2", c.mode, links)
+		}
+		if m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*")); len(m) != 0 {
+			t.Errorf("shell %q: left %q behind", c.mode, m)
+		}
+	}
+
+	// A shell that stops answering is given up on with the timeout
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_SHELL=hang", "TMPDIR=" + dir,
+		"FAKE_INKSCAPE_VERSION=Inkscape 0.92.4 (5da689c313, 2019-01-14)"}, "-no-cache", "-query-ids", "-timeout", "500ms", "a.svg", "b.pdf")
+	if code == 0 || !strings.Contains(stderr, "inkscape was stopped while calculating bounding boxes") {
+		t.Errorf("exited with %d: %s, want the timeout reported", code, stderr)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".svglinkify-*")); len(m) != 0 {
+		t.Errorf("left %q behind", m)
+	}
+}
+
+func TestInkscapeShellOutput(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	svgPath := writeFile(t, dir, "a.svg", linkSVG)
+	t.Setenv("TMPDIR", dir)
+
+	// Output that looks like prompts and comes in bits is no end to an
+	// answer
+	t.Setenv("FAKE_INKSCAPE_SHELL", "noisy")
+	s, err := startInkscapeShell(context.Background(), filepath.Join(tools, "inkscape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ id, want string }{
+		{"r1", "100\n100\n200\n100\n"},
+		{"r2", "400\n300\n100\n100\n"},
+	} {
+		out, err := s.run("-I", c.id, "-X", "-Y", "-W", "-H", svgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "> not a prompt\n>> nor this\n" + c.want; string(out) != want {
+			t.Errorf("%s: got %q, want %q", c.id, out, want)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Errorf("shell exited with %s", err)
+	}
+	if len(tempFiles) != 0 {
+		t.Errorf("left %v behind", tempFiles)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"a.svg", "", "my drawing.svg", "it's", `a\b "c" $d`} {
+		if got := fakeShellSplit("-I " + shellQuote(s)); len(got) != 2 || got[1] != s {
+			t.Errorf("%q: split back as %q", s, got)
+		}
+	}
+}
+
+func TestBackgroundColor(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	logPath := filepath.Join(dir, "inkscape.log")
+	run := func(args ...string) (query, export string, links []linkJSON) {
+		t.Helper()
+		os.Remove(logPath)
+		args = append(append([]string{"-no-cache", "-links-out", "links.json"}, args...), "a.svg", "a.pdf")
+		_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_LOG=" + logPath}, args...)
+		if code != 0 {
+			t.Fatalf("%q: failed with %d: %s", args, code, stderr)
+		}
+		b, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			switch {
+			case strings.HasPrefix(l, "--query-all "):
+				query = l
+			case strings.Contains(l, "--export-type=pdf"):
+				export = l
+			}
+		}
+		return query, export, readLinksJSON(t, filepath.Join(dir, "links.json"))
+	}
+	plainQuery, plainExport, plainLinks := run()
+	if plainQuery == "" || plainExport == "" || strings.Contains(plainExport, "--export-background") {
+		t.Fatalf("queried with %q and exported with %q, want no background", plainQuery, plainExport)
+	}
+	for _, c := range []struct {
+		color, want string
+	}{
+		{"#336699", "--export-background #336699 "},
+		{"#33669980", "--export-background #336699 --export-background-opacity 0.502 "},
+	} {
+		query, export, links := run("-background-color", c.color)
+		if !strings.Contains(export, c.want) {
+			t.Errorf("%s: exported with %q, want %q", c.color, export, c.want)
+		}
+
+		// The background isn't an object, so the query and the boxes it
+		// gives are the same with or without it. The temporary SVG has
+		// another name each time.
+		re := regexp.MustCompile(`\.svglinkify-\d+`)
+		if re.ReplaceAllString(query, "") != re.ReplaceAllString(plainQuery, "") {
+			t.Errorf("%s: queried with %q, want %q", c.color, query, plainQuery)
+		}
+		if !reflect.DeepEqual(links, plainLinks) {
+			t.Errorf("%s: got links %+v, want %+v as without a background", c.color, links, plainLinks)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-background-color", "#33669"}, "invalid color '#33669' - expected #rrggbb or #rrggbbaa"},
+		{[]string{"-background-color", "#336699zz"}, "invalid color '#336699zz' - expected #rrggbb or #rrggbbaa"},
+		{[]string{"-background-color", "notacolor"}, "invalid color 'notacolor' - expected #rrggbb or #rrggbbaa"},
+		{[]string{"-background-color", "#33669980", "-background-opacity", "0.5"}, "-background-opacity cannot be used with a -background-color that has an opacity"},
+	} {
+		_, stderr, code := runSvglinkify(t, dir, tools, "", nil, append(c.args, "a.svg", "b.pdf")...)
+		if code == 0 || !strings.Contains(stderr, c.want) {
+			t.Errorf("%q: exited with %d: %s, want %q", c.args, code, stderr, c.want)
+		}
+	}
+}
+
+func TestDanglingInternalLink(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", strings.Replace(linkSVG, `href="#r1"`, `href="#missing"`, 1))
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-no-cache", "a.svg", "a.pdf")
+	if code == 0 || !strings.Contains(stderr, "link '#missing' points to non-existing object - ignoring link") {
+		t.Errorf("exited with %d: %s, want the dangling link reported", code, stderr)
+	}
+	pdf, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other link is still added, and the dangling one not even with an
+	// empty action
+	annots := readPDFAnnots(t, pdf)
+	if len(annots) != 1 || annots[0].URI != "https://example.com/" {
+		t.Errorf("got annotations %v, want only the external link", annots)
+	}
+	if regexp.MustCompile(`/S\s*>>`).Match(pdf) {
+		t.Errorf("PDF has an action without a type")
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.svg", linkSVG)
+	writeFile(t, dir, "dangling.svg", strings.Replace(linkSVG, `href="#r1"`, `href="#missing"`, 1))
+	for _, c := range []struct {
+		stage, message string
+		code           int
+		env            []string
+		args           []string
+	}{
+		{"setup", "-jobs must be at least 1", 2, nil, []string{"-jobs", "0", "a.svg", "a.pdf"}},
+		{"parse", "open missing.svg: no such file or directory", 3, nil, []string{"missing.svg", "a.pdf"}},
+		{"render", "inkscape errored when calculating bounding boxes", 4, []string{"FAKE_INKSCAPE_QUERY=" + filepath.Join(dir, "none.txt")}, []string{"a.svg", "a.pdf"}},
+		{"linkify", "cannot find startxref in PDF", 5, []string{"FAKE_INKSCAPE_TRUNCATE=1"}, []string{"a.svg", "a.pdf"}},
+		{"links", "1 link(s) could not be resolved: #missing", 6, nil, []string{"dangling.svg", "a.pdf"}},
+	} {
+		args := append([]string{"-no-cache"}, c.args...)
+		_, stderr, code := runSvglinkify(t, dir, tools, "", c.env, append([]string{"-error-format", "json"}, args...)...)
+		if code != c.code {
+			t.Errorf("%s: exited with %d, want %d: %s", c.stage, code, c.code, stderr)
+		}
+		lines := strings.Split(strings.TrimSpace(stderr), "\n")
+		var e struct {
+			Stage   string `json:"stage"`
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		}
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &e); err != nil {
+			t.Errorf("%s: last line of %q isn't JSON: %s", c.stage, stderr, err)
+			continue
+		}
+		if e.Stage != c.stage || e.Code != c.code || !strings.Contains(e.Message, c.message) {
+			t.Errorf("%s: got %+v, want the stage, code %d and a message with %q", c.stage, e, c.code, c.message)
+		}
+
+		// By default, every failure is a plain message and status 1
+		_, stderr, code = runSvglinkify(t, dir, tools, "", c.env, args...)
+		if code != 1 || strings.Contains(stderr, `"stage"`) || !strings.Contains(stderr, c.message) {
+			t.Errorf("%s: exited with %d: %s, want a plain message and 1", c.stage, code, stderr)
+		}
+	}
+	_, stderr, code := runSvglinkify(t, dir, tools, "", nil, "-error-format", "xml", "a.svg", "a.pdf")
+	if code == 0 || !strings.Contains(stderr, "unknown -error-format 'xml'") {
+		t.Errorf("exited with %d: %s, want the unknown format reported", code, stderr)
+	}
+}
+
+func TestToolError(t *testing.T) {
+	err := toolError("inkscape errored", "inkscape export", []byte("first\r\n\n  \nsecond  \n"))
+	if want := "inkscape errored\ninkscape export: first\ninkscape export: second"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+	if err := toolError("inkscape errored", "inkscape export", nil); err.Error() != "inkscape errored" {
+		t.Errorf("got %q without stderr, want the message alone", err)
+	}
+}
+
+func TestToolStderr(t *testing.T) {
+	tools := fakeTools(t)
+	dir := t.TempDir()
+	svgPath := writeFile(t, dir, "a.svg", linkSVG)
+	pdfPath := filepath.Join(dir, "a.pdf")
+	inkscape := &inkscapeBackend{path: filepath.Join(tools, "inkscape"), major: 1}
+	rsvg := &rsvgBackend{path: filepath.Join(tools, "rsvg-convert")}
+	for _, c := range []struct {
+		name, fail string
+		run        func() error
+		want       string
+	}{
+		// What the tool wrote is kept, each line saying which stage
+		// failed, so the query and export running at once can be told
+		// apart
+		{"inkscape query", "query", func() error {
+			_, err := inkscape.queryBoundingBoxes(context.Background(), svgPath, nil)
+			return err
+		}, "inkscape errored when calculating bounding boxes\n" +
+			"inkscape query: ** WARNING **: fake query warning\n" +
+			"inkscape query: fake query failed"},
+		{"inkscape export", "export", func() error {
+			return inkscape.Render(context.Background(), svgPath, pdfPath)
+		}, "inkscape errored while generating PDF\n" +
+			"inkscape export: ** WARNING **: fake export warning\n" +
+			"inkscape export: fake export failed"},
+		{"rsvg-convert export", "export", func() error {
+			return rsvg.Render(context.Background(), svgPath, pdfPath)
+		}, "rsvg-convert errored while generating PDF\n" +
+			"rsvg-convert export: ** WARNING **: fake export warning\n" +
+			"rsvg-convert export: fake export failed"},
+	} {
+		t.Setenv("FAKE_INKSCAPE_FAIL", c.fail)
+		if err := c.run(); err == nil || err.Error() != c.want {
+			t.Errorf("%s: got error %q, want %q", c.name, err, c.want)
+		}
+	}
+
+	// and it reaches the user whole
+	_, stderr, code := runSvglinkify(t, dir, tools, "", []string{"FAKE_INKSCAPE_FAIL=export"}, "-no-cache", "a.svg", "a.pdf")
+	if code == 0 || !strings.Contains(stderr, "inkscape errored while generating PDF\n"+
+		"inkscape export: ** WARNING **: fake export warning\ninkscape export: fake export failed\n") {
+		t.Errorf("exited with %d: %s, want the export's stderr in the error", code, stderr)
+	}
+}
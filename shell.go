@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// inkscapeShell is a running inkscape --shell, which takes command lines as
+// they'd be given to inkscape on its stdin and answers each with what
+// inkscape would output followed by a '>' prompt. It saves starting inkscape
+// for each of many queries.
+type inkscapeShell struct {
+	ctx    context.Context
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    *bufio.Reader
+	stderr bytes.Buffer
+
+	// markerPath is the SVG of the marker query, see shellMarkerSVG
+	markerPath string
+}
+
+// shellMarker is the x of the only object in shellMarkerSVG. What inkscape
+// outputs may well have a '>' at the start of a line and come in bits, so
+// rather than waiting for a prompt, each command is followed by a query of
+// the object's x, and the command's output is what comes before the answer.
+const shellMarker = 7301
+
+// shellMarkerSVG is the SVG of the marker query
+var shellMarkerSVG = fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1">`+
+	`<rect id="svglinkify-marker" x="%d" y="0" width="1" height="1"/></svg>`, shellMarker)
+
+// startInkscapeShell starts the inkscape at path in shell mode and waits for
+// it to answer the marker query. The shell is killed once ctx is done.
+func startInkscapeShell(ctx context.Context, path string) (*inkscapeShell, error) {
+	marker, err := ioutil.TempFile("", ".svglinkify-*.svg")
+	if err != nil {
+		return nil, err
+	}
+	tempFiles[marker.Name()] = true
+	_, err = marker.WriteString(shellMarkerSVG)
+	if cerr := marker.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(marker.Name())
+		delete(tempFiles, marker.Name())
+		return nil, err
+	}
+	s := &inkscapeShell{ctx: ctx, cmd: exec.CommandContext(ctx, path, "--shell"), markerPath: marker.Name()}
+	s.cmd.Env = cLocaleEnv()
+	s.cmd.Stderr = &s.stderr
+	in, err := s.cmd.StdinPipe()
+	if err != nil {
+		s.removeMarker()
+		return nil, err
+	}
+	out, err := s.cmd.StdoutPipe()
+	if err != nil {
+		s.removeMarker()
+		return nil, err
+	}
+	s.in, s.out = in, bufio.NewReader(out)
+	verbosef("running %s", strings.Join(s.cmd.Args, " "))
+	if err := s.cmd.Start(); err != nil {
+		s.removeMarker()
+		return nil, err
+	}
+
+	// Whatever inkscape says on starting comes before the answer
+
+	if _, err := s.send(""); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// run has the shell run inkscape with the given arguments and returns what
+// it outputs
+func (s *inkscapeShell) run(args ...string) ([]byte, error) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	line := strings.Join(quoted, " ")
+	verbosef("inkscape shell: %s", line)
+	return s.send(line + "\n")
+}
+
+// send writes the command lines to the shell followed by the marker query,
+// and returns what the shell outputs before answering it, without the
+// prompt. The prompt after the answer is read too, so the next send starts
+// afresh.
+func (s *inkscapeShell) send(lines string) ([]byte, error) {
+	query := fmt.Sprintf("-I svglinkify-marker -X %s\n", shellQuote(s.markerPath))
+	if _, err := io.WriteString(s.in, lines+query); err != nil {
+		return nil, s.exitError(err)
+	}
+	var buf []byte
+	for {
+		line, err := s.out.ReadBytes('\n')
+		if err != nil {
+			return nil, s.exitError(err)
+		}
+
+		// The answer follows the prompt for the marker query, after
+		// any output of the commands that doesn't end in a newline
+
+		i := bytes.LastIndexByte(line, '>')
+		if i >= 0 {
+			if v, err := strconv.ParseFloat(string(bytes.TrimSpace(line[i+1:])), 64); err == nil && v == shellMarker {
+				if _, err := s.out.ReadByte(); err != nil {
+					return nil, s.exitError(err)
+				}
+				return append(buf, line[:i]...), nil
+			}
+		}
+		buf = append(buf, line...)
+	}
+}
+
+// exitError returns the error for the shell having stopped answering, which
+// reading from or writing to it failed with err
+func (s *inkscapeShell) exitError(err error) error {
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("inkscape was stopped while calculating bounding boxes: %s", s.ctx.Err())
+	}
+	// Its stderr is only complete once it has exited
+
+	s.in.Close()
+	s.cmd.Wait()
+	msg := "inkscape shell exited unexpectedly"
+	if err != io.EOF {
+		msg += ": " + err.Error()
+	}
+	return toolError(msg, "inkscape shell", s.stderr.Bytes())
+}
+
+// close asks the shell to quit and waits for it to exit, if it hasn't yet
+func (s *inkscapeShell) close() error {
+	io.WriteString(s.in, "quit\n")
+	s.in.Close()
+	err := s.cmd.Wait()
+	s.removeMarker()
+	return err
+}
+
+// removeMarker removes the SVG of the marker query
+func (s *inkscapeShell) removeMarker() {
+	os.Remove(s.markerPath)
+	delete(tempFiles, s.markerPath)
+}
+
+// shellQuote quotes s for the inkscape shell, which splits command lines
+// like a POSIX shell does
+func shellQuote(s string) string {
+	if s != "" && strings.IndexAny(s, " \t\n'\"\\$`*?[]{}()<>|&;#~") < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}